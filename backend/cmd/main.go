@@ -1,11 +1,14 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
 	"path/filepath"
 
+	"github.com/goyalg325/whiz/backend/internal/ai"
 	"github.com/goyalg325/whiz/backend/internal/api"
+	"github.com/goyalg325/whiz/backend/internal/auth"
 	"github.com/goyalg325/whiz/backend/internal/db"
 	"github.com/goyalg325/whiz/backend/internal/user"
 	"github.com/goyalg325/whiz/backend/internal/ws"
@@ -46,22 +49,72 @@ func main() {
 		log.Fatalf("could not initialize database connection: %s", err)
 	}
 
-	// Clean up any numeric channels that were created by mistake
-	if err := dbConn.CleanupNumericChannels(); err != nil {
-		log.Printf("Warning: Failed to cleanup numeric channels: %v", err)
+	// `main migrate [up|down [steps]|status]` manages the schema and exits
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrateCommand(dbConn, os.Args[2:]); err != nil {
+			log.Fatalf("migration failed: %s", err)
+		}
+		return
+	}
+
+	if err := dbConn.MigrateUp(context.Background()); err != nil {
+		log.Fatalf("could not apply database migrations: %s", err)
+	}
+
+	keys, err := auth.LoadKeySetFromEnv()
+	if err != nil {
+		log.Fatalf("could not load token signing keys: %s", err)
 	}
 
+	sessions := auth.NewSessions(auth.NewSessionRepository(dbConn.GetDB()), keys)
+
 	userRep := user.NewRepository(dbConn.GetDB())
-	userSvc := user.NewService(userRep)
+	userSvc := user.NewService(userRep, sessions)
 	userHandler := user.NewHandler(userSvc)
 
-	// Initialize AI handler
-	aiHandler := api.NewAIHandler(dbConn)
+	aiProvider, err := ai.NewProviderFromEnv()
+	if err != nil {
+		log.Fatalf("could not configure AI provider: %s", err)
+	}
+	promptBudget, err := ai.PromptBudgetFromEnv()
+	if err != nil {
+		log.Fatalf("could not configure AI prompt budget: %s", err)
+	}
+	aiHandler := api.NewAIHandler(dbConn, ai.NewService(aiProvider, promptBudget))
+
+	broker, err := ws.NewBrokerFromEnv(dbConn.GetDB(), db.DSN())
+	if err != nil {
+		log.Fatalf("could not initialize hub broker: %s", err)
+	}
+	defer broker.Close()
+
+	hubConfig, err := ws.HubConfigFromEnv()
+	if err != nil {
+		log.Fatalf("could not configure hub: %s", err)
+	}
 
-	hub := ws.NewHub()
-	wsHandler := ws.NewHandler(hub, dbConn)
+	connConfig, err := ws.ConnConfigFromEnv()
+	if err != nil {
+		log.Fatalf("could not configure websocket limits: %s", err)
+	}
+
+	hub := ws.NewHub(broker, dbConn, hubConfig)
+	wsHandler := ws.NewHandler(hub, dbConn, connConfig, sessions)
+	channelHandler := api.NewChannelHandler(dbConn, hub)
+	dmHandler := api.NewDMHandler(dbConn, hub)
+	searchHandler := api.NewSearchHandler(dbConn)
 	go hub.Run()
 
-	router.InitRouter(userHandler, wsHandler, aiHandler)
+	// Metrics are only served when an internal address is configured
+	if debugAddr := os.Getenv("DEBUG_ADDR"); debugAddr != "" {
+		go func() {
+			log.Printf("Serving metrics on %s/debug/vars", debugAddr)
+			if err := router.StartDebug(debugAddr); err != nil {
+				log.Printf("Metrics listener stopped: %v", err)
+			}
+		}()
+	}
+
+	router.InitRouter(keys, sessions, userHandler, wsHandler, channelHandler, dmHandler, searchHandler, aiHandler)
 	router.Start("0.0.0.0:8080")
 }
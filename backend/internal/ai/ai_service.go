@@ -1,27 +1,29 @@
 package ai
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
 	"strings"
+	"sync"
 	"time"
 )
 
-const (
-	geminiEndpoint = "https://generativelanguage.googleapis.com/v1beta/models/gemini-2.0-flash:generateContent"
-)
-
-type GeminiClient struct {
-	APIKey           string
-	UseMockResponses bool
+// Service writes the prompts for the AI features and sends them to a
+// Provider. If the provider fails the error wraps ErrProviderFailed; the
+// mock only answers when it is the configured provider. The chat history in a prompt is kept within budget
+// tokens: context prompts carry the most relevant window of messages and
+// long summaries are built from summaries of their parts.
+type Service struct {
+	provider Provider
+	budget   int
 }
 
+// ErrProviderFailed is wrapped by the error returned when the provider
+// could not answer for a reason other than the caller's context ending
+var ErrProviderFailed = errors.New("AI provider failed")
+
 type SummaryRequest struct {
 	Messages    []Message
 	StartTime   time.Time
@@ -29,10 +31,14 @@ type SummaryRequest struct {
 	ChannelName string
 }
 
+// ContextRequest asks about one message. Thread is the thread it belongs
+// to and Nearby the messages posted around it in the channel; the prompt
+// carries as many of them as fit the budget.
 type ContextRequest struct {
 	MessageID   int
 	MessageText string
 	Thread      []Message
+	Nearby      []Message
 }
 
 type Message struct {
@@ -43,111 +49,262 @@ type Message struct {
 	Timestamp time.Time
 }
 
-// Gemini API request structure
-type GeminiRequest struct {
-	Contents []Content `json:"contents"`
+const (
+	// targetMarker introduces the message a context prompt asks about
+	targetMarker = "**Target Message:** "
+	// partMarker starts each part summary in a condensed history
+	partMarker = "**Part "
+)
+
+// PromptVersion identifies the current prompts. Bump it when they change so
+// replies stored for the old prompts are no longer reused.
+const PromptVersion = 1
+
+// Reply is a generated answer and the model that wrote it
+type Reply struct {
+	Text  string
+	Model string
 }
 
-type Content struct {
-	Parts []Part `json:"parts"`
+func NewService(provider Provider, budget int) *Service {
+	if budget <= 0 {
+		budget = DefaultPromptBudget
+	}
+	return &Service{
+		provider: provider,
+		budget:   budget,
+	}
 }
 
-type Part struct {
-	Text string `json:"text"`
+// Provider returns the provider prompts are sent to
+func (s *Service) Provider() Provider {
+	return s.provider
 }
 
-// Gemini API response structure
-type GeminiResponse struct {
-	Candidates []struct {
-		Content struct {
-			Parts []struct {
-				Text string `json:"text"`
-			} `json:"parts"`
-		} `json:"content"`
-	} `json:"candidates"`
+// Model names the provider's model, as found in the Model of its replies
+func (s *Service) Model() string {
+	return s.provider.Name()
 }
 
-func NewGeminiClient(apiKey string) *GeminiClient {
-	log.Printf("NewGeminiClient called with API key length: %d", len(apiKey))
-	if len(apiKey) > 0 {
-		log.Printf("API key starts with: %s...", apiKey[:min(10, len(apiKey))])
+func (s *Service) GenerateMessageContext(ctx context.Context, req ContextRequest) (*Reply, error) {
+	if req.MessageID == 0 || req.MessageText == "" {
+		return nil, errors.New("invalid message information")
 	}
+	return s.generate(ctx, s.contextPrompt(req))
+}
 
-	useMock := apiKey == "" || apiKey == "mock-api-key"
-	log.Printf("UseMockResponses set to: %v (empty: %v, mock-api-key: %v)", useMock, apiKey == "", apiKey == "mock-api-key")
-
-	if useMock {
-		log.Println("Using mock responses for Gemini AI - for production, set a valid API key")
-	} else {
-		log.Println("Using real Gemini API with provided API key")
+// StreamMessageContext is GenerateMessageContext delivered a chunk at a
+// time. The returned reply holds the whole text that was sent.
+func (s *Service) StreamMessageContext(ctx context.Context, req ContextRequest, onChunk func(chunk string) error) (*Reply, error) {
+	if req.MessageID == 0 || req.MessageText == "" {
+		return nil, errors.New("invalid message information")
 	}
+	return s.stream(ctx, s.contextPrompt(req), onChunk)
+}
 
-	return &GeminiClient{
-		APIKey:           apiKey,
-		UseMockResponses: useMock,
+func (s *Service) GenerateMissedMessagesSummary(ctx context.Context, req SummaryRequest) (*Reply, error) {
+	if len(req.Messages) == 0 {
+		return &Reply{Text: "No new messages since your last visit."}, nil
+	}
+	history, err := s.condense(ctx, req.Messages)
+	if err != nil {
+		return nil, err
 	}
+	return s.generate(ctx, missedMessagesPrompt(req, history))
 }
 
-func (g *GeminiClient) GenerateSummary(ctx context.Context, req SummaryRequest) (string, error) {
+// StreamMissedMessagesSummary is GenerateMissedMessagesSummary delivered a
+// chunk at a time. Only the final summary is streamed; summarizing the parts
+// of a long backlog happens first.
+func (s *Service) StreamMissedMessagesSummary(ctx context.Context, req SummaryRequest, onChunk func(chunk string) error) (*Reply, error) {
 	if len(req.Messages) == 0 {
-		return "", errors.New("no messages to summarize")
+		text := "No new messages since your last visit."
+		return &Reply{Text: text}, onChunk(text)
 	}
+	history, err := s.condense(ctx, req.Messages)
+	if err != nil {
+		return nil, err
+	}
+	return s.stream(ctx, missedMessagesPrompt(req, history), onChunk)
+}
 
-	// If using mock responses or no API key is set
-	if g.UseMockResponses {
-		return g.generateMockSummary(req)
+// contextPrompt selects the messages to show with the target and writes the prompt
+func (s *Service) contextPrompt(req ContextRequest) string {
+	target := Message{ID: req.MessageID, Content: req.MessageText}
+	for _, m := range req.Thread {
+		if m.ID == req.MessageID {
+			target = m
+		}
 	}
+	window := SelectContextWindow(target, req.Thread, req.Nearby, s.budget)
+	log.Printf("Context for message %d uses %d of %d thread and nearby messages", req.MessageID, len(window)-1, len(req.Thread)+len(req.Nearby))
+	return contextPrompt(req, window)
+}
 
-	// Prepare conversation history for Gemini
-	var conversationText string
-	for _, msg := range req.Messages {
-		timeStr := msg.Timestamp.Format("15:04:05")
-		conversationText += fmt.Sprintf("[%s] %s: %s\n", timeStr, msg.Username, msg.Content)
+// condense returns the transcript of messages if the provider counts it
+// within the budget. Otherwise the messages are split into parts that fit,
+// each part is summarized (map) and the part summaries are merged until
+// they fit (reduce). At most maxSummaryParts of the newest parts are used.
+func (s *Service) condense(ctx context.Context, messages []Message) (string, error) {
+	// The estimate rules out histories far over budget without sending
+	// them to be counted
+	if transcriptTokens(messages) <= 2*s.budget {
+		transcript := formatTranscript(messages)
+		if s.countTokens(ctx, transcript) <= s.budget {
+			return transcript, nil
+		}
 	}
 
-	prompt := fmt.Sprintf(
-		"Please summarize the following conversation that occurred in the channel '%s' from %s to %s:\n\n%s",
-		req.ChannelName,
-		req.StartTime.Format("Jan 2 15:04"),
-		req.EndTime.Format("Jan 2 15:04"),
-		conversationText,
-	)
+	parts := chunkMessages(messages, s.budget)
+	skipped := omittedMessages(parts)
+	if len(parts) > maxSummaryParts {
+		parts = parts[len(parts)-maxSummaryParts:]
+	}
+	log.Printf("Summarizing %d messages in %d parts (%d older messages left out)", len(messages)-skipped, len(parts), skipped)
+
+	summaries := make([]string, len(parts))
+	err := s.generateAll(ctx, len(parts), func(i int) string {
+		return partSummaryPrompt(parts[i])
+	}, func(i int, reply *Reply) {
+		part := parts[i]
+		summaries[i] = fmt.Sprintf("%s%d, %s to %s, %d messages:** %s", partMarker, i+1,
+			part[0].Timestamp.Format("Jan 2 15:04"), part[len(part)-1].Timestamp.Format("Jan 2 15:04"), len(part), reply.Text)
+	})
+	if err != nil {
+		return "", err
+	}
 
-	response, err := g.callGeminiAPI(ctx, prompt)
+	for round := 0; round < maxReduceRounds && len(summaries) > 1 && s.countTokens(ctx, strings.Join(summaries, "\n\n")) > s.budget; round++ {
+		groups := groupTexts(summaries, s.budget)
+		merged := make([]string, len(groups))
+		err := s.generateAll(ctx, len(groups), func(i int) string {
+			return mergeSummariesPrompt(groups[i])
+		}, func(i int, reply *Reply) {
+			merged[i] = fmt.Sprintf("%s%d:** %s", partMarker, i+1, reply.Text)
+		})
+		if err != nil {
+			return "", err
+		}
+		summaries = merged
+	}
+
+	header := "The conversation is too long to include in full. These are summaries of consecutive parts of it, oldest first"
+	if skipped > 0 {
+		header += fmt.Sprintf("; the %d oldest messages are not covered", skipped)
+	}
+	return header + ":\n\n" + strings.Join(summaries, "\n\n") + "\n", nil
+}
+
+// SummaryOmits returns how many of the oldest messages a summary of messages
+// leaves out because the backlog is longer than maxSummaryParts parts. It
+// depends only on the messages and the budget, so it can be reported
+// before the summary is written.
+func (s *Service) SummaryOmits(messages []Message) int {
+	if transcriptTokens(messages) <= s.budget {
+		return 0
+	}
+	return omittedMessages(chunkMessages(messages, s.budget))
+}
+
+// omittedMessages counts the messages in the parts before the newest maxSummaryParts
+func omittedMessages(parts [][]Message) int {
+	omitted := 0
+	for i := 0; i < len(parts)-maxSummaryParts; i++ {
+		omitted += len(parts[i])
+	}
+	return omitted
+}
+
+// countTokens asks the provider how many tokens text uses, estimating if it cannot say
+func (s *Service) countTokens(ctx context.Context, text string) int {
+	n, err := s.provider.CountTokens(ctx, text)
 	if err != nil {
-		log.Printf("Error calling Gemini API: %v, falling back to mock", err)
-		return g.generateMockSummary(req)
+		log.Printf("Error counting tokens with %s: %v, estimating instead", s.provider.Name(), err)
+		return EstimateTokens(text)
 	}
+	return n
+}
 
-	return response, nil
+// generateAll runs n prompts with bounded concurrency, passing each reply to done
+func (s *Service) generateAll(ctx context.Context, n int, prompt func(i int) string, done func(i int, reply *Reply)) error {
+	sem := make(chan struct{}, summaryConcurrency)
+	errs := make(chan error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			reply, err := s.generate(ctx, prompt(i))
+			if err != nil {
+				errs <- err
+				return
+			}
+			done(i, reply)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
 }
 
-func (g *GeminiClient) GenerateMessageContext(ctx context.Context, req ContextRequest) (string, error) {
-	if req.MessageID == 0 || req.MessageText == "" {
-		return "", errors.New("invalid message information")
+// generate sends a prompt to the provider
+func (s *Service) generate(ctx context.Context, prompt string) (*Reply, error) {
+	log.Printf("Sending prompt of %d bytes to %s", len(prompt), s.provider.Name())
+	response, err := s.provider.Generate(ctx, prompt)
+	if err != nil {
+		return nil, s.failed(ctx, err)
 	}
+	return &Reply{Text: response, Model: s.provider.Name()}, nil
+}
 
-	log.Printf("GenerateMessageContext called - UseMockResponses: %v, APIKey length: %d", g.UseMockResponses, len(g.APIKey))
+// stream sends a prompt to the provider's stream. An error from onChunk is
+// returned as it is.
+func (s *Service) stream(ctx context.Context, prompt string, onChunk func(chunk string) error) (*Reply, error) {
+	log.Printf("Streaming prompt of %d bytes from %s", len(prompt), s.provider.Name())
+	var text strings.Builder
+	var sendErr error
+	collect := func(chunk string) error {
+		text.WriteString(chunk)
+		sendErr = onChunk(chunk)
+		return sendErr
+	}
 
-	// If using mock responses or no API key is set
-	if g.UseMockResponses {
-		log.Printf("Using mock response because UseMockResponses=true")
-		return g.generateMockMessageContext(req)
+	if err := s.provider.Stream(ctx, prompt, collect); err != nil {
+		if sendErr != nil {
+			return nil, sendErr
+		}
+		return nil, s.failed(ctx, err)
 	}
+	return &Reply{Text: text.String(), Model: s.provider.Name()}, nil
+}
 
-	log.Printf("Proceeding with real Gemini API call...")
+// failed turns a provider error into the error to return: the context's
+// own error if it ended, otherwise one wrapping ErrProviderFailed
+func (s *Service) failed(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	log.Printf("Error calling %s: %v", s.provider.Name(), err)
+	return fmt.Errorf("%w: %s: %v", ErrProviderFailed, s.provider.Name(), err)
+}
 
-	// Prepare thread context for Gemini
-	var threadText string
-	for _, msg := range req.Thread {
-		timeStr := msg.Timestamp.Format("15:04:05")
-		threadText += fmt.Sprintf("[%s] %s: %s\n", timeStr, msg.Username, msg.Content)
+// formatTranscript writes one "[15:04:05] user: text" line per message
+func formatTranscript(messages []Message) string {
+	var b strings.Builder
+	for _, msg := range messages {
+		fmt.Fprintf(&b, "[%s] %s: %s\n", msg.Timestamp.Format("15:04:05"), msg.Username, msg.Content)
 	}
+	return b.String()
+}
 
-	prompt := fmt.Sprintf(
+func contextPrompt(req ContextRequest, window []Message) string {
+	return fmt.Sprintf(
 		`You are an intelligent chat assistant helping a user understand the context behind a specific message. 
 
-**Target Message:** "%s"
+`+targetMarker+`"%s"
 
 **Conversation Thread:**
 %s
@@ -162,38 +319,12 @@ Please provide a well-structured analysis that helps the user understand this me
 
 Format your response to be clear and scannable, using bullet points or short paragraphs. Focus on helping the user quickly understand both the immediate message and its place in the broader conversation flow.`,
 		req.MessageText,
-		threadText,
+		formatTranscript(window),
 	)
-
-	log.Printf("Making Gemini API call with prompt length: %d", len(prompt))
-	response, err := g.callGeminiAPI(ctx, prompt)
-	if err != nil {
-		log.Printf("Error calling Gemini API: %v, falling back to mock", err)
-		return g.generateMockMessageContext(req)
-	}
-
-	log.Printf("Gemini API call successful, response length: %d", len(response))
-	return response, nil
 }
 
-func (g *GeminiClient) GenerateMissedMessagesSummary(ctx context.Context, req SummaryRequest) (string, error) {
-	if len(req.Messages) == 0 {
-		return "No new messages since your last visit.", nil
-	}
-
-	// If using mock responses or no API key is set
-	if g.UseMockResponses {
-		return g.generateMockMissedMessagesSummary(req)
-	}
-
-	// Prepare missed messages for Gemini
-	var messagesText string
-	for _, msg := range req.Messages {
-		timeStr := msg.Timestamp.Format("15:04:05")
-		messagesText += fmt.Sprintf("[%s] %s: %s\n", timeStr, msg.Username, msg.Content)
-	}
-
-	prompt := fmt.Sprintf(
+func missedMessagesPrompt(req SummaryRequest, history string) string {
+	return fmt.Sprintf(
 		`You are an intelligent chat assistant helping a user catch up on missed messages in the "%s" channel. 
 
 Since their last visit on %s, there have been %d new messages. Your task is to provide a meaningful, insightful summary that helps the user quickly understand what happened without overwhelming them.
@@ -213,178 +344,24 @@ Keep the summary concise but informative - focus on what the user actually needs
 		req.ChannelName,
 		req.StartTime.Format("Jan 2 at 3:04 PM"),
 		len(req.Messages),
-		messagesText,
+		history,
 	)
-
-	response, err := g.callGeminiAPI(ctx, prompt)
-	if err != nil {
-		log.Printf("Error calling Gemini API: %v, falling back to mock", err)
-		return g.generateMockMissedMessagesSummary(req)
-	}
-
-	return response, nil
 }
 
-// Helper function to call Gemini API
-func (g *GeminiClient) callGeminiAPI(ctx context.Context, prompt string) (string, error) {
-	// The API key should be passed as a query parameter, not in the URL itself
-	url := fmt.Sprintf("%s?key=%s", geminiEndpoint, g.APIKey)
-
-	log.Printf("Making Gemini API call to: %s", geminiEndpoint)
-	log.Printf("Using API key starting with: %s...", g.APIKey[:min(5, len(g.APIKey))])
-
-	// Prepare request body
-	reqBody := GeminiRequest{
-		Contents: []Content{
-			{
-				Parts: []Part{
-					{
-						Text: prompt,
-					},
-				},
-			},
-		},
-	}
+func partSummaryPrompt(messages []Message) string {
+	return fmt.Sprintf(
+		`Summarize this part of a chat conversation in a few sentences. Keep the topics discussed, decisions, action items, open questions and who was involved; leave out small talk.
 
-	jsonData, err := json.Marshal(reqBody)
-	if err != nil {
-		log.Printf("Error marshaling request: %v", err)
-		return "", fmt.Errorf("error marshaling request: %w", err)
-	}
-
-	// Create HTTP request
-	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
-	if err != nil {
-		log.Printf("Error creating request: %v", err)
-		return "", fmt.Errorf("error creating request: %w", err)
-	}
-
-	req.Header.Set("Content-Type", "application/json")
-
-	// Send request
-	log.Printf("Sending request to Gemini API...")
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Printf("Error sending request: %v", err)
-		return "", fmt.Errorf("error sending request: %w", err)
-	}
-	defer resp.Body.Close()
-
-	// Read response
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.Printf("Error reading response: %v", err)
-		return "", fmt.Errorf("error reading response: %w", err)
-	}
-
-	log.Printf("Received response with status: %d", resp.StatusCode)
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("API error response: %s", string(body))
-		return "", fmt.Errorf("API returned non-200 status: %d, body: %s", resp.StatusCode, string(body))
-	}
-
-	// Parse response
-	var geminiResp GeminiResponse
-	err = json.Unmarshal(body, &geminiResp)
-	if err != nil {
-		log.Printf("Error unmarshaling response: %v, response body: %s", err, string(body))
-		return "", fmt.Errorf("error unmarshaling response: %w", err)
-	}
-
-	// Extract text from response
-	if len(geminiResp.Candidates) == 0 || len(geminiResp.Candidates[0].Content.Parts) == 0 {
-		log.Printf("Empty response from Gemini API: %s", string(body))
-		return "", errors.New("empty response from Gemini API")
-	}
-
-	log.Printf("Successfully extracted text from Gemini API response")
-	return geminiResp.Candidates[0].Content.Parts[0].Text, nil
-}
-
-// Helper function for safe substring
-func min(a, b int) int {
-	if a < b {
-		return a
-	}
-	return b
-}
-
-// Mock response generators
-func (g *GeminiClient) generateMockSummary(req SummaryRequest) (string, error) {
-	return fmt.Sprintf("Here's a summary of the conversation in %s from %s to %s: [AI-generated summary would appear here, summarizing %d messages]",
-		req.ChannelName,
-		req.StartTime.Format("Jan 2 15:04"),
-		req.EndTime.Format("Jan 2 15:04"),
-		len(req.Messages)), nil
-}
-
-func (g *GeminiClient) generateMockMessageContext(req ContextRequest) (string, error) {
-	// Analyze the message and thread to provide a meaningful mock response
-	messageText := req.MessageText
-	threadCount := len(req.Thread)
-
-	// Try to determine if it's a question, response, or statement
-	isQuestion := strings.Contains(strings.ToLower(messageText), "?") ||
-		strings.HasPrefix(strings.ToLower(messageText), "how ") ||
-		strings.HasPrefix(strings.ToLower(messageText), "what ") ||
-		strings.HasPrefix(strings.ToLower(messageText), "why ") ||
-		strings.HasPrefix(strings.ToLower(messageText), "when ") ||
-		strings.HasPrefix(strings.ToLower(messageText), "where ")
-
-	var analysis string
-	if isQuestion {
-		analysis = "**Message Type:** Question seeking information or clarification\n\n**Context:** This message is asking for input from the team about a specific topic that came up in the recent discussion."
-	} else if strings.Contains(strings.ToLower(messageText), "thanks") || strings.Contains(strings.ToLower(messageText), "got it") {
-		analysis = "**Message Type:** Acknowledgment or appreciation\n\n**Context:** This message is responding to help or information provided earlier in the conversation."
-	} else {
-		analysis = "**Message Type:** Information sharing or discussion contribution\n\n**Context:** This message is contributing new information or perspective to the ongoing discussion."
-	}
-
-	threadInfo := ""
-	if threadCount > 1 {
-		threadInfo = fmt.Sprintf("\n\n**Thread Context:** Part of an active conversation with %d messages. The discussion appears to be focused on collaborative work or problem-solving.", threadCount)
-	} else {
-		threadInfo = "\n\n**Thread Context:** This appears to be the start of a new conversation topic."
-	}
-
-	return fmt.Sprintf("🔍 **Message Analysis**\n\n%s%s\n\n**Significance:** This message helps move the conversation forward by either requesting information, providing updates, or acknowledging team input.\n\n*Note: This is a sample analysis. Enable Gemini AI for detailed contextual understanding.*",
-		analysis, threadInfo), nil
+%s`,
+		formatTranscript(messages),
+	)
 }
 
-func (g *GeminiClient) generateMockMissedMessagesSummary(req SummaryRequest) (string, error) {
-	// Get some basic info about the messages
-	messageCount := len(req.Messages)
-	if messageCount == 0 {
-		return "No new messages since your last visit.", nil
-	}
+func mergeSummariesPrompt(summaries []string) string {
+	return fmt.Sprintf(
+		`These are summaries of consecutive parts of a chat conversation, oldest first. Combine them into one summary of a few sentences that keeps the topics discussed, decisions, action items, open questions and who was involved.
 
-	// Get unique participants
-	participants := make(map[string]bool)
-	for _, msg := range req.Messages {
-		participants[msg.Username] = true
-	}
-
-	participantList := make([]string, 0, len(participants))
-	for username := range participants {
-		participantList = append(participantList, username)
-	}
-
-	// Create a more realistic mock summary
-	var summary string
-	if messageCount <= 3 {
-		summary = fmt.Sprintf("**Main Activity:** Brief conversation between %d participants. The discussion covered general topics and casual chat.", len(participantList))
-	} else if messageCount <= 10 {
-		summary = fmt.Sprintf("**Main Topics:** Active discussion with %d participants (%s and others) covering several topics. Key conversations included project updates and general coordination.", len(participantList), participantList[0])
-	} else {
-		summary = fmt.Sprintf("**Busy Period:** High activity with %d messages from %d participants. Main themes included ongoing project discussions, planning sessions, and team coordination. %s was particularly active in driving conversations.", messageCount, len(participantList), participantList[0])
-	}
-
-	return fmt.Sprintf("📊 **Channel Update for #%s**\n\n%s\n\n**Period:** %s to %s\n**Messages:** %d total\n**Participants:** %s\n\n*Note: This is a sample summary. Enable Gemini AI for detailed analysis.*",
-		req.ChannelName,
-		summary,
-		req.StartTime.Format("Jan 2 at 3:04 PM"),
-		req.EndTime.Format("3:04 PM"),
-		messageCount,
-		fmt.Sprintf("%v", participantList)), nil
+%s`,
+		strings.Join(summaries, "\n\n"),
+	)
 }
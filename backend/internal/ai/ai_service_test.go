@@ -0,0 +1,264 @@
+package ai
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testProvider answers like the mock, can be made to fail and records the
+// prompts it was sent
+type testProvider struct {
+	MockProvider
+	// fail makes Generate and Stream return an error
+	fail bool
+	// failAfter makes Stream fail after sending this many chunks
+	failAfter int
+	// hang makes Generate and Stream wait for ctx to end, then fail
+	hang bool
+	// tokens, when set, is what CountTokens reports for every text
+	tokens int
+
+	mu      sync.Mutex
+	prompts []string
+	counted int
+}
+
+func (p *testProvider) Name() string {
+	return "test"
+}
+
+func (p *testProvider) Generate(ctx context.Context, prompt string) (string, error) {
+	p.mu.Lock()
+	p.prompts = append(p.prompts, prompt)
+	p.mu.Unlock()
+	if p.hang {
+		<-ctx.Done()
+		return "", errors.New("request aborted")
+	}
+	if p.fail {
+		return "", errors.New("provider is down")
+	}
+	return p.MockProvider.Generate(ctx, prompt)
+}
+
+func (p *testProvider) Stream(ctx context.Context, prompt string, onChunk func(chunk string) error) error {
+	p.mu.Lock()
+	p.prompts = append(p.prompts, prompt)
+	p.mu.Unlock()
+	if p.hang {
+		<-ctx.Done()
+		return errors.New("request aborted")
+	}
+	if p.fail {
+		return errors.New("provider is down")
+	}
+	sent := 0
+	return p.MockProvider.Stream(ctx, prompt, func(chunk string) error {
+		if p.failAfter > 0 && sent == p.failAfter {
+			return errors.New("connection lost")
+		}
+		sent++
+		return onChunk(chunk)
+	})
+}
+
+func (p *testProvider) CountTokens(ctx context.Context, text string) (int, error) {
+	p.mu.Lock()
+	p.counted++
+	p.mu.Unlock()
+	if p.tokens > 0 {
+		return p.tokens, nil
+	}
+	return EstimateTokens(text), nil
+}
+
+func conversation(n int) []Message {
+	start := time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC)
+	messages := make([]Message, n)
+	for i := range messages {
+		messages[i] = Message{
+			ID:        i + 1,
+			Username:  []string{"alice", "bob", "carol"}[i%3],
+			Content:   fmt.Sprintf("message number %d about the release plan", i+1),
+			Timestamp: start.Add(time.Duration(i) * time.Minute),
+		}
+	}
+	return messages
+}
+
+func summaryRequest(messages []Message) SummaryRequest {
+	return SummaryRequest{
+		Messages:    messages,
+		StartTime:   messages[0].Timestamp,
+		EndTime:     messages[len(messages)-1].Timestamp,
+		ChannelName: "general",
+	}
+}
+
+func TestServiceSummarizesWithMock(t *testing.T) {
+	service := NewService(NewMockProvider(), 0)
+	reply, err := service.GenerateMissedMessagesSummary(context.Background(), summaryRequest(conversation(5)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Model != "mock" {
+		t.Errorf("reply from %s, want mock", reply.Model)
+	}
+	if !strings.Contains(reply.Text, "**Messages:** 5 total") || !strings.Contains(reply.Text, "alice, bob, carol") {
+		t.Errorf("unexpected summary:\n%s", reply.Text)
+	}
+
+	again, _ := service.GenerateMissedMessagesSummary(context.Background(), summaryRequest(conversation(5)))
+	if again.Text != reply.Text {
+		t.Error("mock summary is not deterministic")
+	}
+}
+
+func TestServiceReportsProviderFailures(t *testing.T) {
+	service := NewService(&testProvider{fail: true}, 0)
+
+	reply, err := service.GenerateMissedMessagesSummary(context.Background(), summaryRequest(conversation(3)))
+	if !errors.Is(err, ErrProviderFailed) {
+		t.Errorf("got %+v, %v, want ErrProviderFailed", reply, err)
+	}
+
+	var chunks int
+	reply, err = service.StreamMessageContext(context.Background(), ContextRequest{
+		MessageID:   2,
+		MessageText: "what is the plan?",
+		Thread:      conversation(3),
+	}, func(chunk string) error {
+		chunks++
+		return nil
+	})
+	if !errors.Is(err, ErrProviderFailed) || chunks != 0 {
+		t.Errorf("got %+v, %v after %d chunks, want ErrProviderFailed and nothing sent", reply, err, chunks)
+	}
+}
+
+func TestServiceReturnsContextErrors(t *testing.T) {
+	service := NewService(&testProvider{hang: true}, 0)
+	request := summaryRequest(conversation(3))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := service.GenerateMissedMessagesSummary(ctx, request); err != context.Canceled {
+		t.Errorf("cancelled generate returned %v, want context.Canceled", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := service.StreamMissedMessagesSummary(ctx, request, func(chunk string) error {
+		t.Error("a chunk was sent after the deadline")
+		return nil
+	})
+	if err != context.DeadlineExceeded {
+		t.Errorf("timed out stream returned %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestServiceStreamReturnsSendErrors(t *testing.T) {
+	service := NewService(&testProvider{}, 0)
+	gone := errors.New("client gone")
+	_, err := service.StreamMissedMessagesSummary(context.Background(), summaryRequest(conversation(3)), func(chunk string) error {
+		return gone
+	})
+	if err != gone {
+		t.Errorf("got %v, want the error from onChunk", err)
+	}
+}
+
+func TestServiceStreamFailureAfterFirstChunkIsReturned(t *testing.T) {
+	service := NewService(&testProvider{failAfter: 2}, 0)
+	var chunks int
+	_, err := service.StreamMissedMessagesSummary(context.Background(), summaryRequest(conversation(3)), func(chunk string) error {
+		chunks++
+		return nil
+	})
+	if !errors.Is(err, ErrProviderFailed) {
+		t.Fatalf("stream that broke midway returned %v, want ErrProviderFailed", err)
+	}
+	if chunks != 2 {
+		t.Errorf("got %d chunks, want the 2 sent before the failure", chunks)
+	}
+}
+
+func TestServiceCondensesLongHistories(t *testing.T) {
+	provider := &testProvider{}
+	service := NewService(provider, 500)
+	messages := conversation(200)
+
+	reply, err := service.GenerateMissedMessagesSummary(context.Background(), summaryRequest(messages))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Model != "test" {
+		t.Errorf("reply from %s, want test", reply.Model)
+	}
+
+	final := provider.prompts[len(provider.prompts)-1]
+	if !strings.Contains(final, partMarker) || strings.Contains(final, messages[0].Content+"\n") {
+		t.Errorf("final prompt carries the raw transcript instead of part summaries:\n%s", final)
+	}
+	if len(provider.prompts) < 3 {
+		t.Errorf("%d prompts sent, want several part summaries and the final summary", len(provider.prompts))
+	}
+}
+
+func TestServiceBudgetsWithProviderTokenCount(t *testing.T) {
+	messages := conversation(10)
+
+	short := &testProvider{}
+	if _, err := NewService(short, 500).GenerateMissedMessagesSummary(context.Background(), summaryRequest(messages)); err != nil {
+		t.Fatal(err)
+	}
+	if short.counted == 0 {
+		t.Error("history was not counted by the provider")
+	}
+	if len(short.prompts) != 1 {
+		t.Errorf("%d prompts sent for a history within budget, want 1", len(short.prompts))
+	}
+
+	// The same history is condensed when the provider counts it over budget,
+	// whether the summary is streamed or not
+	long := &testProvider{tokens: 5000}
+	if _, err := NewService(long, 500).StreamMissedMessagesSummary(context.Background(), summaryRequest(messages), func(string) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if len(long.prompts) < 2 {
+		t.Errorf("%d prompts sent for a history counted over budget, want part summaries first", len(long.prompts))
+	}
+}
+
+func TestServiceSummaryOmitsOldestBeyondPartCap(t *testing.T) {
+	provider := &testProvider{}
+	service := NewService(provider, 500)
+
+	if n := service.SummaryOmits(conversation(200)); n != 0 {
+		t.Errorf("%d messages omitted from a backlog within %d parts, want 0", n, maxSummaryParts)
+	}
+
+	messages := conversation(2000)
+	omitted := service.SummaryOmits(messages)
+	if omitted == 0 || omitted >= len(messages) {
+		t.Fatalf("%d of %d messages omitted, want some of the oldest", omitted, len(messages))
+	}
+
+	if _, err := service.GenerateMissedMessagesSummary(context.Background(), summaryRequest(messages)); err != nil {
+		t.Fatal(err)
+	}
+	final := provider.prompts[len(provider.prompts)-1]
+	if want := fmt.Sprintf("the %d oldest messages are not covered", omitted); !strings.Contains(final, want) {
+		t.Errorf("final prompt does not say %q:\n%s", want, final)
+	}
+	for _, prompt := range provider.prompts {
+		if strings.Contains(prompt, messages[omitted-1].Content+"\n") {
+			t.Fatalf("an omitted message was sent to the provider")
+		}
+	}
+}
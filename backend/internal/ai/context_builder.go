@@ -0,0 +1,205 @@
+package ai
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// DefaultPromptBudget is how many tokens of chat history one prompt may carry
+const DefaultPromptBudget = 6000
+
+const (
+	// maxSummaryParts caps the map step of a summary; older messages beyond
+	// it are left out
+	maxSummaryParts = 16
+	// maxReduceRounds caps how many times part summaries are merged
+	maxReduceRounds = 4
+	// summaryConcurrency is how many parts are summarized at once
+	summaryConcurrency = 4
+	// transcriptOverhead is the tokens a transcript line adds to a message: timestamp and punctuation
+	transcriptOverhead = 6
+)
+
+// PromptBudgetFromEnv reads AI_PROMPT_TOKENS, the token budget for the chat
+// history in a prompt, defaulting to DefaultPromptBudget
+func PromptBudgetFromEnv() (int, error) {
+	v := os.Getenv("AI_PROMPT_TOKENS")
+	if v == "" {
+		return DefaultPromptBudget, nil
+	}
+	budget, err := strconv.Atoi(v)
+	if err != nil || budget < 500 {
+		return 0, fmt.Errorf("invalid AI_PROMPT_TOKENS %q, expected a number of at least 500", v)
+	}
+	return budget, nil
+}
+
+// messageTokens estimates the tokens a message takes in a transcript
+func messageTokens(m Message) int {
+	return EstimateTokens(m.Username+m.Content) + transcriptOverhead
+}
+
+func transcriptTokens(messages []Message) int {
+	total := 0
+	for _, m := range messages {
+		total += messageTokens(m)
+	}
+	return total
+}
+
+// SelectContextWindow picks the messages that best explain target and fit
+// in budget tokens, returned oldest first. target always comes first, then
+// the rest of its thread, then nearby messages ranked by the words they
+// share with target and by how close they are to it.
+func SelectContextWindow(target Message, thread, nearby []Message, budget int) []Message {
+	type candidate struct {
+		msg      Message
+		inThread bool
+		overlap  int
+		distance int
+	}
+
+	keywords := wordSet(target.Content)
+	all := make(map[int]*candidate)
+	add := func(messages []Message, inThread bool) {
+		for _, m := range messages {
+			if m.ID == target.ID {
+				continue
+			}
+			if c, ok := all[m.ID]; ok {
+				c.inThread = c.inThread || inThread
+				continue
+			}
+			overlap := 0
+			for word := range wordSet(m.Content) {
+				if keywords[word] {
+					overlap++
+				}
+			}
+			all[m.ID] = &candidate{msg: m, inThread: inThread, overlap: overlap}
+		}
+	}
+	add(thread, true)
+	add(nearby, false)
+
+	// Distance is measured in messages, not IDs, so gaps from other rooms do not count
+	ordered := make([]*candidate, 0, len(all)+1)
+	for _, c := range all {
+		ordered = append(ordered, c)
+	}
+	targetPos := &candidate{msg: target}
+	ordered = append(ordered, targetPos)
+	sort.Slice(ordered, func(i, j int) bool { return ordered[i].msg.ID < ordered[j].msg.ID })
+	var targetIndex int
+	for i, c := range ordered {
+		if c == targetPos {
+			targetIndex = i
+		}
+	}
+	for i, c := range ordered {
+		c.distance = i - targetIndex
+		if c.distance < 0 {
+			c.distance = -c.distance
+		}
+	}
+
+	ranked := make([]*candidate, 0, len(all))
+	for _, c := range ordered {
+		if c != targetPos {
+			ranked = append(ranked, c)
+		}
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		a, b := ranked[i], ranked[j]
+		if a.inThread != b.inThread {
+			return a.inThread
+		}
+		// A few shared words mark a message as related; more than that says little extra
+		if min(a.overlap, 3) != min(b.overlap, 3) {
+			return min(a.overlap, 3) > min(b.overlap, 3)
+		}
+		return a.distance < b.distance
+	})
+
+	selected := []Message{target}
+	used := messageTokens(target)
+	for _, c := range ranked {
+		cost := messageTokens(c.msg)
+		if used+cost > budget {
+			continue
+		}
+		selected = append(selected, c.msg)
+		used += cost
+	}
+	sort.Slice(selected, func(i, j int) bool { return selected[i].ID < selected[j].ID })
+	return selected
+}
+
+// chunkMessages splits messages into consecutive parts of at most budget
+// tokens each. A message larger than budget gets a part of its own.
+func chunkMessages(messages []Message, budget int) [][]Message {
+	var parts [][]Message
+	var current []Message
+	used := 0
+	for _, m := range messages {
+		cost := messageTokens(m)
+		if len(current) > 0 && used+cost > budget {
+			parts = append(parts, current)
+			current, used = nil, 0
+		}
+		current = append(current, m)
+		used += cost
+	}
+	if len(current) > 0 {
+		parts = append(parts, current)
+	}
+	return parts
+}
+
+// groupTexts splits texts into consecutive groups of at most budget tokens,
+// with at least two texts per group so every merge shrinks the list
+func groupTexts(texts []string, budget int) [][]string {
+	var groups [][]string
+	var current []string
+	used := 0
+	for _, t := range texts {
+		cost := EstimateTokens(t)
+		if len(current) >= 2 && used+cost > budget {
+			groups = append(groups, current)
+			current, used = nil, 0
+		}
+		current = append(current, t)
+		used += cost
+	}
+	if len(current) == 1 && len(groups) > 0 {
+		groups[len(groups)-1] = append(groups[len(groups)-1], current[0])
+	} else if len(current) > 0 {
+		groups = append(groups, current)
+	}
+	return groups
+}
+
+// stopWords are left out when comparing messages
+var stopWords = map[string]bool{
+	"the": true, "and": true, "for": true, "are": true, "but": true, "not": true,
+	"you": true, "all": true, "can": true, "was": true, "this": true, "that": true,
+	"with": true, "have": true, "from": true, "they": true, "will": true, "what": true,
+	"about": true, "there": true, "their": true, "just": true, "your": true,
+}
+
+// wordSet returns the distinct lowercase words of three or more letters in text
+func wordSet(text string) map[string]bool {
+	words := make(map[string]bool)
+	for _, w := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if len(w) >= 3 && !stopWords[w] {
+			words[w] = true
+		}
+	}
+	return words
+}
@@ -0,0 +1,166 @@
+package ai
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func msg(id int, content string) Message {
+	return Message{ID: id, Username: "u", Content: content}
+}
+
+func messageIDs(messages []Message) []int {
+	ids := make([]int, len(messages))
+	for i, m := range messages {
+		ids[i] = m.ID
+	}
+	return ids
+}
+
+func TestSelectContextWindowKeepsTargetOverBudget(t *testing.T) {
+	target := msg(10, strings.Repeat("long ", 200))
+	window := SelectContextWindow(target, []Message{msg(9, "reply")}, []Message{msg(11, "next")}, 1)
+	if got := messageIDs(window); !reflect.DeepEqual(got, []int{10}) {
+		t.Errorf("got %v, want only the target", got)
+	}
+}
+
+func TestSelectContextWindowPrefersThreadThenSharedWords(t *testing.T) {
+	target := msg(10, "deploy the database migration tonight")
+	thread := []Message{msg(2, "unrelated chatter"), target}
+	related := msg(3, "database migration deploy checklist")
+	nearby := []Message{msg(9, "lunch plans anyone"), related, msg(11, "sure")}
+
+	budget := messageTokens(target) + messageTokens(thread[0]) + messageTokens(related)
+	window := SelectContextWindow(target, thread, nearby, budget)
+	if got := messageIDs(window); !reflect.DeepEqual(got, []int{2, 3, 10}) {
+		t.Errorf("got %v, want the thread, then the message sharing words, oldest first", got)
+	}
+}
+
+func TestSelectContextWindowPrefersClosestMessages(t *testing.T) {
+	target := msg(10, "zzz")
+	// IDs skip numbers, as other rooms' messages would; distance counts messages
+	nearby := []Message{msg(1, "x"), msg(5, "x"), msg(9, "x"), msg(11, "x"), msg(20, "x")}
+
+	budget := messageTokens(target) + 2*messageTokens(nearby[0])
+	window := SelectContextWindow(target, nil, nearby, budget)
+	if got := messageIDs(window); !reflect.DeepEqual(got, []int{9, 10, 11}) {
+		t.Errorf("got %v, want the two messages next to the target", got)
+	}
+}
+
+func TestSelectContextWindowBudgetEdges(t *testing.T) {
+	target := msg(10, "zzz")
+	huge := msg(9, strings.Repeat("word ", 100))
+	small := msg(8, "x")
+	nearby := []Message{huge, small}
+
+	exact := messageTokens(target) + messageTokens(small)
+	// The closer message is too large, but the smaller one behind it still fits exactly
+	if got := messageIDs(SelectContextWindow(target, nil, nearby, exact)); !reflect.DeepEqual(got, []int{8, 10}) {
+		t.Errorf("budget %d: got %v, want the small message and the target", exact, got)
+	}
+	if got := messageIDs(SelectContextWindow(target, nil, nearby, exact-1)); !reflect.DeepEqual(got, []int{10}) {
+		t.Errorf("budget %d: got %v, want only the target", exact-1, got)
+	}
+}
+
+func TestSelectContextWindowCountsMessagesOnce(t *testing.T) {
+	target := msg(10, "zzz")
+	shared := msg(9, "x")
+	window := SelectContextWindow(target, []Message{shared, target}, []Message{shared, target, msg(11, "y")}, 1000)
+	if got := messageIDs(window); !reflect.DeepEqual(got, []int{9, 10, 11}) {
+		t.Errorf("got %v, want each message once", got)
+	}
+}
+
+func TestChunkMessages(t *testing.T) {
+	a, b, c := msg(1, "same"), msg(2, "same"), msg(3, "same")
+	cost := messageTokens(a)
+	huge := msg(4, strings.Repeat("word ", 100))
+
+	tests := []struct {
+		name     string
+		messages []Message
+		budget   int
+		want     [][]int
+	}{
+		{"empty", nil, 100, nil},
+		{"two fit exactly", []Message{a, b, c}, 2 * cost, [][]int{{1, 2}, {3}}},
+		{"one token short", []Message{a, b, c}, 2*cost - 1, [][]int{{1}, {2}, {3}}},
+		{"all fit", []Message{a, b, c}, 3 * cost, [][]int{{1, 2, 3}}},
+		{"oversized alone", []Message{a, huge, b}, 2 * cost, [][]int{{1}, {4}, {2}}},
+		{"oversized first", []Message{huge, a, b}, 2 * cost, [][]int{{4}, {1, 2}}},
+	}
+	for _, tt := range tests {
+		var got [][]int
+		for _, part := range chunkMessages(tt.messages, tt.budget) {
+			got = append(got, messageIDs(part))
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestChunkMessagesKeepsOrderWithinBudget(t *testing.T) {
+	messages := conversation(50)
+	parts := chunkMessages(messages, 100)
+
+	var flat []Message
+	for _, part := range parts {
+		if len(part) > 1 && transcriptTokens(part) > 100 {
+			t.Errorf("part of %d messages uses %d tokens, over the budget", len(part), transcriptTokens(part))
+		}
+		flat = append(flat, part...)
+	}
+	if !reflect.DeepEqual(messageIDs(flat), messageIDs(messages)) {
+		t.Error("parts do not hold the messages in their original order")
+	}
+}
+
+func TestGroupTexts(t *testing.T) {
+	// tokens returns a text EstimateTokens counts as n tokens, labelled by its first letter
+	tokens := func(label string, n int) string {
+		return label + strings.Repeat("x", 4*n-1)
+	}
+	a, b, c, d, e := tokens("a", 10), tokens("b", 10), tokens("c", 10), tokens("d", 10), tokens("e", 10)
+	big1, big2, big3 := tokens("f", 100), tokens("g", 100), tokens("h", 100)
+
+	tests := []struct {
+		name   string
+		texts  []string
+		budget int
+		want   [][]string
+	}{
+		{"empty", nil, 20, nil},
+		{"single", []string{a}, 20, [][]string{{a}}},
+		{"pairs, leftover joins the last group", []string{a, b, c, d, e}, 20, [][]string{{a, b}, {c, d, e}}},
+		{"three fit exactly", []string{a, b, c, d, e}, 30, [][]string{{a, b, c}, {d, e}}},
+		{"oversized texts still merge in twos", []string{big1, big2, big3, a, b}, 20, [][]string{{big1, big2}, {big3, a, b}}},
+	}
+	for _, tt := range tests {
+		got := groupTexts(tt.texts, tt.budget)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, label(got), label(tt.want))
+		}
+		for _, group := range got {
+			if len(tt.texts) > 1 && len(group) < 2 {
+				t.Errorf("%s: group %v would not shrink the list", tt.name, label([][]string{group}))
+			}
+		}
+	}
+}
+
+// label shortens grouped texts to their first letters for error messages
+func label(groups [][]string) [][]string {
+	short := make([][]string, len(groups))
+	for i, group := range groups {
+		for _, text := range group {
+			short[i] = append(short[i], text[:1])
+		}
+	}
+	return short
+}
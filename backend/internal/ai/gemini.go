@@ -0,0 +1,177 @@
+package ai
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+)
+
+const (
+	geminiBaseURL = "https://generativelanguage.googleapis.com/v1beta/models/"
+	// DefaultGeminiModel is used when AI_MODEL is not set
+	DefaultGeminiModel = "gemini-2.0-flash"
+)
+
+// GeminiClient is the Provider for Google's Gemini API
+type GeminiClient struct {
+	APIKey string
+	Model  string
+	client *http.Client
+}
+
+// Gemini API request structure
+type GeminiRequest struct {
+	Contents []Content `json:"contents"`
+}
+
+type Content struct {
+	Parts []Part `json:"parts"`
+}
+
+type Part struct {
+	Text string `json:"text"`
+}
+
+// Gemini API response structure
+type GeminiResponse struct {
+	Candidates []struct {
+		Content struct {
+			Parts []struct {
+				Text string `json:"text"`
+			} `json:"parts"`
+		} `json:"content"`
+	} `json:"candidates"`
+}
+
+func NewGeminiClient(apiKey, model string) *GeminiClient {
+	return &GeminiClient{
+		APIKey: apiKey,
+		Model:  model,
+		client: &http.Client{},
+	}
+}
+
+func (g *GeminiClient) Name() string {
+	return "gemini/" + g.Model
+}
+
+func (g *GeminiClient) Generate(ctx context.Context, prompt string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	var geminiResp GeminiResponse
+	if err := g.call(ctx, "generateContent", newGeminiRequest(prompt), &geminiResp); err != nil {
+		return "", err
+	}
+
+	// Extract text from response
+	if len(geminiResp.Candidates) == 0 || len(geminiResp.Candidates[0].Content.Parts) == 0 {
+		return "", errors.New("empty response from Gemini API")
+	}
+	return geminiResp.Candidates[0].Content.Parts[0].Text, nil
+}
+
+// Stream uses streamGenerateContent, which sends each part of the reply as
+// a server-sent event
+func (g *GeminiClient) Stream(ctx context.Context, prompt string, onChunk func(chunk string) error) error {
+	resp, err := g.post(ctx, "streamGenerateContent?alt=sse", newGeminiRequest(prompt))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	err = readEventStream(resp.Body, func(data string) error {
+		var chunk GeminiResponse
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return fmt.Errorf("error unmarshaling stream chunk: %w", err)
+		}
+		if len(chunk.Candidates) == 0 {
+			return nil
+		}
+		for _, part := range chunk.Candidates[0].Content.Parts {
+			if part.Text == "" {
+				continue
+			}
+			if err := onChunk(part.Text); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// CountTokens asks Gemini's countTokens endpoint
+func (g *GeminiClient) CountTokens(ctx context.Context, text string) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	var resp struct {
+		TotalTokens int `json:"totalTokens"`
+	}
+	if err := g.call(ctx, "countTokens", newGeminiRequest(text), &resp); err != nil {
+		return 0, err
+	}
+	return resp.TotalTokens, nil
+}
+
+func newGeminiRequest(prompt string) GeminiRequest {
+	return GeminiRequest{
+		Contents: []Content{{Parts: []Part{{Text: prompt}}}},
+	}
+}
+
+// call posts a request to one of the model's methods and decodes the reply into out
+func (g *GeminiClient) call(ctx context.Context, method string, body interface{}, out interface{}) error {
+	resp, err := g.post(ctx, method, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("error reading response: %w", err)
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("error unmarshaling response: %w", err)
+	}
+	return nil
+}
+
+// post sends a request to one of the model's methods and returns the
+// response once it has a 200 status
+func (g *GeminiClient) post(ctx context.Context, method string, body interface{}) (*http.Response, error) {
+	jsonData, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling request: %w", err)
+	}
+
+	url := geminiBaseURL + g.Model + ":" + method
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(jsonData))
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("x-goog-api-key", g.APIKey)
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error sending request: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		errBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		log.Printf("Gemini %s returned %d: %s", method, resp.StatusCode, errBody)
+		return nil, fmt.Errorf("API returned non-200 status: %d", resp.StatusCode)
+	}
+	return resp, nil
+}
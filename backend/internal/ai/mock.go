@@ -0,0 +1,130 @@
+package ai
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// transcriptLine matches the lines formatTranscript writes, capturing the author and text
+var transcriptLine = regexp.MustCompile(`(?m)^\[\d{2}:\d{2}:\d{2}\] ([^:\n]+): (.*)$`)
+
+// MockProvider answers every prompt with a deterministic sample built from
+// the transcript in it. It needs no network access, so it is the default
+// without an API key and the provider to use in tests.
+type MockProvider struct{}
+
+func NewMockProvider() *MockProvider {
+	return &MockProvider{}
+}
+
+func (m *MockProvider) Name() string {
+	return "mock"
+}
+
+func (m *MockProvider) Generate(ctx context.Context, prompt string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	if i := strings.Index(prompt, targetMarker); i >= 0 {
+		target := prompt[i+len(targetMarker):]
+		if end := strings.Index(target, "\n"); end >= 0 {
+			target = target[:end]
+		}
+		return mockMessageContext(strings.Trim(target, `"`), transcriptLine.FindAllStringSubmatch(prompt, -1)), nil
+	}
+	lines := transcriptLine.FindAllStringSubmatch(prompt, -1)
+	if parts := strings.Count(prompt, partMarker); len(lines) == 0 && parts > 0 {
+		return mockCondensedSummary(parts), nil
+	}
+	return mockSummary(lines), nil
+}
+
+// Stream delivers the sample reply a word at a time
+func (m *MockProvider) Stream(ctx context.Context, prompt string, onChunk func(chunk string) error) error {
+	text, err := m.Generate(ctx, prompt)
+	if err != nil {
+		return err
+	}
+	for _, word := range strings.SplitAfter(text, " ") {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := onChunk(word); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MockProvider) CountTokens(ctx context.Context, text string) (int, error) {
+	return EstimateTokens(text), nil
+}
+
+func mockMessageContext(messageText string, thread [][]string) string {
+	lower := strings.ToLower(messageText)
+
+	// Try to determine if it's a question, response, or statement
+	isQuestion := strings.Contains(lower, "?")
+	for _, word := range []string{"how ", "what ", "why ", "when ", "where "} {
+		isQuestion = isQuestion || strings.HasPrefix(lower, word)
+	}
+
+	var analysis string
+	if isQuestion {
+		analysis = "**Message Type:** Question seeking information or clarification\n\n**Context:** This message is asking for input from the team about a specific topic that came up in the recent discussion."
+	} else if strings.Contains(lower, "thanks") || strings.Contains(lower, "got it") {
+		analysis = "**Message Type:** Acknowledgment or appreciation\n\n**Context:** This message is responding to help or information provided earlier in the conversation."
+	} else {
+		analysis = "**Message Type:** Information sharing or discussion contribution\n\n**Context:** This message is contributing new information or perspective to the ongoing discussion."
+	}
+
+	threadInfo := "\n\n**Thread Context:** This appears to be the start of a new conversation topic."
+	if len(thread) > 1 {
+		threadInfo = fmt.Sprintf("\n\n**Thread Context:** Part of an active conversation with %d messages. The discussion appears to be focused on collaborative work or problem-solving.", len(thread))
+	}
+
+	return fmt.Sprintf("🔍 **Message Analysis**\n\n%s%s\n\n**Significance:** This message helps move the conversation forward by either requesting information, providing updates, or acknowledging team input.\n\n*Note: This is a sample analysis. Configure an AI provider for detailed contextual understanding.*",
+		analysis, threadInfo)
+}
+
+// mockCondensedSummary answers prompts that carry part summaries instead of a transcript
+func mockCondensedSummary(parts int) string {
+	return fmt.Sprintf("📊 **Channel Update**\n\n**Busy Period:** Too many messages to read at once, so the conversation was summarized in %d parts. Main themes included ongoing project discussions, planning sessions, and team coordination.\n\n*Note: This is a sample summary. Configure an AI provider for detailed analysis.*", parts)
+}
+
+func mockSummary(lines [][]string) string {
+	if len(lines) == 0 {
+		return "No new messages since your last visit."
+	}
+
+	// Participants ordered by activity, then name, so the output never varies
+	counts := make(map[string]int)
+	for _, line := range lines {
+		counts[line[1]]++
+	}
+	participants := make([]string, 0, len(counts))
+	for username := range counts {
+		participants = append(participants, username)
+	}
+	sort.Slice(participants, func(i, j int) bool {
+		if counts[participants[i]] != counts[participants[j]] {
+			return counts[participants[i]] > counts[participants[j]]
+		}
+		return participants[i] < participants[j]
+	})
+
+	var summary string
+	if len(lines) <= 3 {
+		summary = fmt.Sprintf("**Main Activity:** Brief conversation between %d participants. The discussion covered general topics and casual chat.", len(participants))
+	} else if len(lines) <= 10 {
+		summary = fmt.Sprintf("**Main Topics:** Active discussion with %d participants (%s and others) covering several topics. Key conversations included project updates and general coordination.", len(participants), participants[0])
+	} else {
+		summary = fmt.Sprintf("**Busy Period:** High activity with %d messages from %d participants. Main themes included ongoing project discussions, planning sessions, and team coordination. %s was particularly active in driving conversations.", len(lines), len(participants), participants[0])
+	}
+
+	return fmt.Sprintf("📊 **Channel Update**\n\n%s\n\n**Messages:** %d total\n**Participants:** %s\n\n*Note: This is a sample summary. Configure an AI provider for detailed analysis.*",
+		summary, len(lines), strings.Join(participants, ", "))
+}
@@ -0,0 +1,146 @@
+package ai
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+const (
+	// DefaultOpenAIBaseURL is used when OPENAI_BASE_URL is not set
+	DefaultOpenAIBaseURL = "https://api.openai.com/v1"
+	// DefaultOpenAIModel is used when AI_MODEL is not set
+	DefaultOpenAIModel = "gpt-4o-mini"
+)
+
+// OpenAIClient is the Provider for any server implementing the OpenAI chat
+// completions API, including self-hosted ones such as vLLM, Ollama or
+// llama.cpp. APIKey may be empty for servers that do not check it.
+type OpenAIClient struct {
+	BaseURL string
+	APIKey  string
+	Model   string
+	client  *http.Client
+}
+
+type openAIMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type openAIRequest struct {
+	Model    string          `json:"model"`
+	Messages []openAIMessage `json:"messages"`
+	Stream   bool            `json:"stream,omitempty"`
+}
+
+type openAIResponse struct {
+	Choices []struct {
+		Message openAIMessage `json:"message"`
+		Delta   openAIMessage `json:"delta"`
+	} `json:"choices"`
+}
+
+func NewOpenAIClient(baseURL, apiKey, model string) *OpenAIClient {
+	return &OpenAIClient{
+		BaseURL: strings.TrimRight(baseURL, "/"),
+		APIKey:  apiKey,
+		Model:   model,
+		client:  &http.Client{},
+	}
+}
+
+func (o *OpenAIClient) Name() string {
+	return "openai/" + o.Model
+}
+
+func (o *OpenAIClient) Generate(ctx context.Context, prompt string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	resp, err := o.post(ctx, prompt, false)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var completion openAIResponse
+	if err := json.NewDecoder(resp.Body).Decode(&completion); err != nil {
+		return "", fmt.Errorf("error unmarshaling response: %w", err)
+	}
+	if len(completion.Choices) == 0 {
+		return "", errors.New("empty response from chat completions API")
+	}
+	return completion.Choices[0].Message.Content, nil
+}
+
+// Stream reads the server-sent events of a streamed chat completion
+func (o *OpenAIClient) Stream(ctx context.Context, prompt string, onChunk func(chunk string) error) error {
+	resp, err := o.post(ctx, prompt, true)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	err = readEventStream(resp.Body, func(data string) error {
+		if data == "[DONE]" {
+			return errStreamDone
+		}
+
+		var chunk openAIResponse
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return fmt.Errorf("error unmarshaling stream chunk: %w", err)
+		}
+		if len(chunk.Choices) == 0 || chunk.Choices[0].Delta.Content == "" {
+			return nil
+		}
+		return onChunk(chunk.Choices[0].Delta.Content)
+	})
+	if err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// CountTokens estimates, since the chat completions API has no way to count
+func (o *OpenAIClient) CountTokens(ctx context.Context, text string) (int, error) {
+	return EstimateTokens(text), nil
+}
+
+func (o *OpenAIClient) post(ctx context.Context, prompt string, stream bool) (*http.Response, error) {
+	jsonData, err := json.Marshal(openAIRequest{
+		Model:    o.Model,
+		Messages: []openAIMessage{{Role: "user", Content: prompt}},
+		Stream:   stream,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.BaseURL+"/chat/completions", bytes.NewReader(jsonData))
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if o.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+o.APIKey)
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error sending request: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		errBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		log.Printf("Chat completions API returned %d: %s", resp.StatusCode, errBody)
+		return nil, fmt.Errorf("API returned non-200 status: %d", resp.StatusCode)
+	}
+	return resp, nil
+}
@@ -0,0 +1,107 @@
+package ai
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Provider is a large language model the ai package can prompt
+type Provider interface {
+	// Name identifies the provider and model, e.g. "gemini/gemini-2.0-flash"
+	Name() string
+	// Generate returns the model's complete reply to prompt
+	Generate(ctx context.Context, prompt string) (string, error)
+	// Stream calls onChunk with each piece of the reply as it arrives and
+	// returns once the reply is complete, ctx is done or onChunk fails
+	Stream(ctx context.Context, prompt string, onChunk func(chunk string) error) error
+	// CountTokens returns how many tokens text uses with this model. The
+	// Service uses it to check that a history fits its prompt budget.
+	CountTokens(ctx context.Context, text string) (int, error)
+}
+
+// requestTimeout bounds a single non-streaming call to a provider
+const requestTimeout = 30 * time.Second
+
+// EstimateTokens approximates a token count at four characters per token,
+// for providers that cannot count exactly
+func EstimateTokens(text string) int {
+	return (utf8.RuneCountInString(text) + 3) / 4
+}
+
+// errStreamDone is returned by a readEventStream callback to stop reading early
+var errStreamDone = errors.New("stream done")
+
+// readEventStream calls onData with the data of every server-sent event in
+// r until r ends or onData returns an error. errStreamDone ends it cleanly.
+func readEventStream(r io.Reader, onData func(data string) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			continue
+		}
+		if err := onData(strings.TrimSpace(data)); err == errStreamDone {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading stream: %w", err)
+	}
+	return nil
+}
+
+// NewProviderFromEnv picks the provider named by AI_PROVIDER: "gemini",
+// "openai" for any OpenAI-compatible API (OPENAI_BASE_URL points it at a
+// self-hosted model) or "mock" for deterministic sample answers. Without
+// AI_PROVIDER, Gemini is used when GEMINI_API_KEY is set and the mock
+// otherwise. AI_MODEL overrides the provider's default model.
+func NewProviderFromEnv() (Provider, error) {
+	model := os.Getenv("AI_MODEL")
+	geminiKey := os.Getenv("GEMINI_API_KEY")
+
+	kind := os.Getenv("AI_PROVIDER")
+	if kind == "" {
+		kind = "mock"
+		if geminiKey != "" && geminiKey != "mock-api-key" {
+			kind = "gemini"
+		}
+	}
+
+	switch kind {
+	case "gemini":
+		if geminiKey == "" {
+			return nil, fmt.Errorf("AI_PROVIDER is gemini but GEMINI_API_KEY is not set")
+		}
+		if model == "" {
+			model = DefaultGeminiModel
+		}
+		log.Printf("Using Gemini AI provider with model %s", model)
+		return NewGeminiClient(geminiKey, model), nil
+	case "openai":
+		baseURL := os.Getenv("OPENAI_BASE_URL")
+		if baseURL == "" {
+			baseURL = DefaultOpenAIBaseURL
+		}
+		if model == "" {
+			model = DefaultOpenAIModel
+		}
+		log.Printf("Using OpenAI-compatible AI provider at %s with model %s", baseURL, model)
+		return NewOpenAIClient(baseURL, os.Getenv("OPENAI_API_KEY"), model), nil
+	case "mock":
+		log.Println("Using mock AI provider - set AI_PROVIDER or GEMINI_API_KEY for real responses")
+		return NewMockProvider(), nil
+	default:
+		return nil, fmt.Errorf("unknown AI_PROVIDER %q, expected gemini, openai or mock", kind)
+	}
+}
@@ -0,0 +1,48 @@
+package ai
+
+import "testing"
+
+func TestNewProviderFromEnv(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want string
+	}{
+		{"mock without a key", nil, "mock"},
+		{"mock with the placeholder key", map[string]string{"GEMINI_API_KEY": "mock-api-key"}, "mock"},
+		{"gemini with a key", map[string]string{"GEMINI_API_KEY": "k"}, "gemini/" + DefaultGeminiModel},
+		{"gemini model override", map[string]string{"GEMINI_API_KEY": "k", "AI_MODEL": "gemini-pro"}, "gemini/gemini-pro"},
+		{"explicit mock beats a key", map[string]string{"AI_PROVIDER": "mock", "GEMINI_API_KEY": "k"}, "mock"},
+		{"openai", map[string]string{"AI_PROVIDER": "openai"}, "openai/" + DefaultOpenAIModel},
+		{"self-hosted openai", map[string]string{"AI_PROVIDER": "openai", "OPENAI_BASE_URL": "http://llm:8000/v1", "AI_MODEL": "llama"}, "openai/llama"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range []string{"AI_PROVIDER", "AI_MODEL", "GEMINI_API_KEY", "OPENAI_BASE_URL", "OPENAI_API_KEY"} {
+				t.Setenv(key, tt.env[key])
+			}
+			provider, err := NewProviderFromEnv()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if provider.Name() != tt.want {
+				t.Errorf("got %s, want %s", provider.Name(), tt.want)
+			}
+		})
+	}
+}
+
+func TestNewProviderFromEnvRejectsBadConfig(t *testing.T) {
+	for _, env := range []map[string]string{
+		{"AI_PROVIDER": "gemini"},
+		{"AI_PROVIDER": "claude"},
+	} {
+		for _, key := range []string{"AI_PROVIDER", "AI_MODEL", "GEMINI_API_KEY"} {
+			t.Setenv(key, env[key])
+		}
+		if provider, err := NewProviderFromEnv(); err == nil {
+			t.Errorf("%v: got %s, want an error", env, provider.Name())
+		}
+	}
+}
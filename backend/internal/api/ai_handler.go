@@ -2,50 +2,101 @@ package api
 
 import (
 	"context"
-	"fmt"
+	"errors"
 	"log"
 	"net/http"
-	"os"
 	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/goyalg325/whiz/backend/internal/ai"
+	"github.com/goyalg325/whiz/backend/internal/auth"
 	"github.com/goyalg325/whiz/backend/internal/db"
 )
 
 type AIHandler struct {
-	db       *db.Database
-	aiClient *ai.GeminiClient
+	db db.Repository
+	ai *ai.Service
 }
 
-func NewAIHandler(database *db.Database) *AIHandler {
-	apiKey := os.Getenv("GEMINI_API_KEY")
-	log.Printf("AI Handler initialization - API key length: %d", len(apiKey))
-	if len(apiKey) > 0 {
-		log.Printf("API key starts with: %s...", apiKey[:min(10, len(apiKey))])
-	} else {
-		log.Printf("WARNING: GEMINI_API_KEY environment variable is empty!")
+// Channel history read around a message for its context prompt
+const (
+	contextBefore = 50
+	contextAfter  = 20
+)
+
+func NewAIHandler(database db.Repository, service *ai.Service) *AIHandler {
+	return &AIHandler{
+		db: database,
+		ai: service,
 	}
+}
 
-	aiClient := ai.NewGeminiClient(apiKey)
+// GetMessageContext generates AI context for a specific message, reusing
+// the stored context while none of the messages it was made from changed
+func (h *AIHandler) GetMessageContext(c *gin.Context) {
+	query, ok := h.contextRequest(c)
+	if !ok {
+		return
+	}
+	req := query.req
 
-	return &AIHandler{
-		db:       database,
-		aiClient: aiClient,
+	if out, ok := h.storedOutput(query.key); ok {
+		c.JSON(http.StatusOK, gin.H{
+			"context":     out.Content,
+			"messageId":   req.MessageID,
+			"cached":      true,
+			"generatedAt": out.CreatedAt,
+		})
+		return
+	}
+
+	// Generate AI context
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+
+	log.Printf("Generating AI context...")
+	reply, err := h.ai.GenerateMessageContext(ctx, req)
+	if err != nil {
+		log.Printf("Failed to generate AI context: %v", err)
+		respondGenerateError(c, err, "Failed to generate context")
+		return
 	}
+
+	log.Printf("Successfully generated AI context of %d bytes", len(reply.Text))
+	c.JSON(http.StatusOK, gin.H{
+		"context":     reply.Text,
+		"messageId":   req.MessageID,
+		"cached":      false,
+		"generatedAt": h.storeOutput(query.key, reply, query.started),
+	})
 }
 
-// Helper function for safe substring
-func min(a, b int) int {
-	if a < b {
-		return a
+// StreamMessageContext is GetMessageContext sent as server-sent events while
+// the model writes it
+func (h *AIHandler) StreamMessageContext(c *gin.Context) {
+	query, ok := h.contextRequest(c)
+	if !ok {
+		return
 	}
-	return b
+
+	h.streamOutput(c, query.key, query.started, gin.H{"messageId": query.req.MessageID}, func(ctx context.Context, onChunk func(string) error) (*ai.Reply, error) {
+		return h.ai.StreamMessageContext(ctx, query.req, onChunk)
+	})
 }
 
-// GetMessageContext generates AI context for a specific message
-func (h *AIHandler) GetMessageContext(c *gin.Context) {
+// contextQuery is what a message's context is made from, the key it is
+// stored under and when its messages were read
+type contextQuery struct {
+	req     ai.ContextRequest
+	key     db.AIOutputKey
+	started time.Time
+}
+
+// contextRequest loads the :messageId message and its thread, responding
+// with an error and returning false if it cannot be read
+func (h *AIHandler) contextRequest(c *gin.Context) (*contextQuery, bool) {
+	started := time.Now()
 	messageIdStr := c.Param("messageId")
 	log.Printf("AI Context request for message ID: %s", messageIdStr)
 
@@ -53,61 +104,100 @@ func (h *AIHandler) GetMessageContext(c *gin.Context) {
 	if err != nil {
 		log.Printf("Invalid message ID: %s, error: %v", messageIdStr, err)
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
-		return
+		return nil, false
+	}
+
+	username, ok := authorizedUsername(c)
+	if !ok {
+		return nil, false
 	}
 
 	// Get the message and its thread context from database
 	log.Printf("Getting message and thread for ID: %d", messageId)
-	message, thread, err := h.getMessageWithThread(messageId)
+	message, thread, err := h.getMessageWithThread(messageId, username)
 	if err != nil {
 		log.Printf("Failed to get message with thread: %v", err)
 		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
-		return
+		return nil, false
 	}
 
-	log.Printf("Found message: %s, thread length: %d", message.Content, len(thread))
+	nearby, err := h.nearbyMessages(messageId, message.RoomID)
+	if err != nil {
+		// The thread alone still gives the model something to work with
+		log.Printf("Failed to load messages around %d: %v", messageId, err)
+	}
 
-	// Create context request
+	log.Printf("Found message %d, thread length: %d, nearby: %d", messageId, len(thread), len(nearby))
 	req := ai.ContextRequest{
 		MessageID:   messageId,
 		MessageText: message.Content,
 		Thread:      thread,
+		Nearby:      nearby,
 	}
+	return &contextQuery{
+		req:     req,
+		key:     h.outputKey(db.AIOutputContext, message.RoomID, messageId, append(thread, nearby...)),
+		started: started,
+	}, true
+}
 
-	// Generate AI context
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
+// authorizedUsername returns the authenticated username, rejecting the request
+// if the :username path parameter names somebody else
+func authorizedUsername(c *gin.Context) (string, bool) {
+	claims, ok := auth.GetClaims(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return "", false
+	}
 
-	log.Printf("Generating AI context...")
-	contextText, err := h.aiClient.GenerateMessageContext(ctx, req)
-	if err != nil {
-		log.Printf("Failed to generate AI context: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate context"})
-		return
+	if username := c.Param("username"); username != "" && username != claims.Username {
+		log.Printf("User %s attempted to act as %s", claims.Username, username)
+		c.JSON(http.StatusForbidden, gin.H{"error": "Cannot access another user's data"})
+		return "", false
 	}
 
-	log.Printf("Successfully generated AI context: %s", contextText)
-	c.JSON(http.StatusOK, gin.H{
-		"context":   contextText,
-		"messageId": messageId,
-	})
+	return claims.Username, true
 }
 
-// GetMissedMessagesSummary generates a summary of missed messages for a user in a specific channel
-func (h *AIHandler) GetMissedMessagesSummary(c *gin.Context) {
-	username := c.Param("username")
-	channelName := c.Param("channelName")
-	log.Printf("Getting missed messages summary for user %s in channel %s", username, channelName)
+// respondGenerateError reports a failed generation: 502 when the provider
+// failed, 504 when it ran out of time and 500 with message otherwise
+func respondGenerateError(c *gin.Context, err error, message string) {
+	switch {
+	case errors.Is(err, ai.ErrProviderFailed):
+		c.JSON(http.StatusBadGateway, gin.H{"error": "AI provider unavailable"})
+	case errors.Is(err, context.DeadlineExceeded):
+		c.JSON(http.StatusGatewayTimeout, gin.H{"error": "AI provider timed out"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": message})
+	}
+}
 
-	// Get unread messages for this specific channel only
-	unreadMessages, err := h.db.GetUnreadMessages(username, channelName)
-	if err != nil {
-		log.Printf("Failed to get unread messages for user %s in channel %s: %v", username, channelName, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve unread messages"})
+// authorizeChannel responds with an error and returns false unless the user may read the channel
+func authorizeChannel(c *gin.Context, database db.Repository, username, channelName string) bool {
+	switch err := database.CheckChannelAccess(channelName, username); err {
+	case nil:
+		return true
+	case db.ErrChannelNotFound, db.ErrNotChannelMember:
+		// Non-members cannot tell a private channel from one that does not exist
+		c.JSON(http.StatusNotFound, gin.H{"error": "Channel not found"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check channel access"})
+	}
+	return false
+}
+
+// GetMissedMessagesSummary generates a summary of missed messages for a user in a specific channel.
+// truncated and omittedCount say whether the oldest messages of a very long
+// backlog were left out of it.
+func (h *AIHandler) GetMissedMessagesSummary(c *gin.Context) {
+	missed, ok := h.missedMessages(c)
+	if !ok {
 		return
 	}
+	username, channelName := missed.username, missed.req.ChannelName
+	aiMessages := missed.req.Messages
 
-	if len(unreadMessages) == 0 {
+	if len(aiMessages) == 0 {
 		c.JSON(http.StatusOK, gin.H{
 			"summary":     "No new messages in this channel since your last visit. You're all caught up! 🎉",
 			"username":    username,
@@ -117,55 +207,121 @@ func (h *AIHandler) GetMissedMessagesSummary(c *gin.Context) {
 		return
 	}
 
-	// Convert unread messages to AI format
-	var aiMessages []ai.Message
-	for _, rawMsg := range unreadMessages {
-		timestamp, err := time.Parse("2006-01-02T15:04:05.999999999Z07:00", rawMsg["timestamp"].(string))
-		if err != nil {
-			// Try alternative format
-			timestamp, err = time.Parse(time.RFC3339, rawMsg["timestamp"].(string))
-			if err != nil {
-				timestamp = time.Now()
-			}
-		}
-
-		message := ai.Message{
-			ID:        rawMsg["id"].(int),
-			Content:   rawMsg["content"].(string),
-			Username:  rawMsg["username"].(string),
-			Timestamp: timestamp,
-		}
-		aiMessages = append(aiMessages, message)
+	omitted := h.ai.SummaryOmits(aiMessages)
+	response := gin.H{
+		"username":     username,
+		"channelName":  channelName,
+		"totalCount":   len(aiMessages),
+		"messages":     missed.unread,
+		"truncated":    omitted > 0,
+		"omittedCount": omitted,
 	}
-
-	// Generate AI summary for this channel's missed messages
-	req := ai.SummaryRequest{
-		Messages:    aiMessages,
-		ChannelName: channelName,
-		StartTime:   aiMessages[0].Timestamp,
-		EndTime:     aiMessages[len(aiMessages)-1].Timestamp,
+	if out, ok := h.storedOutput(missed.key); ok {
+		response["summary"] = out.Content
+		response["cached"] = true
+		response["generatedAt"] = out.CreatedAt
+		c.JSON(http.StatusOK, response)
+		return
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 60*time.Second)
 	defer cancel()
 
-	summary, err := h.aiClient.GenerateMissedMessagesSummary(ctx, req)
+	reply, err := h.ai.GenerateMissedMessagesSummary(ctx, missed.req)
 	if err != nil {
 		log.Printf("Error generating summary for channel %s: %v", channelName, err)
-		summary = fmt.Sprintf("Found %d new messages in #%s. AI summary temporarily unavailable.", len(unreadMessages), channelName)
+		respondGenerateError(c, err, "Failed to generate summary")
+		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"summary":     summary,
-		"username":    username,
-		"channelName": channelName,
-		"totalCount":  len(unreadMessages),
-		"messages":    unreadMessages,
+	response["summary"] = reply.Text
+	response["cached"] = false
+	response["generatedAt"] = h.storeOutput(missed.key, reply, missed.started)
+	c.JSON(http.StatusOK, response)
+}
+
+// StreamMissedMessagesSummary is GetMissedMessagesSummary sent as
+// server-sent events while the model writes it
+func (h *AIHandler) StreamMissedMessagesSummary(c *gin.Context) {
+	missed, ok := h.missedMessages(c)
+	if !ok {
+		return
+	}
+
+	omitted := h.ai.SummaryOmits(missed.req.Messages)
+	meta := gin.H{
+		"username":     missed.username,
+		"channelName":  missed.req.ChannelName,
+		"totalCount":   len(missed.req.Messages),
+		"truncated":    omitted > 0,
+		"omittedCount": omitted,
+	}
+	h.streamOutput(c, missed.key, missed.started, meta, func(ctx context.Context, onChunk func(string) error) (*ai.Reply, error) {
+		return h.ai.StreamMissedMessagesSummary(ctx, missed.req, onChunk)
 	})
-} // UpdateUserActivity marks messages as read for a user
+}
+
+// missed is what a missed messages summary is made from, the key it is
+// stored under and when its messages were read
+type missed struct {
+	username string
+	unread   []db.Message
+	req      ai.SummaryRequest
+	key      db.AIOutputKey
+	started  time.Time
+}
+
+// missedMessages loads the caller's unread messages in :channelName,
+// responding with an error and returning false if that fails
+func (h *AIHandler) missedMessages(c *gin.Context) (*missed, bool) {
+	started := time.Now()
+	username, ok := authorizedUsername(c)
+	if !ok {
+		return nil, false
+	}
+	channelName := c.Param("channelName")
+	if !authorizeChannel(c, h.db, username, channelName) {
+		return nil, false
+	}
+	log.Printf("Getting missed messages summary for user %s in channel %s", username, channelName)
+
+	// Get unread messages for this specific channel only
+	unreadMessages, err := h.db.GetUnreadMessages(username, channelName)
+	if err != nil {
+		log.Printf("Failed to get unread messages for user %s in channel %s: %v", username, channelName, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve unread messages"})
+		return nil, false
+	}
+
+	// Convert unread messages to AI format
+	aiMessages := toAIMessages(unreadMessages)
+	req := ai.SummaryRequest{
+		Messages:    aiMessages,
+		ChannelName: channelName,
+	}
+	if len(aiMessages) > 0 {
+		req.StartTime = aiMessages[0].Timestamp
+		req.EndTime = aiMessages[len(aiMessages)-1].Timestamp
+	}
+	return &missed{
+		username: username,
+		unread:   unreadMessages,
+		req:      req,
+		key:      h.outputKey(db.AIOutputMissedSummary, channelName, 0, aiMessages),
+		started:  started,
+	}, true
+}
+
+// UpdateUserActivity marks messages as read for a user
 func (h *AIHandler) UpdateUserActivity(c *gin.Context) {
-	username := c.Param("username")
+	username, ok := authorizedUsername(c)
+	if !ok {
+		return
+	}
 	channelName := c.Param("channelName")
+	if !authorizeChannel(c, h.db, username, channelName) {
+		return
+	}
 	messageIdStr := c.Param("messageId")
 
 	messageId, err := strconv.Atoi(messageIdStr)
@@ -188,62 +344,171 @@ func (h *AIHandler) UpdateUserActivity(c *gin.Context) {
 	})
 }
 
-// Helper function to get message with thread context
-func (h *AIHandler) getMessageWithThread(messageId int) (*ai.Message, []ai.Message, error) {
-	// Get all messages from the same channel around the target message time
-	query := `
-		SELECT id, content, username, created_at
-		FROM messages m
-		WHERE m.channel_id = (
-			SELECT channel_id FROM messages WHERE id = $1
-		)
-		ORDER BY created_at ASC
-	`
+// Helper function to get message with thread context, provided the user can read its channel
+func (h *AIHandler) getMessageWithThread(messageId int, username string) (*db.Message, []ai.Message, error) {
+	message, thread, err := h.db.GetMessageWithThread(messageId)
+	if err != nil {
+		return nil, nil, err
+	}
+	if message.Deleted {
+		return nil, nil, db.ErrMessageNotFound
+	}
+	if err := h.db.CheckChannelAccess(message.RoomID, username); err != nil {
+		return nil, nil, err
+	}
+
+	return message, toAIMessages(thread), nil
+}
 
-	rows, err := h.db.GetDB().Query(query, messageId)
+// nearbyMessages loads the channel history posted just before and after a message
+func (h *AIHandler) nearbyMessages(messageId int, roomId string) ([]ai.Message, error) {
+	before, err := h.db.GetRoomMessages(roomId, db.PageRequest{Before: messageId, Limit: contextBefore})
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to query messages: %v", err)
+		return nil, err
 	}
-	defer rows.Close()
+	after, err := h.db.GetRoomMessages(roomId, db.PageRequest{After: messageId, Limit: contextAfter})
+	if err != nil {
+		return nil, err
+	}
+	return toAIMessages(append(before.Messages, after.Messages...)), nil
+}
 
-	var allMessages []ai.Message
-	var targetMessage *ai.Message
+// toAIMessages converts stored messages to the format the AI client expects,
+// leaving out deleted messages
+func toAIMessages(messages []db.Message) []ai.Message {
+	aiMessages := make([]ai.Message, 0, len(messages))
+	for _, msg := range messages {
+		if msg.Deleted {
+			continue
+		}
+		aiMessages = append(aiMessages, ai.Message{
+			ID:        msg.ID,
+			Content:   msg.Content,
+			Username:  msg.Username,
+			Timestamp: msg.Timestamp,
+		})
+	}
+	return aiMessages
+}
 
-	for rows.Next() {
-		var id int
-		var content, username, createdAt string
-		if err := rows.Scan(&id, &content, &username, &createdAt); err != nil {
-			return nil, nil, fmt.Errorf("failed to scan message: %v", err)
+// outputKey is the key a reply made from messages is stored under. The
+// messages are identified by the range of their IDs, which changes when a
+// message is added and is invalidated when one is edited or deleted.
+func (h *AIHandler) outputKey(kind, channelName string, targetId int, messages []ai.Message) db.AIOutputKey {
+	key := db.AIOutputKey{
+		Kind:           kind,
+		Channel:        channelName,
+		TargetID:       targetId,
+		FirstMessageID: targetId,
+		LastMessageID:  targetId,
+		PromptVersion:  ai.PromptVersion,
+		Model:          h.ai.Model(),
+	}
+	for _, m := range messages {
+		if key.FirstMessageID == 0 || m.ID < key.FirstMessageID {
+			key.FirstMessageID = m.ID
 		}
+		if m.ID > key.LastMessageID {
+			key.LastMessageID = m.ID
+		}
+	}
+	return key
+}
 
-		// Parse timestamp
-		timestamp, err := time.Parse(time.RFC3339, createdAt)
-		if err != nil {
-			// Try alternative format
-			timestamp, err = time.Parse("2006-01-02T15:04:05.999999999Z07:00", createdAt)
-			if err != nil {
-				timestamp = time.Now() // fallback
-			}
+// storedOutput returns the reply stored for key, if there is one
+func (h *AIHandler) storedOutput(key db.AIOutputKey) (*db.AIOutput, bool) {
+	out, err := h.db.GetAIOutput(key)
+	if err != nil {
+		if err != db.ErrAIOutputNotFound {
+			log.Printf("Failed to read stored %s for %s: %v", key.Kind, key.Channel, err)
 		}
+		return nil, false
+	}
+	log.Printf("Reusing %s for %s generated at %s", key.Kind, key.Channel, out.CreatedAt)
+	return out, true
+}
+
+// storeOutput saves a reply for reuse and returns when it was generated.
+// Replies not written by the key's model, such as the canned answer for an
+// empty backlog, are not stored, and neither are replies whose messages
+// were edited or deleted after started, when they were read.
+func (h *AIHandler) storeOutput(key db.AIOutputKey, reply *ai.Reply, started time.Time) time.Time {
+	if reply.Model != key.Model {
+		return time.Now()
+	}
+	out, err := h.db.SaveAIOutput(key, reply.Text, started)
+	if err == db.ErrAIOutputStale {
+		log.Printf("Not storing %s for %s: its messages changed while it was generated", key.Kind, key.Channel)
+		return time.Now()
+	} else if err != nil {
+		log.Printf("Failed to store %s for %s: %v", key.Kind, key.Channel, err)
+		return time.Now()
+	}
+	return out.CreatedAt
+}
 
-		message := ai.Message{
-			ID:        id,
-			Content:   content,
-			Username:  username,
-			Timestamp: timestamp,
+// streamOutput streams the reply stored for key, or generates, streams and
+// stores a new one. The meta event says which with "cached" and "generatedAt".
+func (h *AIHandler) streamOutput(c *gin.Context, key db.AIOutputKey, started time.Time, meta gin.H, generate func(ctx context.Context, onChunk func(string) error) (*ai.Reply, error)) {
+	if out, ok := h.storedOutput(key); ok {
+		meta["cached"] = true
+		meta["generatedAt"] = out.CreatedAt
+		streamSSE(c, meta, func(ctx context.Context, onChunk func(string) error) error {
+			return onChunk(out.Content)
+		})
+		return
+	}
+
+	meta["cached"] = false
+	meta["generatedAt"] = time.Now()
+	streamSSE(c, meta, func(ctx context.Context, onChunk func(string) error) error {
+		reply, err := generate(ctx, onChunk)
+		if err != nil {
+			return err
 		}
+		h.storeOutput(key, reply, started)
+		return nil
+	})
+}
+
+// streamTimeout bounds how long a streamed reply may take
+const streamTimeout = 2 * time.Minute
+
+// streamSSE sends a generated reply as server-sent events: "meta" with the
+// given fields, a "chunk" event with {"text": ...} for each piece of the
+// reply, then "done" or "error". Generation is cancelled as soon as the
+// client disconnects.
+func streamSSE(c *gin.Context, meta gin.H, generate func(ctx context.Context, onChunk func(string) error) error) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), streamTimeout)
+	defer cancel()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
 
-		allMessages = append(allMessages, message)
+	c.SSEvent("meta", meta)
+	c.Writer.Flush()
 
-		// Track the target message
-		if id == messageId {
-			targetMessage = &message
+	err := generate(ctx, func(chunk string) error {
+		if err := c.Request.Context().Err(); err != nil {
+			return err
 		}
-	}
+		c.SSEvent("chunk", gin.H{"text": chunk})
+		c.Writer.Flush()
+		return nil
+	})
 
-	if targetMessage == nil {
-		return nil, nil, fmt.Errorf("message with ID %d not found", messageId)
+	if c.Request.Context().Err() != nil {
+		log.Printf("Client disconnected from %s, stopped generating", c.Request.URL.Path)
+		return
 	}
-
-	return targetMessage, allMessages, nil
+	if err != nil {
+		log.Printf("Streaming %s failed: %v", c.Request.URL.Path, err)
+		c.SSEvent("error", gin.H{"error": "AI response temporarily unavailable"})
+	} else {
+		c.SSEvent("done", gin.H{})
+	}
+	c.Writer.Flush()
 }
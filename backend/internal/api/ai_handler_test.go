@@ -0,0 +1,153 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/goyalg325/whiz/backend/internal/ai"
+	"github.com/goyalg325/whiz/backend/internal/db"
+)
+
+// fakeMessages is one public channel with a short thread. SaveAIOutput
+// refuses replies whose messages were edited after since, as the database does.
+type fakeMessages struct {
+	db.Repository
+
+	mu       sync.Mutex
+	editedAt time.Time
+	saved    []db.AIOutputKey
+}
+
+func (f *fakeMessages) thread() []db.Message {
+	at := time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC)
+	return []db.Message{
+		{ID: 1, Content: "shall we ship today?", Username: "alice", RoomID: "general", Timestamp: at},
+		{ID: 2, Content: "after the migration", Username: "bob", RoomID: "general", Timestamp: at.Add(time.Minute)},
+	}
+}
+
+func (f *fakeMessages) GetMessageWithThread(messageId int) (*db.Message, []db.Message, error) {
+	thread := f.thread()
+	return &thread[0], thread, nil
+}
+
+func (f *fakeMessages) CheckChannelAccess(name, username string) error {
+	return nil
+}
+
+func (f *fakeMessages) GetRoomMessages(roomId string, page db.PageRequest) (*db.MessagePage, error) {
+	return &db.MessagePage{}, nil
+}
+
+func (f *fakeMessages) GetUnreadMessages(username, channelName string) ([]db.Message, error) {
+	return f.thread(), nil
+}
+
+func (f *fakeMessages) GetAIOutput(key db.AIOutputKey) (*db.AIOutput, error) {
+	return nil, db.ErrAIOutputNotFound
+}
+
+func (f *fakeMessages) SaveAIOutput(key db.AIOutputKey, content string, since time.Time) (*db.AIOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.editedAt.After(since) {
+		return nil, db.ErrAIOutputStale
+	}
+	f.saved = append(f.saved, key)
+	return &db.AIOutput{AIOutputKey: key, Content: content, CreatedAt: time.Now()}, nil
+}
+
+// edit marks the thread as edited now
+func (f *fakeMessages) edit() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.editedAt = time.Now()
+}
+
+func (f *fakeMessages) savedCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.saved)
+}
+
+// duringProvider answers like the mock after calling during
+type duringProvider struct {
+	*ai.MockProvider
+	during func()
+}
+
+func (p *duringProvider) Generate(ctx context.Context, prompt string) (string, error) {
+	p.during()
+	return p.MockProvider.Generate(ctx, prompt)
+}
+
+func (p *duringProvider) Stream(ctx context.Context, prompt string, onChunk func(chunk string) error) error {
+	p.during()
+	return p.MockProvider.Stream(ctx, prompt, onChunk)
+}
+
+func TestRespondGenerateError(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		err  error
+		code int
+	}{
+		{fmt.Errorf("%w: gemini: 500 Internal Server Error", ai.ErrProviderFailed), http.StatusBadGateway},
+		{context.DeadlineExceeded, http.StatusGatewayTimeout},
+		{errors.New("invalid message information"), http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		respondGenerateError(c, tt.err, "Failed to generate context")
+		if w.Code != tt.code {
+			t.Errorf("%v: got %d, want %d", tt.err, w.Code, tt.code)
+		}
+	}
+}
+
+func TestAIOutputEditedDuringGenerationIsNotStored(t *testing.T) {
+	paths := []string{
+		"/messages/1/context",
+		"/messages/1/context/stream",
+		"/summaries/missed/alice/general",
+		"/summaries/missed/alice/general/stream",
+	}
+	for _, path := range paths {
+		for _, edited := range []bool{false, true} {
+			repo := &fakeMessages{}
+			provider := &duringProvider{MockProvider: ai.NewMockProvider(), during: func() {}}
+			if edited {
+				provider.during = repo.edit
+			}
+			h := NewAIHandler(repo, ai.NewService(provider, 0))
+
+			r, authed, keys := authedRouter(t)
+			authed.GET("/messages/:messageId/context", h.GetMessageContext)
+			authed.GET("/messages/:messageId/context/stream", h.StreamMessageContext)
+			authed.GET("/summaries/missed/:username/:channelName", h.GetMissedMessagesSummary)
+			authed.GET("/summaries/missed/:username/:channelName/stream", h.StreamMissedMessagesSummary)
+
+			w := do(t, r, keys, "alice", http.MethodGet, path, "")
+			if w.Code != http.StatusOK || (strings.HasSuffix(path, "/stream") && !strings.Contains(w.Body.String(), "event:done")) {
+				t.Fatalf("%s: got %d %s", path, w.Code, w.Body)
+			}
+
+			want := 1
+			if edited {
+				want = 0
+			}
+			if got := repo.savedCount(); got != want {
+				t.Errorf("%s, edited during generation %v: %d replies stored, want %d", path, edited, got, want)
+			}
+		}
+	}
+}
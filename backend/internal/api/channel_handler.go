@@ -0,0 +1,512 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/goyalg325/whiz/backend/internal/auth"
+	"github.com/goyalg325/whiz/backend/internal/db"
+	"github.com/goyalg325/whiz/backend/internal/ws"
+)
+
+// ChannelHandler manages channel membership (joining and leaving, roles,
+// invitations to private channels and requests to join them) and the
+// channel lifecycle: renaming, topics, archiving and deletion
+type ChannelHandler struct {
+	db  db.Repository
+	hub *ws.Hub
+}
+
+func NewChannelHandler(database db.Repository, hub *ws.Hub) *ChannelHandler {
+	return &ChannelHandler{
+		db:  database,
+		hub: hub,
+	}
+}
+
+type InviteReq struct {
+	Username string `json:"username" binding:"required"`
+}
+
+type SetRoleReq struct {
+	Role string `json:"role" binding:"required"`
+}
+
+type RenameChannelReq struct {
+	Name string `json:"name" binding:"required"`
+}
+
+type SetTopicReq struct {
+	Topic string `json:"topic"`
+}
+
+// JoinChannel adds the caller to a public channel, or files a request to
+// join a private one. A name no channel has gets the same answer as a
+// private channel, so joining cannot be used to find private channels.
+func (h *ChannelHandler) JoinChannel(c *gin.Context) {
+	claims, ok := auth.GetClaims(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+	name := c.Param("channelName")
+
+	channel, err := h.db.GetChannel(name)
+	if err == db.ErrChannelNotFound {
+		c.JSON(http.StatusAccepted, gin.H{"message": "Join request sent", "channel": name})
+		return
+	} else if err != nil {
+		h.respondError(c, err)
+		return
+	}
+	if channel.Kind == db.KindDirect {
+		h.respondError(c, db.ErrDirectMessage)
+		return
+	}
+
+	if channel.IsPrivate {
+		if err := h.db.RequestToJoin(channel.Name, claims.Username); err != nil {
+			h.respondError(c, err)
+			return
+		}
+		c.JSON(http.StatusAccepted, gin.H{"message": "Join request sent", "channel": channel.Name})
+		return
+	}
+
+	if err := h.db.AddMember(channel.Name, claims.Username, db.RoleMember); err != nil {
+		h.respondError(c, err)
+		return
+	}
+	h.announce(ws.MessageTypeMemberJoined, channel.Name, claims.Username, "joined the channel")
+	c.JSON(http.StatusOK, gin.H{"message": "Joined channel", "channel": channel.Name})
+}
+
+// LeaveChannel removes the caller from a channel. The owner cannot leave.
+func (h *ChannelHandler) LeaveChannel(c *gin.Context) {
+	claims, channel, ok := h.loadChannel(c)
+	if !ok {
+		return
+	}
+
+	role, err := h.db.GetMemberRole(channel.Name, claims.Username)
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+	if role == db.RoleOwner {
+		c.JSON(http.StatusConflict, gin.H{"error": "The owner cannot leave the channel"})
+		return
+	}
+
+	if err := h.db.RemoveMember(channel.Name, claims.Username); err != nil {
+		h.respondError(c, err)
+		return
+	}
+	h.announceChannel(ws.MessageTypeMemberRemoved, channel.Name, channel, claims.Username, "left the channel")
+	c.JSON(http.StatusOK, gin.H{"message": "Left channel", "channel": channel.Name})
+}
+
+// ListMembers returns the members of a channel the caller can read
+func (h *ChannelHandler) ListMembers(c *gin.Context) {
+	claims, channel, ok := h.loadChannel(c)
+	if !ok {
+		return
+	}
+	if !authorizeChannel(c, h.db, claims.Username, channel.Name) {
+		return
+	}
+
+	members, err := h.db.ListMembers(channel.Name)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list members"})
+		return
+	}
+	c.JSON(http.StatusOK, members)
+}
+
+// RemoveMember takes someone out of a channel. Admins can remove members
+// and only the owner can remove admins; nobody can remove the owner.
+func (h *ChannelHandler) RemoveMember(c *gin.Context) {
+	claims, channel, ok := h.loadChannel(c)
+	if !ok {
+		return
+	}
+	target := c.Param("username")
+
+	callerRole, ok := h.requireRole(c, channel.Name, claims.Username, db.RoleAdmin)
+	if !ok {
+		return
+	}
+	targetRole, err := h.db.GetMemberRole(channel.Name, target)
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+	if targetRole == db.RoleOwner || (targetRole == db.RoleAdmin && callerRole != db.RoleOwner) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Cannot remove a member with an equal or higher role"})
+		return
+	}
+
+	if err := h.db.RemoveMember(channel.Name, target); err != nil {
+		h.respondError(c, err)
+		return
+	}
+	h.announceChannel(ws.MessageTypeMemberRemoved, channel.Name, channel, target, "was removed from the channel")
+	c.JSON(http.StatusOK, gin.H{"message": "Member removed", "channel": channel.Name, "username": target})
+}
+
+// SetMemberRole promotes or demotes a member. Only the owner can change
+// roles, and ownership itself cannot be handed out this way.
+func (h *ChannelHandler) SetMemberRole(c *gin.Context) {
+	claims, channel, ok := h.loadChannel(c)
+	if !ok {
+		return
+	}
+	target := c.Param("username")
+
+	var req SetRoleReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Role != db.RoleAdmin && req.Role != db.RoleMember {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Role must be admin or member"})
+		return
+	}
+
+	if _, ok := h.requireRole(c, channel.Name, claims.Username, db.RoleOwner); !ok {
+		return
+	}
+	if target == claims.Username {
+		c.JSON(http.StatusConflict, gin.H{"error": "The owner cannot change their own role"})
+		return
+	}
+
+	if err := h.db.SetMemberRole(channel.Name, target, req.Role); err != nil {
+		h.respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"channel": channel.Name, "username": target, "role": req.Role})
+}
+
+// InviteMember invites someone to a channel. Admins and the owner can invite.
+func (h *ChannelHandler) InviteMember(c *gin.Context) {
+	claims, channel, ok := h.loadChannel(c)
+	if !ok {
+		return
+	}
+
+	var req InviteReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, ok := h.requireRole(c, channel.Name, claims.Username, db.RoleAdmin); !ok {
+		return
+	}
+
+	if err := h.db.InviteMember(channel.Name, req.Username, claims.Username); err != nil {
+		h.respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Invitation sent", "channel": channel.Name, "username": req.Username})
+}
+
+// ListInvitations returns the invitations waiting for the caller
+func (h *ChannelHandler) ListInvitations(c *gin.Context) {
+	claims, ok := auth.GetClaims(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	invitations, err := h.db.ListInvitations(claims.Username)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list invitations"})
+		return
+	}
+	c.JSON(http.StatusOK, invitations)
+}
+
+// AcceptInvitation makes the caller a member of a channel they were
+// invited to. The invitation is what lets a non-member see a private
+// channel, so without one the answer is 404 whether the channel exists or not.
+func (h *ChannelHandler) AcceptInvitation(c *gin.Context) {
+	claims, ok := auth.GetClaims(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+	name := c.Param("channelName")
+
+	if err := h.db.AcceptInvitation(name, claims.Username); err != nil {
+		h.respondError(c, err)
+		return
+	}
+	h.announce(ws.MessageTypeMemberJoined, name, claims.Username, "joined the channel")
+	c.JSON(http.StatusOK, gin.H{"message": "Joined channel", "channel": name})
+}
+
+// DeclineInvitation discards an invitation to the caller
+func (h *ChannelHandler) DeclineInvitation(c *gin.Context) {
+	claims, ok := auth.GetClaims(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+	name := c.Param("channelName")
+
+	if err := h.db.DeclineInvitation(name, claims.Username); err != nil {
+		h.respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Invitation declined", "channel": name})
+}
+
+// ListJoinRequests returns the pending requests to join a channel, for its admins
+func (h *ChannelHandler) ListJoinRequests(c *gin.Context) {
+	claims, channel, ok := h.loadChannel(c)
+	if !ok {
+		return
+	}
+	if _, ok := h.requireRole(c, channel.Name, claims.Username, db.RoleAdmin); !ok {
+		return
+	}
+
+	requests, err := h.db.ListJoinRequests(channel.Name)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list join requests"})
+		return
+	}
+	c.JSON(http.StatusOK, requests)
+}
+
+// ApproveJoinRequest lets a user who asked to join into the channel
+func (h *ChannelHandler) ApproveJoinRequest(c *gin.Context) {
+	claims, channel, ok := h.loadChannel(c)
+	if !ok {
+		return
+	}
+	if _, ok := h.requireRole(c, channel.Name, claims.Username, db.RoleAdmin); !ok {
+		return
+	}
+	target := c.Param("username")
+
+	if err := h.db.ApproveJoinRequest(channel.Name, target); err != nil {
+		h.respondError(c, err)
+		return
+	}
+	h.announce(ws.MessageTypeMemberJoined, channel.Name, target, "joined the channel")
+	c.JSON(http.StatusOK, gin.H{"message": "Join request approved", "channel": channel.Name, "username": target})
+}
+
+// RejectJoinRequest turns down a request to join
+func (h *ChannelHandler) RejectJoinRequest(c *gin.Context) {
+	claims, channel, ok := h.loadChannel(c)
+	if !ok {
+		return
+	}
+	if _, ok := h.requireRole(c, channel.Name, claims.Username, db.RoleAdmin); !ok {
+		return
+	}
+	target := c.Param("username")
+
+	if err := h.db.RejectJoinRequest(channel.Name, target); err != nil {
+		h.respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Join request rejected", "channel": channel.Name, "username": target})
+}
+
+// RenameChannel gives a channel a new name; admins and the owner can rename.
+// History is kept and connected clients follow the channel to its new name.
+func (h *ChannelHandler) RenameChannel(c *gin.Context) {
+	claims, channel, ok := h.loadChannel(c)
+	if !ok {
+		return
+	}
+
+	var req RenameChannelReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if _, ok := h.requireRole(c, channel.Name, claims.Username, db.RoleAdmin); !ok {
+		return
+	}
+
+	renamed, err := h.db.RenameChannel(channel.Name, req.Name)
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+	h.announceChannel(ws.MessageTypeChannelRenamed, channel.Name, renamed, claims.Username, "renamed the channel to "+renamed.Name)
+	c.JSON(http.StatusOK, renamed)
+}
+
+// SetTopic changes a channel's topic; admins and the owner can set it
+func (h *ChannelHandler) SetTopic(c *gin.Context) {
+	claims, channel, ok := h.loadChannel(c)
+	if !ok {
+		return
+	}
+
+	var req SetTopicReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if _, ok := h.requireRole(c, channel.Name, claims.Username, db.RoleAdmin); !ok {
+		return
+	}
+
+	updated, err := h.db.SetChannelTopic(channel.Name, req.Topic)
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+	content := "set the topic to " + updated.Topic
+	if updated.Topic == "" {
+		content = "cleared the topic"
+	}
+	h.announceChannel(ws.MessageTypeChannelTopic, channel.Name, updated, claims.Username, content)
+	c.JSON(http.StatusOK, updated)
+}
+
+// ArchiveChannel makes a channel read-only; admins and the owner can archive
+func (h *ChannelHandler) ArchiveChannel(c *gin.Context) {
+	h.setArchived(c, true)
+}
+
+// UnarchiveChannel lets a channel be posted to again
+func (h *ChannelHandler) UnarchiveChannel(c *gin.Context) {
+	h.setArchived(c, false)
+}
+
+func (h *ChannelHandler) setArchived(c *gin.Context, archived bool) {
+	claims, channel, ok := h.loadChannel(c)
+	if !ok {
+		return
+	}
+	if _, ok := h.requireRole(c, channel.Name, claims.Username, db.RoleAdmin); !ok {
+		return
+	}
+
+	updated, err := h.db.SetChannelArchived(channel.Name, archived)
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+	if archived {
+		h.announceChannel(ws.MessageTypeChannelArchived, channel.Name, updated, claims.Username, "archived the channel")
+	} else {
+		h.announceChannel(ws.MessageTypeChannelUnarchived, channel.Name, updated, claims.Username, "unarchived the channel")
+	}
+	c.JSON(http.StatusOK, updated)
+}
+
+// DeleteChannel removes a channel and everything in it. Only the owner can
+// delete a channel.
+func (h *ChannelHandler) DeleteChannel(c *gin.Context) {
+	claims, channel, ok := h.loadChannel(c)
+	if !ok {
+		return
+	}
+	if _, ok := h.requireRole(c, channel.Name, claims.Username, db.RoleOwner); !ok {
+		return
+	}
+
+	if err := h.db.DeleteChannel(channel.Name); err != nil {
+		h.respondError(c, err)
+		return
+	}
+	h.announceChannel(ws.MessageTypeChannelDeleted, channel.Name, channel, claims.Username, "deleted the channel")
+	c.JSON(http.StatusOK, gin.H{"message": "Channel deleted", "channel": channel.Name})
+}
+
+// loadChannel reads the caller's claims and the :channelName channel.
+// Direct messages are refused since their participants never change.
+func (h *ChannelHandler) loadChannel(c *gin.Context) (*auth.Claims, *db.Channel, bool) {
+	claims, ok := auth.GetClaims(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return nil, nil, false
+	}
+
+	channel, err := h.db.GetChannel(c.Param("channelName"))
+	if err != nil {
+		h.respondError(c, err)
+		return nil, nil, false
+	}
+	if channel.Kind == db.KindDirect {
+		h.respondError(c, db.ErrDirectMessage)
+		return nil, nil, false
+	}
+	// Non-members cannot tell a private channel from one that does not exist
+	if err := h.db.CheckChannelAccess(channel.Name, claims.Username); err != nil {
+		if err == db.ErrNotChannelMember {
+			err = db.ErrChannelNotFound
+		}
+		h.respondError(c, err)
+		return nil, nil, false
+	}
+	return claims, channel, true
+}
+
+// requireRole responds with 403 and returns false unless the user holds at
+// least the given role in the channel
+func (h *ChannelHandler) requireRole(c *gin.Context, channelName, username, min string) (string, bool) {
+	role, err := h.db.GetMemberRole(channelName, username)
+	if err != nil && err != db.ErrNotChannelMember {
+		h.respondError(c, err)
+		return "", false
+	}
+	if !db.RoleAtLeast(role, min) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Requires the " + min + " role in this channel"})
+		return "", false
+	}
+	return role, true
+}
+
+// announce tells everyone connected to the channel about a membership change
+func (h *ChannelHandler) announce(msgType, channelName, username, content string) {
+	h.hub.Broadcast <- &ws.Message{
+		Type:      msgType,
+		Content:   content,
+		RoomID:    channelName,
+		Username:  username,
+		Timestamp: time.Now().Format(time.RFC3339),
+		IsSystem:  true,
+	}
+}
+
+// announceChannel tells everyone connected to the channel that it changed.
+// room is the channel's name before the change.
+func (h *ChannelHandler) announceChannel(msgType, room string, channel *db.Channel, username, content string) {
+	h.hub.Broadcast <- &ws.Message{
+		Type:      msgType,
+		Content:   content,
+		RoomID:    room,
+		Username:  username,
+		Timestamp: time.Now().Format(time.RFC3339),
+		IsSystem:  true,
+		Channel:   channel,
+	}
+}
+
+func (h *ChannelHandler) respondError(c *gin.Context, err error) {
+	switch err {
+	case db.ErrChannelNotFound, db.ErrNotChannelMember, db.ErrInvitationNotFound, db.ErrJoinRequestNotFound, db.ErrUserNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case db.ErrAlreadyMember, db.ErrDirectMessage, db.ErrChannelExists:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case db.ErrInvalidRole, db.ErrInvalidChannelName, db.ErrTopicTooLong:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		log.Printf("Channel error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update channel"})
+	}
+}
@@ -0,0 +1,149 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/goyalg325/whiz/backend/internal/auth"
+	"github.com/goyalg325/whiz/backend/internal/db"
+)
+
+// fakeChannels holds one public and one private channel; alice is the
+// only member of the private one
+type fakeChannels struct {
+	db.Repository
+	requests []string
+}
+
+func (f *fakeChannels) GetChannel(name string) (*db.Channel, error) {
+	switch name {
+	case "general":
+		return &db.Channel{ID: 1, Name: name, Kind: db.KindChannel}, nil
+	case "secret":
+		return &db.Channel{ID: 2, Name: name, Kind: db.KindChannel, IsPrivate: true}, nil
+	}
+	return nil, db.ErrChannelNotFound
+}
+
+func (f *fakeChannels) CheckChannelAccess(name, username string) error {
+	channel, err := f.GetChannel(name)
+	if err != nil {
+		return err
+	}
+	if channel.IsPrivate && username != "alice" {
+		return db.ErrNotChannelMember
+	}
+	return nil
+}
+
+func (f *fakeChannels) RequestToJoin(name, username string) error {
+	f.requests = append(f.requests, name+"/"+username)
+	return nil
+}
+
+func (f *fakeChannels) AcceptInvitation(name, username string) error {
+	return db.ErrInvitationNotFound
+}
+
+func (f *fakeChannels) DeclineInvitation(name, username string) error {
+	return db.ErrInvitationNotFound
+}
+
+type noRevocations struct{}
+
+func (noRevocations) IsRevoked(ctx context.Context, sessionID string) (bool, error) {
+	return false, nil
+}
+
+// authedRouter returns a router with a group behind the real auth
+// middleware and the keys its tokens are signed with
+func authedRouter(t *testing.T) (*gin.Engine, *gin.RouterGroup, *auth.KeySet) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	keys, err := auth.NewKeySet("test", auth.NewHMACKey("test", []byte("test-secret")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := gin.New()
+	return r, r.Group("/", auth.Middleware(keys, noRevocations{})), keys
+}
+
+// channelServer routes the channel endpoints behind the real auth middleware
+func channelServer(t *testing.T, repo db.Repository) (*gin.Engine, *auth.KeySet) {
+	t.Helper()
+	r, authed, keys := authedRouter(t)
+	h := NewChannelHandler(repo, nil)
+
+	authed.POST("/channels/:channelName/join", h.JoinChannel)
+	authed.POST("/channels/:channelName/leave", h.LeaveChannel)
+	authed.GET("/channels/:channelName/members", h.ListMembers)
+	authed.DELETE("/channels/:channelName/members/:username", h.RemoveMember)
+	authed.POST("/channels/:channelName/invitations", h.InviteMember)
+	authed.POST("/channels/:channelName/invitations/accept", h.AcceptInvitation)
+	authed.POST("/channels/:channelName/invitations/decline", h.DeclineInvitation)
+	authed.GET("/channels/:channelName/requests", h.ListJoinRequests)
+	authed.POST("/channels/:channelName/requests/:username/approve", h.ApproveJoinRequest)
+	authed.PUT("/channels/:channelName/name", h.RenameChannel)
+	authed.PUT("/channels/:channelName/topic", h.SetTopic)
+	authed.POST("/channels/:channelName/archive", h.ArchiveChannel)
+	authed.DELETE("/channels/:channelName", h.DeleteChannel)
+	return r, keys
+}
+
+// do sends a request as username and returns the recorded response
+func do(t *testing.T, r *gin.Engine, keys *auth.KeySet, username, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	token, err := keys.Sign(&auth.Claims{ID: username, Username: username, SessionID: username})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestPrivateChannelsLookMissingToNonMembers(t *testing.T) {
+	repo := &fakeChannels{}
+	r, keys := channelServer(t, repo)
+
+	endpoints := []struct {
+		method, path, body string
+	}{
+		{http.MethodPost, "/join", ""},
+		{http.MethodPost, "/leave", ""},
+		{http.MethodGet, "/members", ""},
+		{http.MethodDelete, "/members/alice", ""},
+		{http.MethodPost, "/invitations", `{"username":"carol"}`},
+		{http.MethodPost, "/invitations/accept", ""},
+		{http.MethodPost, "/invitations/decline", ""},
+		{http.MethodGet, "/requests", ""},
+		{http.MethodPost, "/requests/carol/approve", ""},
+		{http.MethodPut, "/name", `{"name":"renamed"}`},
+		{http.MethodPut, "/topic", `{"topic":"hi"}`},
+		{http.MethodPost, "/archive", ""},
+		{http.MethodDelete, "", ""},
+	}
+	for _, e := range endpoints {
+		private := do(t, r, keys, "bob", e.method, "/channels/secret"+e.path, e.body)
+		missing := do(t, r, keys, "bob", e.method, "/channels/nowhere"+e.path, e.body)
+		if private.Code != missing.Code || private.Body.String() != strings.Replace(missing.Body.String(), "nowhere", "secret", -1) {
+			t.Errorf("%s %s: private channel answered %d %s, missing channel %d %s",
+				e.method, e.path, private.Code, private.Body, missing.Code, missing.Body)
+		}
+		if e.path != "/join" && private.Code != http.StatusNotFound {
+			t.Errorf("%s %s: got %d for a private channel, want 404", e.method, e.path, private.Code)
+		}
+	}
+
+	if len(repo.requests) != 1 || repo.requests[0] != "secret/bob" {
+		t.Errorf("join requests = %v, want only secret/bob", repo.requests)
+	}
+}
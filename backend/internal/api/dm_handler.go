@@ -0,0 +1,81 @@
+package api
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/goyalg325/whiz/backend/internal/auth"
+	"github.com/goyalg325/whiz/backend/internal/db"
+	"github.com/goyalg325/whiz/backend/internal/ws"
+)
+
+// DMHandler opens and lists direct messages. A direct message is used like
+// any other room once opened: its ID is the room for /ws/joinRoom,
+// subscribe frames, history and activity tracking.
+type DMHandler struct {
+	db  db.Repository
+	hub *ws.Hub
+}
+
+func NewDMHandler(database db.Repository, hub *ws.Hub) *DMHandler {
+	return &DMHandler{
+		db:  database,
+		hub: hub,
+	}
+}
+
+type OpenDMReq struct {
+	// Participants other than the caller, who is always included
+	Participants []string `json:"participants" binding:"required"`
+}
+
+// OpenDirectMessage returns the conversation between the caller and the
+// given users, creating it if this is the first time
+func (h *DMHandler) OpenDirectMessage(c *gin.Context) {
+	claims, ok := auth.GetClaims(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	var req OpenDMReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	dm, err := h.db.OpenDirectMessage(append(req.Participants, claims.Username))
+	switch err {
+	case nil:
+	case db.ErrInvalidParticipants:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case db.ErrUnknownParticipant:
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	default:
+		log.Printf("Error opening direct message for %s: %v", claims.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open direct message"})
+		return
+	}
+
+	h.hub.EnsureRoom(dm.ID)
+	c.JSON(http.StatusOK, dm)
+}
+
+// ListDirectMessages returns the caller's direct messages with unread counts
+func (h *DMHandler) ListDirectMessages(c *gin.Context) {
+	claims, ok := auth.GetClaims(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	conversations, err := h.db.ListDirectMessages(claims.Username)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list direct messages"})
+		return
+	}
+	c.JSON(http.StatusOK, conversations)
+}
@@ -0,0 +1,102 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/goyalg325/whiz/backend/internal/auth"
+	"github.com/goyalg325/whiz/backend/internal/db"
+)
+
+// SearchHandler serves full-text message search
+type SearchHandler struct {
+	db db.Repository
+}
+
+func NewSearchHandler(database db.Repository) *SearchHandler {
+	return &SearchHandler{db: database}
+}
+
+// SearchMessages searches the messages the caller can read.
+//
+//	q        search text; "quoted words" match a phrase, OR and -word work too
+//	channel  only this channel
+//	author   only messages by this user
+//	from, to RFC 3339 timestamps or YYYY-MM-DD dates; a date in to includes that whole day
+//	limit    results per page, default 20 and at most 100
+//	offset   results to skip, for the next page
+func (h *SearchHandler) SearchMessages(c *gin.Context) {
+	claims, ok := auth.GetClaims(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	search := db.SearchQuery{
+		Query:   strings.TrimSpace(c.Query("q")),
+		Channel: c.Query("channel"),
+		Author:  c.Query("author"),
+	}
+	if search.Query == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The q parameter is required"})
+		return
+	}
+
+	for name, dest := range map[string]*int{"limit": &search.Limit, "offset": &search.Offset} {
+		v := c.Query(name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + name + " parameter"})
+			return
+		}
+		*dest = n
+	}
+
+	var err error
+	if search.From, err = parseSearchTime(c.Query("from"), false); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid from parameter"})
+		return
+	}
+	if search.To, err = parseSearchTime(c.Query("to"), true); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid to parameter"})
+		return
+	}
+
+	if search.Channel != "" && !authorizeChannel(c, h.db, claims.Username, search.Channel) {
+		return
+	}
+
+	page, err := h.db.SearchMessages(claims.Username, search)
+	if err != nil {
+		log.Printf("Search for %s failed: %v", claims.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search messages"})
+		return
+	}
+	c.JSON(http.StatusOK, page)
+}
+
+// parseSearchTime reads an RFC 3339 timestamp or a date. With endOfDay a
+// date means the start of the next day, so the range includes it.
+func parseSearchTime(v string, endOfDay bool) (*time.Time, error) {
+	if v == "" {
+		return nil, nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return &t, nil
+	}
+	t, err := time.Parse("2006-01-02", v)
+	if err != nil {
+		return nil, err
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return &t, nil
+}
@@ -0,0 +1,33 @@
+package auth
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	// CookieName is the name of the cookie the access token is stored in
+	CookieName = "jwt"
+	// RefreshCookieName is the name of the cookie the refresh token is stored in
+	RefreshCookieName = "refresh_token"
+
+	claimsKey = "authClaims"
+)
+
+// Claims are the JWT claims issued to a user on login
+type Claims struct {
+	ID        string `json:"id"`
+	Username  string `json:"username"`
+	SessionID string `json:"sid"`
+	jwt.RegisteredClaims
+}
+
+// GetClaims returns the claims stored on the context by Middleware
+func GetClaims(c *gin.Context) (*Claims, bool) {
+	v, ok := c.Get(claimsKey)
+	if !ok {
+		return nil, false
+	}
+	claims, ok := v.(*Claims)
+	return claims, ok
+}
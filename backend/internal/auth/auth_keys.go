@@ -0,0 +1,265 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	// legacyKeyID is used for JWT_SECRET and for tokens issued before key IDs existed
+	legacyKeyID = "default"
+
+	// devSecret is only used when no key is configured and JWT_ALLOW_DEV_SECRET
+	// opts in to it
+	devSecret = "secret"
+)
+
+// Key is a single signing key identified by the kid token header
+type Key struct {
+	ID        string
+	Method    jwt.SigningMethod
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+// CanSign reports whether the private half of the key is available
+func (k *Key) CanSign() bool {
+	return k.signKey != nil
+}
+
+// KeySet holds every key tokens may be verified with and the one new tokens are signed with
+type KeySet struct {
+	activeID string
+	keys     map[string]*Key
+}
+
+// NewKeySet builds a key set that signs with the key identified by activeID
+func NewKeySet(activeID string, keys ...*Key) (*KeySet, error) {
+	ks := &KeySet{
+		activeID: activeID,
+		keys:     make(map[string]*Key),
+	}
+
+	for _, k := range keys {
+		if _, exists := ks.keys[k.ID]; exists {
+			return nil, fmt.Errorf("duplicate key id %q", k.ID)
+		}
+		ks.keys[k.ID] = k
+	}
+
+	active, ok := ks.keys[activeID]
+	if !ok {
+		return nil, fmt.Errorf("active key %q is not configured", activeID)
+	}
+	if !active.CanSign() {
+		return nil, fmt.Errorf("active key %q has no private key", activeID)
+	}
+
+	return ks, nil
+}
+
+// NewHMACKey creates an HS256 key from a shared secret
+func NewHMACKey(id string, secret []byte) *Key {
+	return &Key{ID: id, Method: jwt.SigningMethodHS256, signKey: secret, verifyKey: secret}
+}
+
+// LoadKeySetFromEnv reads the signing keys from the environment.
+//
+// JWT_KEYS is a comma separated list of kid:alg:value entries. For HS256 the
+// value is the secret itself; for RS256 and EdDSA it is the path to a PEM
+// file holding either a private key or, for retired keys that should only
+// verify, a public key. JWT_ACTIVE_KEY selects the key new tokens are signed
+// with and defaults to the first entry. When JWT_KEYS is unset JWT_SECRET is
+// used as a single HS256 key. Without either it is an error, unless
+// JWT_ALLOW_DEV_SECRET=1 allows the well-known development secret.
+func LoadKeySetFromEnv() (*KeySet, error) {
+	spec := strings.TrimSpace(os.Getenv("JWT_KEYS"))
+	if spec == "" {
+		secret := os.Getenv("JWT_SECRET")
+		if secret == "" {
+			if os.Getenv("JWT_ALLOW_DEV_SECRET") != "1" {
+				return nil, errors.New("neither JWT_KEYS nor JWT_SECRET is set; set JWT_ALLOW_DEV_SECRET=1 to sign with the insecure development secret")
+			}
+			log.Printf("WARNING: neither JWT_KEYS nor JWT_SECRET is set, signing tokens with the insecure development secret")
+			secret = devSecret
+		}
+		return NewKeySet(legacyKeyID, NewHMACKey(legacyKeyID, []byte(secret)))
+	}
+
+	var keys []*Key
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) != 3 || parts[0] == "" || parts[2] == "" {
+			return nil, fmt.Errorf("invalid JWT_KEYS entry %q, expected kid:alg:value", entry)
+		}
+
+		key, err := parseKey(parts[0], parts[1], parts[2])
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", parts[0], err)
+		}
+		keys = append(keys, key)
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("JWT_KEYS does not contain any keys")
+	}
+
+	activeID := os.Getenv("JWT_ACTIVE_KEY")
+	if activeID == "" {
+		activeID = keys[0].ID
+	}
+
+	log.Printf("Loaded %d token signing keys, active key: %s", len(keys), activeID)
+	return NewKeySet(activeID, keys...)
+}
+
+func parseKey(id, alg, value string) (*Key, error) {
+	switch alg {
+	case "HS256":
+		return NewHMACKey(id, []byte(value)), nil
+
+	case "RS256":
+		pem, err := os.ReadFile(value)
+		if err != nil {
+			return nil, err
+		}
+		if priv, err := jwt.ParseRSAPrivateKeyFromPEM(pem); err == nil {
+			return &Key{ID: id, Method: jwt.SigningMethodRS256, signKey: priv, verifyKey: &priv.PublicKey}, nil
+		}
+		pub, err := jwt.ParseRSAPublicKeyFromPEM(pem)
+		if err != nil {
+			return nil, fmt.Errorf("no RSA key found in %s: %w", value, err)
+		}
+		return &Key{ID: id, Method: jwt.SigningMethodRS256, verifyKey: pub}, nil
+
+	case "EdDSA":
+		pem, err := os.ReadFile(value)
+		if err != nil {
+			return nil, err
+		}
+		if priv, err := jwt.ParseEdPrivateKeyFromPEM(pem); err == nil {
+			edPriv, ok := priv.(ed25519.PrivateKey)
+			if !ok {
+				return nil, fmt.Errorf("unsupported EdDSA key in %s", value)
+			}
+			return &Key{ID: id, Method: jwt.SigningMethodEdDSA, signKey: edPriv, verifyKey: edPriv.Public()}, nil
+		}
+		pub, err := jwt.ParseEdPublicKeyFromPEM(pem)
+		if err != nil {
+			return nil, fmt.Errorf("no Ed25519 key found in %s: %w", value, err)
+		}
+		return &Key{ID: id, Method: jwt.SigningMethodEdDSA, verifyKey: pub}, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q", alg)
+	}
+}
+
+// Sign signs the claims with the active key and sets the kid header
+func (ks *KeySet) Sign(claims *Claims) (string, error) {
+	key := ks.keys[ks.activeID]
+
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.signKey)
+}
+
+// Parse verifies the token with the key named by its kid header and returns its claims
+func (ks *KeySet) Parse(tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		if kid == "" {
+			kid = legacyKeyID
+		}
+
+		key, ok := ks.keys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown key id %q", kid)
+		}
+		// Never let the token pick the algorithm
+		if t.Method.Alg() != key.Method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method %q for key %q", t.Method.Alg(), kid)
+		}
+		return key.verifyKey, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+	if claims.ID == "" || claims.Username == "" {
+		return nil, errors.New("token is missing user identity")
+	}
+	return claims, nil
+}
+
+// JWK is a public key in JSON Web Key format
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+}
+
+// JWKS is the document served to services that verify whiz tokens offline
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public keys of the set. Shared HMAC secrets are never published.
+func (ks *KeySet) JWKS() JWKS {
+	set := JWKS{Keys: make([]JWK, 0)}
+
+	ids := make([]string, 0, len(ks.keys))
+	for id := range ks.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		key := ks.keys[id]
+		switch pub := key.verifyKey.(type) {
+		case *rsa.PublicKey:
+			set.Keys = append(set.Keys, JWK{
+				KeyType:   "RSA",
+				KeyID:     key.ID,
+				Use:       "sig",
+				Algorithm: key.Method.Alg(),
+				N:         base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+				E:         base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+			})
+		case ed25519.PublicKey:
+			set.Keys = append(set.Keys, JWK{
+				KeyType:   "OKP",
+				KeyID:     key.ID,
+				Use:       "sig",
+				Algorithm: key.Method.Alg(),
+				Curve:     "Ed25519",
+				X:         base64.RawURLEncoding.EncodeToString(pub),
+			})
+		}
+	}
+
+	return set
+}
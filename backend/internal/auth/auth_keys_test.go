@@ -0,0 +1,190 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func testClaims() *Claims {
+	return &Claims{
+		ID:        "1",
+		Username:  "alice",
+		SessionID: "s1",
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+	}
+}
+
+// signWith signs claims with an arbitrary method, key and kid, as an
+// attacker or an older deployment would
+func signWith(t *testing.T, method jwt.SigningMethod, key interface{}, kid string, claims *Claims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	s, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestKeySetParse(t *testing.T) {
+	_, retiredPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPriv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPubPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: mustMarshalPKIX(t, &rsaPriv.PublicKey)})
+
+	keys, err := NewKeySet("current",
+		NewHMACKey("current", []byte("current-secret")),
+		NewHMACKey(legacyKeyID, []byte("legacy-secret")),
+		&Key{ID: "retired", Method: jwt.SigningMethodEdDSA, verifyKey: retiredPriv.Public()},
+		&Key{ID: "rsa", Method: jwt.SigningMethodRS256, verifyKey: &rsaPriv.PublicKey},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	active, err := keys.Sign(testClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired := testClaims()
+	expired.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+	anonymous := testClaims()
+	anonymous.Username = ""
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"active key", active, true},
+		{"retired key still verifies", signWith(t, jwt.SigningMethodEdDSA, retiredPriv, "retired", testClaims()), true},
+		{"legacy token without kid", signWith(t, jwt.SigningMethodHS256, []byte("legacy-secret"), "", testClaims()), true},
+		{"legacy default kid", signWith(t, jwt.SigningMethodHS256, []byte("legacy-secret"), legacyKeyID, testClaims()), true},
+		{"RS256 key", signWith(t, jwt.SigningMethodRS256, rsaPriv, "rsa", testClaims()), true},
+		{"unknown kid", signWith(t, jwt.SigningMethodHS256, []byte("current-secret"), "someone-else", testClaims()), false},
+		{"wrong secret", signWith(t, jwt.SigningMethodHS256, []byte("guess"), "current", testClaims()), false},
+		{"HS256 against an RSA public key", signWith(t, jwt.SigningMethodHS256, rsaPubPEM, "rsa", testClaims()), false},
+		{"HS256 against an EdDSA key", signWith(t, jwt.SigningMethodHS256, []byte("current-secret"), "retired", testClaims()), false},
+		{"RS256 against an HMAC key", signWith(t, jwt.SigningMethodRS256, rsaPriv, "current", testClaims()), false},
+		{"alg none", signWith(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, "current", testClaims()), false},
+		{"alg none without kid", signWith(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, "", testClaims()), false},
+		{"expired", signWith(t, jwt.SigningMethodHS256, []byte("current-secret"), "current", expired), false},
+		{"missing username", signWith(t, jwt.SigningMethodHS256, []byte("current-secret"), "current", anonymous), false},
+		{"tampered payload", active[:strings.LastIndex(active, ".")] + "x" + active[strings.LastIndex(active, "."):], false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := keys.Parse(tt.token)
+			if tt.ok && err != nil {
+				t.Fatalf("rejected: %v", err)
+			}
+			if !tt.ok && err == nil {
+				t.Fatalf("accepted with claims %+v", claims)
+			}
+			if tt.ok && claims.Username != "alice" {
+				t.Errorf("got username %q, want alice", claims.Username)
+			}
+		})
+	}
+}
+
+func mustMarshalPKIX(t *testing.T, pub interface{}) []byte {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func TestSignSetsActiveKeyID(t *testing.T) {
+	keys, err := NewKeySet("b", NewHMACKey("a", []byte("a")), NewHMACKey("b", []byte("b")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := keys.Sign(testClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _, err := jwt.NewParser().ParseUnverified(signed, &Claims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Header["kid"] != "b" {
+		t.Errorf("kid %v, want b", token.Header["kid"])
+	}
+}
+
+func TestNewKeySetRejectsBadSets(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyOnly := &Key{ID: "old", Method: jwt.SigningMethodEdDSA, verifyKey: pub}
+
+	tests := []struct {
+		name   string
+		active string
+		keys   []*Key
+	}{
+		{"duplicate kid", "a", []*Key{NewHMACKey("a", []byte("1")), NewHMACKey("a", []byte("2"))}},
+		{"active key missing", "b", []*Key{NewHMACKey("a", []byte("1"))}},
+		{"active key cannot sign", "old", []*Key{verifyOnly}},
+		{"no keys", "a", nil},
+	}
+	for _, tt := range tests {
+		if _, err := NewKeySet(tt.active, tt.keys...); err == nil {
+			t.Errorf("%s: accepted", tt.name)
+		}
+	}
+}
+
+func TestLoadKeySetFromEnv(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		ok   bool
+	}{
+		{"nothing configured", nil, false},
+		{"dev secret needs opt-in", map[string]string{"JWT_ALLOW_DEV_SECRET": "true"}, false},
+		{"dev secret opted in", map[string]string{"JWT_ALLOW_DEV_SECRET": "1"}, true},
+		{"single secret", map[string]string{"JWT_SECRET": "s3cret"}, true},
+		{"key list", map[string]string{"JWT_KEYS": "k1:HS256:one,k2:HS256:two", "JWT_ACTIVE_KEY": "k2"}, true},
+		{"malformed key list", map[string]string{"JWT_KEYS": "k1:HS256"}, false},
+		{"unknown algorithm", map[string]string{"JWT_KEYS": "k1:HS512:one"}, false},
+		{"unknown active key", map[string]string{"JWT_KEYS": "k1:HS256:one", "JWT_ACTIVE_KEY": "k9"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range []string{"JWT_KEYS", "JWT_ACTIVE_KEY", "JWT_SECRET", "JWT_ALLOW_DEV_SECRET"} {
+				t.Setenv(key, tt.env[key])
+			}
+			_, err := LoadKeySetFromEnv()
+			if tt.ok && err != nil {
+				t.Fatalf("rejected: %v", err)
+			}
+			if !tt.ok && err == nil {
+				t.Fatal("accepted")
+			}
+		})
+	}
+}
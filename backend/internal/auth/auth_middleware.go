@@ -0,0 +1,69 @@
+package auth
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Middleware verifies the access token sent in the jwt cookie or an
+// Authorization: Bearer header, checks that its session has not been
+// revoked and stores its claims on the context. Requests without a valid
+// token are rejected with 401.
+func Middleware(keys *KeySet, revocations RevocationChecker) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tokenString := tokenFromRequest(c)
+		if tokenString == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+			return
+		}
+
+		claims, err := keys.Parse(tokenString)
+		if err != nil {
+			log.Printf("Rejected token for %s %s: %v", c.Request.Method, c.Request.URL.Path, err)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token"})
+			return
+		}
+
+		if claims.SessionID == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token"})
+			return
+		}
+
+		revoked, err := revocations.IsRevoked(c.Request.Context(), claims.SessionID)
+		if err != nil {
+			log.Printf("Error checking session %s: %v", claims.SessionID, err)
+		}
+		if revoked {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Session has been revoked"})
+			return
+		}
+
+		c.Set(claimsKey, claims)
+		c.Next()
+	}
+}
+
+func tokenFromRequest(c *gin.Context) string {
+	if header := c.GetHeader("Authorization"); header != "" {
+		if token, ok := strings.CutPrefix(header, "Bearer "); ok {
+			return strings.TrimSpace(token)
+		}
+	}
+
+	if cookie, err := c.Cookie(CookieName); err == nil {
+		return cookie
+	}
+
+	return ""
+}
+
+// JWKSHandler serves the public verification keys so other services can check whiz tokens offline
+func JWKSHandler(keys *KeySet) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Cache-Control", "public, max-age=300")
+		c.JSON(http.StatusOK, keys.JWKS())
+	}
+}
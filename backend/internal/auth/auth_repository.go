@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+type DBTX interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryRowContext(context.Context, string, ...interface{}) *sql.Row
+}
+
+type sessionRepository struct {
+	db DBTX
+}
+
+func NewSessionRepository(db DBTX) SessionRepository {
+	return &sessionRepository{db: db}
+}
+
+func (r *sessionRepository) CreateSession(ctx context.Context, s *Session) error {
+	query := "INSERT INTO user_sessions(id, user_id, username, created_at, expires_at) VALUES ($1, $2, $3, $4, $5)"
+	_, err := r.db.ExecContext(ctx, query, s.ID, s.UserID, s.Username, s.CreatedAt, s.ExpiresAt)
+	return err
+}
+
+func (r *sessionRepository) GetSession(ctx context.Context, id string) (*Session, error) {
+	s := Session{}
+	var revokedAt sql.NullTime
+	query := "SELECT id, user_id, username, created_at, expires_at, revoked_at FROM user_sessions WHERE id = $1"
+	err := r.db.QueryRowContext(ctx, query, id).Scan(&s.ID, &s.UserID, &s.Username, &s.CreatedAt, &s.ExpiresAt, &revokedAt)
+	if err != nil {
+		return nil, err
+	}
+	if revokedAt.Valid {
+		s.RevokedAt = &revokedAt.Time
+	}
+	return &s, nil
+}
+
+func (r *sessionRepository) RevokeSession(ctx context.Context, id string) error {
+	query := "UPDATE user_sessions SET revoked_at = NOW() WHERE id = $1 AND revoked_at IS NULL"
+	_, err := r.db.ExecContext(ctx, query, id)
+	return err
+}
+
+func (r *sessionRepository) RevokeUserSessions(ctx context.Context, userID int64) (int64, error) {
+	query := "UPDATE user_sessions SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL"
+	res, err := r.db.ExecContext(ctx, query, userID)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (r *sessionRepository) CreateRefreshToken(ctx context.Context, tokenHash, sessionID string, expiresAt time.Time) error {
+	query := "INSERT INTO refresh_tokens(token_hash, session_id, expires_at) VALUES ($1, $2, $3)"
+	_, err := r.db.ExecContext(ctx, query, tokenHash, sessionID, expiresAt)
+	return err
+}
+
+func (r *sessionRepository) UseRefreshToken(ctx context.Context, tokenHash string) (string, error) {
+	var sessionID string
+	// A single conditional update, so two concurrent refreshes cannot both succeed
+	query := `
+		UPDATE refresh_tokens SET used_at = NOW()
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > NOW()
+		RETURNING session_id
+	`
+	err := r.db.QueryRowContext(ctx, query, tokenHash).Scan(&sessionID)
+	if err == sql.ErrNoRows {
+		return "", ErrInvalidRefreshToken
+	}
+	return sessionID, err
+}
+
+func (r *sessionRepository) GetRefreshTokenSession(ctx context.Context, tokenHash string) (string, error) {
+	var sessionID string
+	query := "SELECT session_id FROM refresh_tokens WHERE token_hash = $1"
+	err := r.db.QueryRowContext(ctx, query, tokenHash).Scan(&sessionID)
+	return sessionID, err
+}
@@ -0,0 +1,240 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	defaultAccessTTL  = 15 * time.Minute
+	defaultRefreshTTL = 30 * 24 * time.Hour
+)
+
+var (
+	// ErrInvalidRefreshToken is returned for unknown, expired or already used refresh tokens
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	// ErrSessionRevoked is returned when the session behind a token has been logged out
+	ErrSessionRevoked = errors.New("session has been revoked")
+)
+
+// Session is a login on one device. Every refresh token belongs to exactly one session.
+type Session struct {
+	ID        string
+	UserID    int64
+	Username  string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	RevokedAt *time.Time
+}
+
+// TokenPair is what a client receives on login and on every refresh
+type TokenPair struct {
+	AccessToken      string
+	RefreshToken     string
+	AccessExpiresAt  time.Time
+	RefreshExpiresAt time.Time
+	SessionID        string
+}
+
+type SessionRepository interface {
+	CreateSession(ctx context.Context, session *Session) error
+	GetSession(ctx context.Context, id string) (*Session, error)
+	RevokeSession(ctx context.Context, id string) error
+	RevokeUserSessions(ctx context.Context, userID int64) (int64, error)
+	CreateRefreshToken(ctx context.Context, tokenHash, sessionID string, expiresAt time.Time) error
+	// UseRefreshToken marks an unused, unexpired token as used and returns its session ID
+	UseRefreshToken(ctx context.Context, tokenHash string) (string, error)
+	// GetRefreshTokenSession returns the session of a token regardless of its state
+	GetRefreshTokenSession(ctx context.Context, tokenHash string) (string, error)
+}
+
+// RevocationChecker reports whether a session may still be used
+type RevocationChecker interface {
+	IsRevoked(ctx context.Context, sessionID string) (bool, error)
+}
+
+// Sessions issues short-lived access tokens and rotating refresh tokens
+type Sessions struct {
+	repo       SessionRepository
+	keys       *KeySet
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+}
+
+// NewSessions creates the session service. ACCESS_TOKEN_TTL and REFRESH_TOKEN_TTL
+// override the default lifetimes and are parsed with time.ParseDuration.
+func NewSessions(repo SessionRepository, keys *KeySet) *Sessions {
+	return &Sessions{
+		repo:       repo,
+		keys:       keys,
+		accessTTL:  durationFromEnv("ACCESS_TOKEN_TTL", defaultAccessTTL),
+		refreshTTL: durationFromEnv("REFRESH_TOKEN_TTL", defaultRefreshTTL),
+	}
+}
+
+func durationFromEnv(name string, fallback time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Printf("Ignoring invalid %s=%q, using %s", name, v, fallback)
+		return fallback
+	}
+	return d
+}
+
+// Start creates a new session for the user and returns its first token pair
+func (s *Sessions) Start(ctx context.Context, userID int64, username string) (*TokenPair, error) {
+	id, err := randomToken(16)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	session := &Session{
+		ID:        id,
+		UserID:    userID,
+		Username:  username,
+		CreatedAt: now,
+		ExpiresAt: now.Add(s.refreshTTL),
+	}
+	if err := s.repo.CreateSession(ctx, session); err != nil {
+		return nil, err
+	}
+
+	return s.issue(ctx, session)
+}
+
+// Refresh exchanges a refresh token for a new token pair. The presented token is
+// consumed; presenting it a second time is treated as theft and revokes the session.
+func (s *Sessions) Refresh(ctx context.Context, refreshToken string) (*TokenPair, error) {
+	if refreshToken == "" {
+		return nil, ErrInvalidRefreshToken
+	}
+	hash := hashToken(refreshToken)
+
+	sessionID, err := s.repo.UseRefreshToken(ctx, hash)
+	if errors.Is(err, ErrInvalidRefreshToken) {
+		// A known token that can no longer be used means it was replayed
+		if reusedSession, lookupErr := s.repo.GetRefreshTokenSession(ctx, hash); lookupErr == nil {
+			log.Printf("Refresh token reuse detected, revoking session %s", reusedSession)
+			if err := s.repo.RevokeSession(ctx, reusedSession); err != nil {
+				log.Printf("Error revoking session %s: %v", reusedSession, err)
+			}
+		}
+		return nil, ErrInvalidRefreshToken
+	} else if err != nil {
+		return nil, err
+	}
+
+	session, err := s.repo.GetSession(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if session.RevokedAt != nil || time.Now().After(session.ExpiresAt) {
+		return nil, ErrSessionRevoked
+	}
+
+	return s.issue(ctx, session)
+}
+
+// Revoke logs out a single session
+func (s *Sessions) Revoke(ctx context.Context, sessionID string) error {
+	return s.repo.RevokeSession(ctx, sessionID)
+}
+
+// RevokeRefreshToken logs out the session a refresh token belongs to
+func (s *Sessions) RevokeRefreshToken(ctx context.Context, refreshToken string) error {
+	sessionID, err := s.repo.GetRefreshTokenSession(ctx, hashToken(refreshToken))
+	if err != nil {
+		return err
+	}
+	return s.repo.RevokeSession(ctx, sessionID)
+}
+
+// RevokeAll logs the user out on every device
+func (s *Sessions) RevokeAll(ctx context.Context, userID int64) error {
+	n, err := s.repo.RevokeUserSessions(ctx, userID)
+	if err != nil {
+		return err
+	}
+	log.Printf("Revoked %d sessions for user %d", n, userID)
+	return nil
+}
+
+// IsRevoked implements RevocationChecker
+func (s *Sessions) IsRevoked(ctx context.Context, sessionID string) (bool, error) {
+	session, err := s.repo.GetSession(ctx, sessionID)
+	if err != nil {
+		return true, err
+	}
+	return session.RevokedAt != nil || time.Now().After(session.ExpiresAt), nil
+}
+
+func (s *Sessions) issue(ctx context.Context, session *Session) (*TokenPair, error) {
+	now := time.Now()
+	accessExpiresAt := now.Add(s.accessTTL)
+
+	accessToken, err := s.keys.Sign(&Claims{
+		ID:        strconv.FormatInt(session.UserID, 10),
+		Username:  session.Username,
+		SessionID: session.ID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    strconv.FormatInt(session.UserID, 10),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(accessExpiresAt),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken, err := randomToken(32)
+	if err != nil {
+		return nil, err
+	}
+
+	// Refresh tokens never outlive their session
+	refreshExpiresAt := now.Add(s.refreshTTL)
+	if refreshExpiresAt.After(session.ExpiresAt) {
+		refreshExpiresAt = session.ExpiresAt
+	}
+
+	if err := s.repo.CreateRefreshToken(ctx, hashToken(refreshToken), session.ID, refreshExpiresAt); err != nil {
+		return nil, err
+	}
+
+	return &TokenPair{
+		AccessToken:      accessToken,
+		RefreshToken:     refreshToken,
+		AccessExpiresAt:  accessExpiresAt,
+		RefreshExpiresAt: refreshExpiresAt,
+		SessionID:        session.ID,
+	}, nil
+}
+
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken is what gets stored, so a database leak does not leak usable refresh tokens
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,255 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSessionRepo keeps sessions and refresh tokens in memory with the same
+// rules as the database: a refresh token can be used once, before it expires
+type fakeSessionRepo struct {
+	mu       sync.Mutex
+	sessions map[string]*Session
+	tokens   map[string]*fakeRefreshToken
+}
+
+type fakeRefreshToken struct {
+	sessionID string
+	expiresAt time.Time
+	used      bool
+}
+
+func newFakeSessionRepo() *fakeSessionRepo {
+	return &fakeSessionRepo{
+		sessions: make(map[string]*Session),
+		tokens:   make(map[string]*fakeRefreshToken),
+	}
+}
+
+func (r *fakeSessionRepo) CreateSession(ctx context.Context, s *Session) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	copied := *s
+	r.sessions[s.ID] = &copied
+	return nil
+}
+
+func (r *fakeSessionRepo) GetSession(ctx context.Context, id string) (*Session, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.sessions[id]
+	if !ok {
+		return nil, errors.New("no such session")
+	}
+	copied := *s
+	return &copied, nil
+}
+
+func (r *fakeSessionRepo) RevokeSession(ctx context.Context, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s, ok := r.sessions[id]; ok && s.RevokedAt == nil {
+		now := time.Now()
+		s.RevokedAt = &now
+	}
+	return nil
+}
+
+func (r *fakeSessionRepo) RevokeUserSessions(ctx context.Context, userID int64) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var n int64
+	for _, s := range r.sessions {
+		if s.UserID == userID && s.RevokedAt == nil {
+			now := time.Now()
+			s.RevokedAt = &now
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (r *fakeSessionRepo) CreateRefreshToken(ctx context.Context, tokenHash, sessionID string, expiresAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tokens[tokenHash] = &fakeRefreshToken{sessionID: sessionID, expiresAt: expiresAt}
+	return nil
+}
+
+func (r *fakeSessionRepo) UseRefreshToken(ctx context.Context, tokenHash string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tok, ok := r.tokens[tokenHash]
+	if !ok || tok.used || !time.Now().Before(tok.expiresAt) {
+		return "", ErrInvalidRefreshToken
+	}
+	tok.used = true
+	return tok.sessionID, nil
+}
+
+func (r *fakeSessionRepo) GetRefreshTokenSession(ctx context.Context, tokenHash string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tok, ok := r.tokens[tokenHash]
+	if !ok {
+		return "", errors.New("no such token")
+	}
+	return tok.sessionID, nil
+}
+
+func newTestSessions(t *testing.T) (*Sessions, *fakeSessionRepo) {
+	t.Helper()
+	for _, key := range []string{"ACCESS_TOKEN_TTL", "REFRESH_TOKEN_TTL"} {
+		t.Setenv(key, "")
+	}
+	keys, err := NewKeySet("test", NewHMACKey("test", []byte("test-secret")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := newFakeSessionRepo()
+	return NewSessions(repo, keys), repo
+}
+
+func TestSessionsRefreshRotatesTokens(t *testing.T) {
+	sessions, _ := newTestSessions(t)
+	ctx := context.Background()
+
+	first, err := sessions.Start(ctx, 1, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := sessions.Refresh(ctx, first.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.RefreshToken == first.RefreshToken || second.AccessToken == "" {
+		t.Fatal("refresh did not issue a new token pair")
+	}
+	if second.SessionID != first.SessionID {
+		t.Errorf("refresh moved to session %s, want %s", second.SessionID, first.SessionID)
+	}
+
+	claims, err := sessions.keys.Parse(second.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Username != "alice" || claims.SessionID != first.SessionID {
+		t.Errorf("access token claims %+v", claims)
+	}
+}
+
+func TestSessionsRefreshRejectsBadTokens(t *testing.T) {
+	sessions, repo := newTestSessions(t)
+	ctx := context.Background()
+
+	pair, err := sessions.Start(ctx, 1, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := sessions.Start(ctx, 1, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo.tokens[hashToken(expired.RefreshToken)].expiresAt = time.Now().Add(-time.Minute)
+	loggedOut, err := sessions.Start(ctx, 1, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sessions.Revoke(ctx, loggedOut.SessionID); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{"empty", "", ErrInvalidRefreshToken},
+		{"unknown", "not-a-token", ErrInvalidRefreshToken},
+		{"access token", pair.AccessToken, ErrInvalidRefreshToken},
+		{"expired", expired.RefreshToken, ErrInvalidRefreshToken},
+		{"logged out session", loggedOut.RefreshToken, ErrSessionRevoked},
+	}
+	for _, tt := range tests {
+		if _, err := sessions.Refresh(ctx, tt.token); !errors.Is(err, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+	if revoked, _ := sessions.IsRevoked(ctx, pair.SessionID); revoked {
+		t.Error("bad tokens revoked an unrelated session")
+	}
+}
+
+func TestSessionsRefreshReuseRevokesSession(t *testing.T) {
+	sessions, _ := newTestSessions(t)
+	ctx := context.Background()
+
+	stolen, err := sessions.Start(ctx, 1, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := sessions.Refresh(ctx, stolen.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	latest, err := sessions.Refresh(ctx, rotated.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := sessions.Start(ctx, 1, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replaying a token that was already rotated away revokes the session
+	if _, err := sessions.Refresh(ctx, stolen.RefreshToken); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Fatalf("replay got %v, want ErrInvalidRefreshToken", err)
+	}
+	if revoked, _ := sessions.IsRevoked(ctx, stolen.SessionID); !revoked {
+		t.Fatal("session is still valid after its refresh token was replayed")
+	}
+	// so no token of that session family works any more, including the newest
+	if _, err := sessions.Refresh(ctx, latest.RefreshToken); !errors.Is(err, ErrSessionRevoked) {
+		t.Errorf("newest token of the family got %v, want ErrSessionRevoked", err)
+	}
+	// but the user's other devices are unaffected
+	if _, err := sessions.Refresh(ctx, other.RefreshToken); err != nil {
+		t.Errorf("another session was affected: %v", err)
+	}
+}
+
+func TestSessionsRevokeAllLogsOutEveryDevice(t *testing.T) {
+	sessions, _ := newTestSessions(t)
+	ctx := context.Background()
+
+	var devices []*TokenPair
+	for i := 0; i < 3; i++ {
+		pair, err := sessions.Start(ctx, 1, "alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		devices = append(devices, pair)
+	}
+	bob, err := sessions.Start(ctx, 2, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sessions.RevokeAll(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	for i, pair := range devices {
+		if revoked, _ := sessions.IsRevoked(ctx, pair.SessionID); !revoked {
+			t.Errorf("device %d is still logged in", i)
+		}
+		if _, err := sessions.Refresh(ctx, pair.RefreshToken); !errors.Is(err, ErrSessionRevoked) {
+			t.Errorf("device %d refresh got %v, want ErrSessionRevoked", i, err)
+		}
+	}
+	if revoked, _ := sessions.IsRevoked(ctx, bob.SessionID); revoked {
+		t.Error("another user's session was revoked")
+	}
+}
@@ -0,0 +1,120 @@
+package db
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+// Kinds of stored AI output
+const (
+	AIOutputContext       = "context"
+	AIOutputMissedSummary = "missed_summary"
+)
+
+// AIOutputKey identifies a generated reply. The messages it was made from
+// are those of Channel with IDs from FirstMessageID to LastMessageID;
+// TargetID is the message asked about, or 0 for summaries. A reply is only
+// reused for the same prompt version and model.
+type AIOutputKey struct {
+	Kind           string
+	Channel        string
+	TargetID       int
+	FirstMessageID int
+	LastMessageID  int
+	PromptVersion  int
+	Model          string
+}
+
+// AIOutput is a generated reply stored for reuse
+type AIOutput struct {
+	AIOutputKey
+	Content   string
+	CreatedAt time.Time
+}
+
+// GetAIOutput returns the reply stored for key, or ErrAIOutputNotFound
+func (d *Database) GetAIOutput(key AIOutputKey) (*AIOutput, error) {
+	query := `
+		SELECT o.content, o.created_at
+		FROM ai_outputs o
+		JOIN channels c ON c.id = o.channel_id
+		WHERE o.kind = $1 AND c.name = $2 AND o.target_id = $3
+		  AND o.first_message_id = $4 AND o.last_message_id = $5
+		  AND o.prompt_version = $6 AND o.model = $7
+	`
+	out := &AIOutput{AIOutputKey: key}
+	err := d.db.QueryRow(query, key.Kind, key.Channel, key.TargetID, key.FirstMessageID,
+		key.LastMessageID, key.PromptVersion, key.Model).Scan(&out.Content, &out.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrAIOutputNotFound
+	} else if err != nil {
+		log.Printf("Error reading AI output for %s in %s: %v", key.Kind, key.Channel, err)
+		return nil, err
+	}
+	return out, nil
+}
+
+// SaveAIOutput stores a generated reply, replacing any stored for the same
+// key. since is when generation started; if a message in the key's range
+// was edited or deleted after it, nothing is stored and ErrAIOutputStale is
+// returned. The messages are locked while checking, so an edit either
+// shows up in the check or runs after the save and invalidates the reply.
+func (d *Database) SaveAIOutput(key AIOutputKey, content string, since time.Time) (*AIOutput, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var stale bool
+	err = tx.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM (
+				SELECT m.edited_at, m.deleted_at
+				FROM messages m
+				JOIN channels c ON c.id = m.channel_id
+				WHERE c.name = $1 AND m.id BETWEEN $2 AND $3
+				FOR SHARE OF m
+			) m
+			WHERE m.edited_at > $4::timestamptz OR m.deleted_at > $4::timestamptz
+		)
+	`, key.Channel, key.FirstMessageID, key.LastMessageID, since).Scan(&stale)
+	if err != nil {
+		log.Printf("Error checking messages of AI output for %s in %s: %v", key.Kind, key.Channel, err)
+		return nil, err
+	}
+	if stale {
+		return nil, ErrAIOutputStale
+	}
+
+	query := `
+		INSERT INTO ai_outputs (kind, channel_id, target_id, first_message_id, last_message_id, prompt_version, model, content)
+		SELECT $1, c.id, $3, $4, $5, $6, $7, $8 FROM channels c WHERE c.name = $2
+		ON CONFLICT (kind, channel_id, target_id, first_message_id, last_message_id, prompt_version, model)
+		DO UPDATE SET content = EXCLUDED.content, created_at = NOW()
+		RETURNING created_at
+	`
+	out := &AIOutput{AIOutputKey: key, Content: content}
+	err = tx.QueryRow(query, key.Kind, key.Channel, key.TargetID, key.FirstMessageID,
+		key.LastMessageID, key.PromptVersion, key.Model, content).Scan(&out.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrChannelNotFound
+	} else if err != nil {
+		log.Printf("Error saving AI output for %s in %s: %v", key.Kind, key.Channel, err)
+		return nil, err
+	}
+	return out, tx.Commit()
+}
+
+// invalidateAIOutputs drops the stored replies made from a message, after
+// it was edited or deleted
+func invalidateAIOutputs(q execer, messageId int) error {
+	_, err := q.Exec(`
+		DELETE FROM ai_outputs o
+		USING messages m
+		WHERE m.id = $1 AND o.channel_id = m.channel_id
+		  AND m.id BETWEEN o.first_message_id AND o.last_message_id
+	`, messageId)
+	return err
+}
@@ -0,0 +1,63 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSaveAIOutputSkipsMessagesChangedDuringGeneration(t *testing.T) {
+	database := testDatabase(t)
+	name, channelId := testChannel(t, database)
+
+	var ids []int
+	for _, content := range []string{"first", "second", "third"} {
+		var id int
+		if err := database.db.QueryRow(`INSERT INTO messages (content, username, channel_id) VALUES ($1, 'alice', $2) RETURNING id`,
+			content, channelId).Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	key := AIOutputKey{
+		Kind:           AIOutputMissedSummary,
+		Channel:        name,
+		FirstMessageID: ids[0],
+		LastMessageID:  ids[2],
+		PromptVersion:  1,
+		Model:          "test",
+	}
+
+	// Nothing changed while generating, so the reply is stored
+	if _, err := database.SaveAIOutput(key, "summary", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := database.GetAIOutput(key); err != nil {
+		t.Fatalf("reply was not stored: %v", err)
+	}
+
+	// An edit lands between generating and storing
+	started := time.Now()
+	if _, err := database.EditMessage(ids[1], "alice", "second, edited"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := database.SaveAIOutput(key, "stale summary", started); err != ErrAIOutputStale {
+		t.Fatalf("got %v, want ErrAIOutputStale", err)
+	}
+	if _, err := database.GetAIOutput(key); err != ErrAIOutputNotFound {
+		t.Fatalf("got %v, want the stale reply left unstored", err)
+	}
+
+	// A deletion counts the same way
+	started = time.Now()
+	if _, err := database.DeleteMessage(ids[2], "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := database.SaveAIOutput(key, "stale summary", started); err != ErrAIOutputStale {
+		t.Fatalf("got %v after a deletion, want ErrAIOutputStale", err)
+	}
+
+	// A reply generated after the changes is stored
+	if _, err := database.SaveAIOutput(key, "fresh summary", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+}
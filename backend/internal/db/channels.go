@@ -0,0 +1,109 @@
+package db
+
+import (
+	"database/sql"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// channelColumns is the select list scanChannel expects
+const channelColumns = `id, name, description, COALESCE(created_by, ''), created_at, is_private, kind, topic, archived_at`
+
+// MaxTopicLength caps the length of a channel topic
+const MaxTopicLength = 250
+
+// uniqueViolation is the Postgres error code for a duplicate key
+const uniqueViolation = "23505"
+
+var numericName = regexp.MustCompile(`^[0-9]+$`)
+
+// ValidateChannelName returns ErrInvalidChannelName unless name can be used
+// for a channel. Names travel in URL paths and comma separated room lists,
+// numeric names are reserved because old clients sent numeric room IDs, and
+// the dm- prefix belongs to direct messages.
+func ValidateChannelName(name string) error {
+	if name == "" || len(name) > 100 || strings.TrimSpace(name) != name ||
+		strings.ContainsAny(name, "/,") || numericName.MatchString(name) ||
+		strings.HasPrefix(name, DirectMessagePrefix) {
+		return ErrInvalidChannelName
+	}
+	return nil
+}
+
+func scanChannel(row rowScanner, ch *Channel) error {
+	var archivedAt sql.NullTime
+	err := row.Scan(&ch.ID, &ch.Name, &ch.Description, &ch.CreatedBy, &ch.CreatedAt, &ch.IsPrivate, &ch.Kind, &ch.Topic, &archivedAt)
+	if err != nil {
+		return err
+	}
+	if archivedAt.Valid {
+		ch.ArchivedAt = &archivedAt.Time
+	}
+	return nil
+}
+
+// RenameChannel gives a channel a new name. Messages, members and room
+// events reference the channel by ID, so its history is kept.
+func (d *Database) RenameChannel(oldName, newName string) (*Channel, error) {
+	if err := ValidateChannelName(newName); err != nil {
+		return nil, err
+	}
+	query := `UPDATE channels SET name = $2 WHERE name = $1 AND kind = 'channel' RETURNING ` + channelColumns
+	ch, err := d.updateChannel(query, oldName, newName)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == uniqueViolation {
+		return nil, ErrChannelExists
+	}
+	if err == nil {
+		log.Printf("Renamed channel %s to %s", oldName, newName)
+	}
+	return ch, err
+}
+
+// SetChannelTopic changes the topic shown for a channel
+func (d *Database) SetChannelTopic(channelName, topic string) (*Channel, error) {
+	if len(topic) > MaxTopicLength {
+		return nil, ErrTopicTooLong
+	}
+	query := `UPDATE channels SET topic = $2 WHERE name = $1 AND kind = 'channel' RETURNING ` + channelColumns
+	return d.updateChannel(query, channelName, topic)
+}
+
+// SetChannelArchived archives a channel, making it read-only, or restores it
+func (d *Database) SetChannelArchived(channelName string, archived bool) (*Channel, error) {
+	query := `
+		UPDATE channels SET archived_at = CASE WHEN $2 THEN COALESCE(archived_at, NOW()) END
+		WHERE name = $1 AND kind = 'channel'
+		RETURNING ` + channelColumns
+	return d.updateChannel(query, channelName, archived)
+}
+
+func (d *Database) updateChannel(query, channelName string, value interface{}) (*Channel, error) {
+	var ch Channel
+	err := scanChannel(d.db.QueryRow(query, channelName, value), &ch)
+	if err == sql.ErrNoRows {
+		return nil, ErrChannelNotFound
+	}
+	if err != nil {
+		log.Printf("Error updating channel %s: %v", channelName, err)
+		return nil, err
+	}
+	return &ch, nil
+}
+
+// DeleteChannel removes a channel. Its messages, reactions, room events,
+// members, invitations, join requests and read markers are deleted with it.
+func (d *Database) DeleteChannel(channelName string) error {
+	result, err := d.db.Exec(`DELETE FROM channels WHERE name = $1 AND kind = 'channel'`, channelName)
+	if err != nil {
+		log.Printf("Error deleting channel %s: %v", channelName, err)
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrChannelNotFound
+	}
+	log.Printf("Deleted channel %s", channelName)
+	return nil
+}
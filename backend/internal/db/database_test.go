@@ -0,0 +1,171 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// testDatabase connects to the database named by WHIZ_TEST_DB_URL. The test
+// is skipped without it.
+func testDatabase(t *testing.T) *Database {
+	dsn := os.Getenv("WHIZ_TEST_DB_URL")
+	if dsn == "" {
+		t.Skip("set WHIZ_TEST_DB_URL to run against a local Postgres")
+	}
+	t.Setenv("DB_URL", dsn)
+
+	database, err := NewDatabase()
+	if err != nil {
+		t.Fatalf("connecting: %v", err)
+	}
+	t.Cleanup(database.Close)
+	if err := database.MigrateUp(context.Background()); err != nil {
+		t.Fatalf("migrating: %v", err)
+	}
+	return database
+}
+
+func TestSaveMessageToUnknownChannelFails(t *testing.T) {
+	database := testDatabase(t)
+
+	const name = "no-such-channel-for-save-test"
+	if _, err := database.SaveMessage("hello", "alice", name); err != ErrChannelNotFound {
+		t.Fatalf("got %v, want ErrChannelNotFound", err)
+	}
+	if _, err := database.GetChannel(name); err != ErrChannelNotFound {
+		t.Errorf("looking the channel up afterwards got %v, want ErrChannelNotFound", err)
+	}
+}
+
+// rows returns query results for IDs in the order given, as a page query would scan them
+func rows(ids ...int) []Message {
+	messages := make([]Message, len(ids))
+	for i, id := range ids {
+		messages[i] = Message{ID: id}
+	}
+	return messages
+}
+
+func ids(page *MessagePage) []int {
+	out := make([]int, len(page.Messages))
+	for i, m := range page.Messages {
+		out[i] = m.ID
+	}
+	return out
+}
+
+func cursor(c *int) string {
+	if c == nil {
+		return "nil"
+	}
+	return fmt.Sprint(*c)
+}
+
+func TestBuildPage(t *testing.T) {
+	tests := []struct {
+		name       string
+		rows       []Message
+		page       PageRequest
+		want       []int
+		prev, next string
+	}{
+		{"empty channel", nil, PageRequest{Limit: 3}, []int{}, "nil", "nil"},
+		{"latest, all fit", rows(9, 7, 4), PageRequest{Limit: 3}, []int{4, 7, 9}, "nil", "nil"},
+		{"latest, more before", rows(9, 7, 4, 2), PageRequest{Limit: 3}, []int{4, 7, 9}, "4", "nil"},
+		{"before, more before", rows(7, 4, 2, 1), PageRequest{Before: 9, Limit: 3}, []int{2, 4, 7}, "2", "7"},
+		{"before, reaches the start", rows(4, 2), PageRequest{Before: 7, Limit: 3}, []int{2, 4}, "nil", "4"},
+		{"before the first message", nil, PageRequest{Before: 1, Limit: 3}, []int{}, "nil", "nil"},
+		{"after, more after", rows(4, 7, 9, 12), PageRequest{After: 2, Limit: 3}, []int{4, 7, 9}, "4", "9"},
+		{"after, reaches the end", rows(4, 7), PageRequest{After: 2, Limit: 3}, []int{4, 7}, "4", "nil"},
+		{"after the last message", nil, PageRequest{After: 12, Limit: 3}, []int{}, "nil", "nil"},
+		{"exactly one page", rows(3, 2, 1), PageRequest{Limit: 3}, []int{1, 2, 3}, "nil", "nil"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page := buildPage(tt.rows, tt.page)
+			if got := fmt.Sprint(ids(page)); got != fmt.Sprint(tt.want) {
+				t.Errorf("messages %s, want %v", got, tt.want)
+			}
+			if got := cursor(page.PrevCursor); got != tt.prev {
+				t.Errorf("prevCursor %s, want %s", got, tt.prev)
+			}
+			if got := cursor(page.NextCursor); got != tt.next {
+				t.Errorf("nextCursor %s, want %s", got, tt.next)
+			}
+		})
+	}
+}
+
+// testChannel creates a channel for one test and removes it afterwards
+func testChannel(t *testing.T, database *Database) (string, int) {
+	t.Helper()
+	name := fmt.Sprintf("test-%s-%d", t.Name(), time.Now().UnixNano())
+	var id int
+	if err := database.db.QueryRow(`INSERT INTO channels (name, description) VALUES ($1, '') RETURNING id`, name).Scan(&id); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.db.Exec(`DELETE FROM channels WHERE id = $1`, id) })
+	return name, id
+}
+
+func TestGetRoomMessagesPagesByIDAndSkipsReplies(t *testing.T) {
+	database := testDatabase(t)
+	name, channelId := testChannel(t, database)
+
+	// Every message has the same timestamp, so only the ID can order them,
+	// and each top-level message has a reply right after it
+	at := time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC)
+	var want []int
+	for i := 0; i < 7; i++ {
+		var id int
+		err := database.db.QueryRow(`INSERT INTO messages (content, username, channel_id, created_at) VALUES ($1, 'alice', $2, $3) RETURNING id`,
+			fmt.Sprintf("message %d", i), channelId, at).Scan(&id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, id)
+		if _, err := database.db.Exec(`INSERT INTO messages (content, username, channel_id, created_at, parent_id) VALUES ('reply', 'bob', $1, $2, $3)`,
+			channelId, at, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Walk back from the latest page, then forward again from the oldest
+	var backward []int
+	page := PageRequest{Limit: 3}
+	for {
+		got, err := database.GetRoomMessages(name, page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		backward = append(ids(got), backward...)
+		if got.PrevCursor == nil {
+			break
+		}
+		page = PageRequest{Before: *got.PrevCursor, Limit: 3}
+	}
+	if fmt.Sprint(backward) != fmt.Sprint(want) {
+		t.Errorf("paging backwards got %v, want %v", backward, want)
+	}
+
+	forward := []int{want[0]}
+	page = PageRequest{After: want[0], Limit: 3}
+	for {
+		got, err := database.GetRoomMessages(name, page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		forward = append(forward, ids(got)...)
+		if got.NextCursor == nil {
+			break
+		}
+		page = PageRequest{After: *got.NextCursor, Limit: 3}
+	}
+	if fmt.Sprint(forward) != fmt.Sprint(want) {
+		t.Errorf("paging forwards got %v, want %v", forward, want)
+	}
+}
@@ -0,0 +1,145 @@
+package db
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// DirectMessagePrefix starts the channel name of every direct message.
+// Regular channels may not use it.
+const DirectMessagePrefix = "dm-"
+
+// MaxDirectParticipants caps the size of a group direct message
+const MaxDirectParticipants = 9
+
+// DirectMessageID returns the conversation ID for a set of participants. It
+// does not depend on their order or on repeated names.
+func DirectMessageID(participants []string) string {
+	sum := sha256.Sum256([]byte(strings.Join(normalizeParticipants(participants), "\x00")))
+	return DirectMessagePrefix + hex.EncodeToString(sum[:16])
+}
+
+// normalizeParticipants returns the distinct non-empty usernames, sorted
+func normalizeParticipants(participants []string) []string {
+	seen := make(map[string]bool, len(participants))
+	result := make([]string, 0, len(participants))
+	for _, p := range participants {
+		p = strings.TrimSpace(p)
+		if p != "" && !seen[p] {
+			seen[p] = true
+			result = append(result, p)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// OpenDirectMessage returns the conversation between the given users,
+// creating it the first time. It is backed by a private channel whose
+// members are the participants, so messages, history, sequencing and
+// unread tracking work exactly as they do for channels.
+func (d *Database) OpenDirectMessage(participants []string) (*DirectMessage, error) {
+	participants = normalizeParticipants(participants)
+	if len(participants) < 2 || len(participants) > MaxDirectParticipants {
+		return nil, ErrInvalidParticipants
+	}
+
+	var known int
+	err := d.db.QueryRow(`SELECT COUNT(*) FROM users WHERE username = ANY($1)`, pq.Array(participants)).Scan(&known)
+	if err != nil {
+		return nil, err
+	}
+	if known != len(participants) {
+		return nil, ErrUnknownParticipant
+	}
+
+	id := DirectMessageID(participants)
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO channels (name, description, is_private, kind)
+		VALUES ($1, '', TRUE, 'dm')
+		ON CONFLICT (name) DO NOTHING
+	`, id)
+	if err != nil {
+		log.Printf("Error creating direct message %s: %v", id, err)
+		return nil, err
+	}
+
+	var kind string
+	var createdAt time.Time
+	if err := tx.QueryRow(`SELECT kind, created_at FROM channels WHERE name = $1`, id).Scan(&kind, &createdAt); err != nil {
+		return nil, err
+	}
+	if kind != KindDirect {
+		return nil, fmt.Errorf("channel %s exists and is not a direct message", id)
+	}
+
+	for _, p := range participants {
+		if err := addMember(tx, id, p, RoleMember); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return &DirectMessage{
+		ID:           id,
+		Participants: participants,
+		CreatedAt:    createdAt,
+	}, nil
+}
+
+// ListDirectMessages returns the user's direct messages, most recently
+// active first, with how many messages from others they have not seen
+func (d *Database) ListDirectMessages(username string) ([]DirectMessage, error) {
+	query := `
+		SELECT c.name, c.created_at,
+			ARRAY(SELECT p.username FROM channel_members p WHERE p.channel_id = c.id ORDER BY p.username),
+			(SELECT MAX(m.created_at) FROM messages m WHERE m.channel_id = c.id AND m.deleted_at IS NULL) AS last_message_at,
+			(SELECT COUNT(*) FROM messages m
+				WHERE m.channel_id = c.id AND m.deleted_at IS NULL AND m.username <> $1
+					AND m.id > COALESCE((
+						SELECT a.last_seen_message_id FROM user_channel_activity a
+						WHERE a.channel_id = c.id AND a.username = $1
+					), 0))
+		FROM channels c
+		JOIN channel_members me ON me.channel_id = c.id AND me.username = $1
+		WHERE c.kind = 'dm'
+		ORDER BY last_message_at DESC NULLS LAST, c.created_at DESC
+	`
+	rows, err := d.db.Query(query, username)
+	if err != nil {
+		log.Printf("Error listing direct messages for %s: %v", username, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	conversations := []DirectMessage{}
+	for rows.Next() {
+		var dm DirectMessage
+		var lastMessageAt sql.NullTime
+		if err := rows.Scan(&dm.ID, &dm.CreatedAt, pq.Array(&dm.Participants), &lastMessageAt, &dm.UnreadCount); err != nil {
+			return nil, err
+		}
+		if lastMessageAt.Valid {
+			dm.LastMessageAt = &lastMessageAt.Time
+		}
+		conversations = append(conversations, dm)
+	}
+	return conversations, rows.Err()
+}
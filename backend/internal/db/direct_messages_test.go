@@ -0,0 +1,61 @@
+package db
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDirectMessageIDIgnoresOrder(t *testing.T) {
+	want := DirectMessageID([]string{"alice", "bob", "carol"})
+	for _, participants := range [][]string{
+		{"bob", "alice", "carol"},
+		{"carol", "bob", "alice"},
+		{"alice", "carol", "bob"},
+	} {
+		if got := DirectMessageID(participants); got != want {
+			t.Errorf("%v: got %s, want %s", participants, got, want)
+		}
+	}
+}
+
+func TestDirectMessageIDIgnoresRepeatedNames(t *testing.T) {
+	want := DirectMessageID([]string{"alice", "bob"})
+	for _, participants := range [][]string{
+		{"alice", "bob", "alice"},
+		{"bob", "bob", "alice"},
+		{" alice", "bob ", ""},
+	} {
+		if got := DirectMessageID(participants); got != want {
+			t.Errorf("%v: got %s, want %s", participants, got, want)
+		}
+	}
+	if DirectMessageID([]string{"alice", "alice"}) == want {
+		t.Error("a conversation with yourself shares an ID with a pair")
+	}
+}
+
+func TestDirectMessageIDKeepsPairsApart(t *testing.T) {
+	names := []string{"a", "b", "ab", "ba", "bc", "c", "alice", "bob", "alicebob", "Alice"}
+	seen := make(map[string][]string)
+	for i, first := range names {
+		for _, second := range names[i+1:] {
+			pair := []string{first, second}
+			id := DirectMessageID(pair)
+			if !strings.HasPrefix(id, DirectMessagePrefix) {
+				t.Fatalf("%v: %s lacks the %s prefix", pair, id, DirectMessagePrefix)
+			}
+			if other, ok := seen[id]; ok {
+				t.Errorf("%v and %v share ID %s", pair, other, id)
+			}
+			seen[id] = pair
+		}
+	}
+
+	// Joining the names must not let a split in a different place collide
+	if DirectMessageID([]string{"ab", "c"}) == DirectMessageID([]string{"a", "bc"}) {
+		t.Error("[ab c] and [a bc] share an ID")
+	}
+	if DirectMessageID([]string{"alice", "bob"}) == DirectMessageID([]string{"alice", "bob", "carol"}) {
+		t.Error("a pair shares an ID with a group that contains it")
+	}
+}
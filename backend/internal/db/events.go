@@ -0,0 +1,138 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+)
+
+// MaxReplayEvents caps how many events a reconnecting client can catch up on;
+// anything further behind must reload history instead. Each room's log only
+// keeps that many events.
+const MaxReplayEvents = 500
+
+// RoomEvent is one sequenced event in a room's log
+type RoomEvent struct {
+	Seq     int64
+	Payload json.RawMessage
+}
+
+// AppendRoomEvent stores an event for a room and returns its sequence number.
+// The channel row is locked while the counter advances, so sequence numbers
+// are gapless and strictly increasing even with several instances writing.
+// Events that fall out of the replay window are trimmed at the same time.
+func (d *Database) AppendRoomEvent(roomId string, payload []byte) (int64, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var channelId int
+	var seq int64
+	err = tx.QueryRow(`UPDATE channels SET last_seq = last_seq + 1 WHERE name = $1 RETURNING id, last_seq`,
+		roomId).Scan(&channelId, &seq)
+	if err != nil {
+		log.Printf("Error advancing sequence for room %s: %v", roomId, err)
+		return 0, err
+	}
+
+	if _, err := tx.Exec(`INSERT INTO room_events (channel_id, seq, payload) VALUES ($1, $2, $3)`,
+		channelId, seq, payload); err != nil {
+		log.Printf("Error appending event %d to room %s: %v", seq, roomId, err)
+		return 0, err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM room_events WHERE channel_id = $1 AND seq <= $2`,
+		channelId, seq-MaxReplayEvents); err != nil {
+		log.Printf("Error trimming events of room %s: %v", roomId, err)
+		return 0, err
+	}
+
+	return seq, tx.Commit()
+}
+
+// scrubRoomEvents blanks a deleted message's content in its room's log, so
+// replaying the log does not bring the text back
+func scrubRoomEvents(q execer, messageId int) error {
+	_, err := q.Exec(`
+		UPDATE room_events e SET payload = jsonb_set(e.payload, '{content}', '""')
+		FROM messages m
+		WHERE m.id = $1 AND e.channel_id = m.channel_id
+		  AND (e.payload->>'id')::int = m.id
+	`, messageId)
+	return err
+}
+
+// AckRoomEvents records that a user has received a room's events up to seq.
+// The acknowledged sequence number only moves forward and never past the
+// room's last event.
+func (d *Database) AckRoomEvents(username, roomId string, seq int64) error {
+	res, err := d.db.Exec(`
+		INSERT INTO user_channel_activity (username, channel_id, last_acked_seq)
+		SELECT $1, id, LEAST($3, last_seq) FROM channels WHERE name = $2
+		ON CONFLICT (username, channel_id)
+		DO UPDATE SET last_acked_seq = GREATEST(user_channel_activity.last_acked_seq, EXCLUDED.last_acked_seq)
+	`, username, roomId, seq)
+	if err != nil {
+		log.Printf("Error acknowledging event %d in room %s for %s: %v", seq, roomId, username, err)
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrChannelNotFound
+	}
+	return nil
+}
+
+// GetAckedSeq returns the last sequence number a user acknowledged in a room, or 0
+func (d *Database) GetAckedSeq(username, roomId string) (int64, error) {
+	var seq int64
+	err := d.db.QueryRow(`
+		SELECT a.last_acked_seq
+		FROM user_channel_activity a
+		JOIN channels c ON a.channel_id = c.id
+		WHERE a.username = $1 AND c.name = $2
+	`, username, roomId).Scan(&seq)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return seq, err
+}
+
+// GetLastSeq returns the sequence number of a room's latest event, or 0 before its first
+func (d *Database) GetLastSeq(roomId string) (int64, error) {
+	var seq int64
+	err := d.db.QueryRow(`SELECT last_seq FROM channels WHERE name = $1`, roomId).Scan(&seq)
+	if err == sql.ErrNoRows {
+		return 0, ErrChannelNotFound
+	}
+	return seq, err
+}
+
+// GetRoomEvents returns up to limit events in a room after the given sequence number, oldest first
+func (d *Database) GetRoomEvents(roomId string, afterSeq int64, limit int) ([]RoomEvent, error) {
+	query := `
+		SELECT e.seq, e.payload
+		FROM room_events e
+		JOIN channels c ON e.channel_id = c.id
+		WHERE c.name = $1 AND e.seq > $2
+		ORDER BY e.seq ASC
+		LIMIT $3
+	`
+	rows, err := d.db.Query(query, roomId, afterSeq, limit)
+	if err != nil {
+		log.Printf("Error querying events for room %s: %v", roomId, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []RoomEvent{}
+	for rows.Next() {
+		var e RoomEvent
+		if err := rows.Scan(&e.Seq, &e.Payload); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
@@ -0,0 +1,337 @@
+package db
+
+import (
+	"database/sql"
+	"log"
+)
+
+// roleRank orders channel roles from least to most privileged
+var roleRank = map[string]int{
+	RoleMember: 1,
+	RoleAdmin:  2,
+	RoleOwner:  3,
+}
+
+// RoleAtLeast reports whether role grants at least the privileges of min
+func RoleAtLeast(role, min string) bool {
+	return roleRank[role] >= roleRank[min] && roleRank[role] > 0
+}
+
+// ValidRole reports whether role is one of the channel roles
+func ValidRole(role string) bool {
+	return roleRank[role] > 0
+}
+
+// CheckChannelAccess returns nil if the user may read the channel: it is
+// public or they are a member. It returns ErrChannelNotFound or
+// ErrNotChannelMember otherwise.
+func (d *Database) CheckChannelAccess(channelName, username string) error {
+	query := `
+		SELECT c.is_private,
+			EXISTS (SELECT 1 FROM channel_members m WHERE m.channel_id = c.id AND m.username = $2)
+		FROM channels c
+		WHERE c.name = $1
+	`
+	var private, member bool
+	err := d.db.QueryRow(query, channelName, username).Scan(&private, &member)
+	if err == sql.ErrNoRows {
+		return ErrChannelNotFound
+	}
+	if err != nil {
+		log.Printf("Error checking access to channel %s for %s: %v", channelName, username, err)
+		return err
+	}
+	if private && !member {
+		return ErrNotChannelMember
+	}
+	return nil
+}
+
+// GetChannel returns a channel by name
+func (d *Database) GetChannel(channelName string) (*Channel, error) {
+	var ch Channel
+	err := scanChannel(d.db.QueryRow(`SELECT `+channelColumns+` FROM channels WHERE name = $1`, channelName), &ch)
+	if err == sql.ErrNoRows {
+		return nil, ErrChannelNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ch, nil
+}
+
+// GetMemberRole returns the user's role in a channel, or ErrNotChannelMember
+func (d *Database) GetMemberRole(channelName, username string) (string, error) {
+	query := `
+		SELECT m.role
+		FROM channel_members m
+		JOIN channels c ON m.channel_id = c.id
+		WHERE c.name = $1 AND m.username = $2
+	`
+	var role string
+	err := d.db.QueryRow(query, channelName, username).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", ErrNotChannelMember
+	}
+	if err != nil {
+		return "", err
+	}
+	return role, nil
+}
+
+// ListMembers returns a channel's members, owners first
+func (d *Database) ListMembers(channelName string) ([]Member, error) {
+	query := `
+		SELECT m.username, m.role, m.joined_at
+		FROM channel_members m
+		JOIN channels c ON m.channel_id = c.id
+		WHERE c.name = $1
+		ORDER BY CASE m.role WHEN 'owner' THEN 0 WHEN 'admin' THEN 1 ELSE 2 END, m.username
+	`
+	rows, err := d.db.Query(query, channelName)
+	if err != nil {
+		log.Printf("Error listing members of %s: %v", channelName, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []Member{}
+	for rows.Next() {
+		var m Member
+		if err := rows.Scan(&m.Username, &m.Role, &m.JoinedAt); err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+// AddMember makes a user a member of a channel with the given role. A user
+// who already belongs to the channel keeps their current role.
+func (d *Database) AddMember(channelName, username, role string) error {
+	if !ValidRole(role) {
+		return ErrInvalidRole
+	}
+	return addMember(d.db, channelName, username, role)
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func addMember(q execer, channelName, username, role string) error {
+	var channelId int
+	err := q.QueryRow(`SELECT id FROM channels WHERE name = $1`, channelName).Scan(&channelId)
+	if err == sql.ErrNoRows {
+		return ErrChannelNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO channel_members (channel_id, username, role)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (channel_id, username) DO NOTHING
+	`
+	if _, err := q.Exec(query, channelId, username, role); err != nil {
+		log.Printf("Error adding %s to %s: %v", username, channelName, err)
+		return err
+	}
+	return nil
+}
+
+// RemoveMember takes a user out of a channel
+func (d *Database) RemoveMember(channelName, username string) error {
+	query := `
+		DELETE FROM channel_members
+		WHERE channel_id = (SELECT id FROM channels WHERE name = $1) AND username = $2
+	`
+	result, err := d.db.Exec(query, channelName, username)
+	if err != nil {
+		log.Printf("Error removing %s from %s: %v", username, channelName, err)
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotChannelMember
+	}
+	return nil
+}
+
+// SetMemberRole changes the role of an existing member
+func (d *Database) SetMemberRole(channelName, username, role string) error {
+	if !ValidRole(role) {
+		return ErrInvalidRole
+	}
+	query := `
+		UPDATE channel_members SET role = $3
+		WHERE channel_id = (SELECT id FROM channels WHERE name = $1) AND username = $2
+	`
+	result, err := d.db.Exec(query, channelName, username, role)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotChannelMember
+	}
+	return nil
+}
+
+// InviteMember records an invitation for a user to join a channel
+func (d *Database) InviteMember(channelName, username, invitedBy string) error {
+	var exists bool
+	if err := d.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM users WHERE username = $1)`, username).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return ErrUserNotFound
+	}
+	if _, err := d.GetMemberRole(channelName, username); err == nil {
+		return ErrAlreadyMember
+	}
+
+	query := `
+		INSERT INTO channel_invitations (channel_id, username, invited_by)
+		SELECT id, $2, $3 FROM channels WHERE name = $1
+		ON CONFLICT (channel_id, username) DO UPDATE SET invited_by = EXCLUDED.invited_by, created_at = NOW()
+	`
+	result, err := d.db.Exec(query, channelName, username, invitedBy)
+	if err != nil {
+		log.Printf("Error inviting %s to %s: %v", username, channelName, err)
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrChannelNotFound
+	}
+	return nil
+}
+
+// ListInvitations returns the invitations waiting for a user
+func (d *Database) ListInvitations(username string) ([]Invitation, error) {
+	query := `
+		SELECT c.name, i.username, i.invited_by, i.created_at
+		FROM channel_invitations i
+		JOIN channels c ON i.channel_id = c.id
+		WHERE i.username = $1
+		ORDER BY i.created_at DESC
+	`
+	rows, err := d.db.Query(query, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invitations := []Invitation{}
+	for rows.Next() {
+		var inv Invitation
+		if err := rows.Scan(&inv.Channel, &inv.Username, &inv.InvitedBy, &inv.CreatedAt); err != nil {
+			return nil, err
+		}
+		invitations = append(invitations, inv)
+	}
+	return invitations, rows.Err()
+}
+
+// AcceptInvitation turns a pending invitation into membership
+func (d *Database) AcceptInvitation(channelName, username string) error {
+	return d.consumePending("channel_invitations", ErrInvitationNotFound, channelName, username)
+}
+
+// DeclineInvitation discards a pending invitation
+func (d *Database) DeclineInvitation(channelName, username string) error {
+	return d.discardPending("channel_invitations", ErrInvitationNotFound, channelName, username)
+}
+
+// RequestToJoin asks the admins of a channel to let a user in
+func (d *Database) RequestToJoin(channelName, username string) error {
+	if _, err := d.GetMemberRole(channelName, username); err == nil {
+		return ErrAlreadyMember
+	}
+
+	query := `
+		INSERT INTO channel_join_requests (channel_id, username)
+		SELECT id, $2 FROM channels WHERE name = $1
+		ON CONFLICT (channel_id, username) DO NOTHING
+	`
+	if _, err := d.db.Exec(query, channelName, username); err != nil {
+		log.Printf("Error filing join request for %s in %s: %v", username, channelName, err)
+		return err
+	}
+	return nil
+}
+
+// ListJoinRequests returns the pending requests to join a channel, oldest first
+func (d *Database) ListJoinRequests(channelName string) ([]JoinRequest, error) {
+	query := `
+		SELECT c.name, r.username, r.created_at
+		FROM channel_join_requests r
+		JOIN channels c ON r.channel_id = c.id
+		WHERE c.name = $1
+		ORDER BY r.created_at ASC
+	`
+	rows, err := d.db.Query(query, channelName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	requests := []JoinRequest{}
+	for rows.Next() {
+		var r JoinRequest
+		if err := rows.Scan(&r.Channel, &r.Username, &r.CreatedAt); err != nil {
+			return nil, err
+		}
+		requests = append(requests, r)
+	}
+	return requests, rows.Err()
+}
+
+// ApproveJoinRequest turns a pending join request into membership
+func (d *Database) ApproveJoinRequest(channelName, username string) error {
+	return d.consumePending("channel_join_requests", ErrJoinRequestNotFound, channelName, username)
+}
+
+// RejectJoinRequest discards a pending join request
+func (d *Database) RejectJoinRequest(channelName, username string) error {
+	return d.discardPending("channel_join_requests", ErrJoinRequestNotFound, channelName, username)
+}
+
+// consumePending deletes an invitation or join request and adds the user as
+// a member in the same transaction. table is one of the two fixed table names.
+func (d *Database) consumePending(table string, notFound error, channelName, username string) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`DELETE FROM `+table+`
+		WHERE channel_id = (SELECT id FROM channels WHERE name = $1) AND username = $2`,
+		channelName, username)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return notFound
+	}
+
+	if err := addMember(tx, channelName, username, RoleMember); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (d *Database) discardPending(table string, notFound error, channelName, username string) error {
+	result, err := d.db.Exec(`DELETE FROM `+table+`
+		WHERE channel_id = (SELECT id FROM channels WHERE name = $1) AND username = $2`,
+		channelName, username)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return notFound
+	}
+	return nil
+}
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS user_channel_activity;
+DROP TABLE IF EXISTS messages;
+DROP TABLE IF EXISTS channels;
+DROP TABLE IF EXISTS users;
@@ -0,0 +1,35 @@
+-- Tables that existing installations created by hand are created only if missing
+CREATE TABLE IF NOT EXISTS users (
+	id BIGSERIAL PRIMARY KEY,
+	username VARCHAR(50) NOT NULL UNIQUE,
+	email VARCHAR(255) NOT NULL UNIQUE,
+	password VARCHAR(255) NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS channels (
+	id SERIAL PRIMARY KEY,
+	name VARCHAR(100) NOT NULL UNIQUE,
+	description TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+ALTER TABLE channels ADD COLUMN IF NOT EXISTS created_by VARCHAR(50);
+
+CREATE TABLE IF NOT EXISTS messages (
+	id SERIAL PRIMARY KEY,
+	content TEXT NOT NULL,
+	username VARCHAR(50) NOT NULL,
+	channel_id INTEGER NOT NULL REFERENCES channels(id) ON DELETE CASCADE,
+	created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_messages_channel_id ON messages(channel_id, id);
+
+CREATE TABLE IF NOT EXISTS user_channel_activity (
+	id SERIAL PRIMARY KEY,
+	username VARCHAR(50) NOT NULL,
+	channel_id INTEGER NOT NULL REFERENCES channels(id),
+	last_seen_message_id INTEGER,
+	last_activity TIMESTAMP DEFAULT NOW(),
+	UNIQUE(username, channel_id)
+);
@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS user_sessions (
+	id VARCHAR(64) PRIMARY KEY,
+	user_id BIGINT NOT NULL,
+	username VARCHAR(50) NOT NULL,
+	created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+	expires_at TIMESTAMP NOT NULL,
+	revoked_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_user_sessions_user_id ON user_sessions(user_id);
+
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+	token_hash CHAR(64) PRIMARY KEY,
+	session_id VARCHAR(64) NOT NULL REFERENCES user_sessions(id) ON DELETE CASCADE,
+	created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+	expires_at TIMESTAMP NOT NULL,
+	used_at TIMESTAMP
+);
@@ -0,0 +1,3 @@
+ALTER TABLE messages ADD COLUMN parent_id INTEGER REFERENCES messages(id) ON DELETE CASCADE;
+
+CREATE INDEX idx_messages_parent_id ON messages(parent_id, id) WHERE parent_id IS NOT NULL;
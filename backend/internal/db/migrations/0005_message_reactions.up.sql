@@ -0,0 +1,7 @@
+CREATE TABLE message_reactions (
+	message_id INTEGER NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+	username VARCHAR(50) NOT NULL,
+	emoji VARCHAR(64) NOT NULL,
+	created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+	PRIMARY KEY (message_id, emoji, username)
+);
@@ -0,0 +1,5 @@
+CREATE TABLE user_presence (
+	username VARCHAR(50) PRIMARY KEY,
+	status VARCHAR(10) NOT NULL DEFAULT 'offline',
+	last_active_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS room_events;
+ALTER TABLE channels DROP COLUMN IF EXISTS last_seq;
@@ -0,0 +1,10 @@
+ALTER TABLE channels ADD COLUMN last_seq BIGINT NOT NULL DEFAULT 0;
+
+-- Every sequenced event broadcast to a room, so reconnecting clients can replay what they missed
+CREATE TABLE room_events (
+	channel_id INTEGER NOT NULL REFERENCES channels(id) ON DELETE CASCADE,
+	seq BIGINT NOT NULL,
+	payload JSONB NOT NULL,
+	created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+	PRIMARY KEY (channel_id, seq)
+);
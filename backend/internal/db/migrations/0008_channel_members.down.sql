@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS channel_join_requests;
+DROP TABLE IF EXISTS channel_invitations;
+DROP TABLE IF EXISTS channel_members;
+ALTER TABLE channels DROP COLUMN IF EXISTS is_private;
@@ -0,0 +1,30 @@
+ALTER TABLE channels ADD COLUMN is_private BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE TABLE channel_members (
+	channel_id INTEGER NOT NULL REFERENCES channels(id) ON DELETE CASCADE,
+	username VARCHAR(50) NOT NULL,
+	role VARCHAR(10) NOT NULL DEFAULT 'member' CHECK (role IN ('owner', 'admin', 'member')),
+	joined_at TIMESTAMP NOT NULL DEFAULT NOW(),
+	PRIMARY KEY (channel_id, username)
+);
+
+CREATE INDEX idx_channel_members_username ON channel_members(username);
+
+CREATE TABLE channel_invitations (
+	channel_id INTEGER NOT NULL REFERENCES channels(id) ON DELETE CASCADE,
+	username VARCHAR(50) NOT NULL,
+	invited_by VARCHAR(50) NOT NULL,
+	created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+	PRIMARY KEY (channel_id, username)
+);
+
+CREATE TABLE channel_join_requests (
+	channel_id INTEGER NOT NULL REFERENCES channels(id) ON DELETE CASCADE,
+	username VARCHAR(50) NOT NULL,
+	created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+	PRIMARY KEY (channel_id, username)
+);
+
+-- Whoever created an existing channel owns it
+INSERT INTO channel_members (channel_id, username, role)
+SELECT id, created_by, 'owner' FROM channels WHERE created_by IS NOT NULL AND created_by <> '';
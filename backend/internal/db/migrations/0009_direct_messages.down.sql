@@ -0,0 +1,2 @@
+DELETE FROM channels WHERE kind = 'dm';
+ALTER TABLE channels DROP COLUMN IF EXISTS kind;
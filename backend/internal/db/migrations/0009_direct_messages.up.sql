@@ -0,0 +1,2 @@
+-- Direct messages are private channels whose members are the participants
+ALTER TABLE channels ADD COLUMN kind VARCHAR(10) NOT NULL DEFAULT 'channel' CHECK (kind IN ('channel', 'dm'));
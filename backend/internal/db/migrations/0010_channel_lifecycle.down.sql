@@ -0,0 +1,6 @@
+ALTER TABLE user_channel_activity DROP CONSTRAINT IF EXISTS user_channel_activity_channel_id_fkey;
+ALTER TABLE user_channel_activity ADD CONSTRAINT user_channel_activity_channel_id_fkey
+	FOREIGN KEY (channel_id) REFERENCES channels(id);
+
+ALTER TABLE channels DROP COLUMN IF EXISTS archived_at;
+ALTER TABLE channels DROP COLUMN IF EXISTS topic;
@@ -0,0 +1,7 @@
+ALTER TABLE channels ADD COLUMN topic TEXT NOT NULL DEFAULT '';
+ALTER TABLE channels ADD COLUMN archived_at TIMESTAMP;
+
+-- Deleting a channel takes its read markers with it, like everything else that references it
+ALTER TABLE user_channel_activity DROP CONSTRAINT IF EXISTS user_channel_activity_channel_id_fkey;
+ALTER TABLE user_channel_activity ADD CONSTRAINT user_channel_activity_channel_id_fkey
+	FOREIGN KEY (channel_id) REFERENCES channels(id) ON DELETE CASCADE;
@@ -0,0 +1,4 @@
+ALTER TABLE messages ADD COLUMN search_vector tsvector
+	GENERATED ALWAYS AS (to_tsvector('english', content)) STORED;
+
+CREATE INDEX idx_messages_search ON messages USING GIN (search_vector);
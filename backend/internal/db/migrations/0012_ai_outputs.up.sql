@@ -0,0 +1,16 @@
+-- Generated AI replies, reused until a message in their range is edited or deleted
+CREATE TABLE ai_outputs (
+    id SERIAL PRIMARY KEY,
+    kind VARCHAR(20) NOT NULL CHECK (kind IN ('context', 'missed_summary')),
+    channel_id INTEGER NOT NULL REFERENCES channels(id) ON DELETE CASCADE,
+    target_id INTEGER NOT NULL DEFAULT 0,
+    first_message_id INTEGER NOT NULL,
+    last_message_id INTEGER NOT NULL,
+    prompt_version INTEGER NOT NULL,
+    model VARCHAR(100) NOT NULL,
+    content TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    UNIQUE (kind, channel_id, target_id, first_message_id, last_message_id, prompt_version, model)
+);
+
+CREATE INDEX idx_ai_outputs_range ON ai_outputs (channel_id, first_message_id, last_message_id);
@@ -0,0 +1,16 @@
+-- One row per open socket on any instance. A user is online while they have
+-- a row whose heartbeat is recent; rows of crashed instances go stale and
+-- are removed by the instances still running.
+CREATE TABLE presence_connections (
+	connection_id VARCHAR(100) PRIMARY KEY,
+	username VARCHAR(50) NOT NULL,
+	instance_id VARCHAR(50) NOT NULL,
+	connected_at TIMESTAMP NOT NULL DEFAULT NOW(),
+	heartbeat_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_presence_connections_username ON presence_connections (username);
+CREATE INDEX idx_presence_connections_heartbeat ON presence_connections (heartbeat_at);
+
+-- Nobody is connected yet; statuses left over from before are stale
+UPDATE user_presence SET status = 'offline' WHERE status <> 'offline';
@@ -0,0 +1,8 @@
+-- Hub events too large for a NOTIFY payload; the notification carries only the id
+CREATE TABLE hub_events (
+	id BIGSERIAL PRIMARY KEY,
+	payload JSONB NOT NULL,
+	created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_hub_events_created_at ON hub_events (created_at);
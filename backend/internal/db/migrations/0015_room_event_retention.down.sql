@@ -0,0 +1 @@
+ALTER TABLE user_channel_activity DROP COLUMN IF EXISTS last_acked_seq;
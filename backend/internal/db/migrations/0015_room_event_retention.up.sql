@@ -0,0 +1,12 @@
+-- The last room event each user confirmed receiving, so a client that lost its own position can resume
+ALTER TABLE user_channel_activity ADD COLUMN last_acked_seq BIGINT NOT NULL DEFAULT 0;
+
+-- Deleted messages must not come back when the log is replayed
+UPDATE room_events e SET payload = jsonb_set(e.payload, '{content}', '""')
+FROM messages m
+WHERE e.channel_id = m.channel_id AND (e.payload->>'id')::int = m.id AND m.deleted_at IS NOT NULL;
+
+-- Each room only keeps its replay window (db.MaxReplayEvents)
+DELETE FROM room_events e
+USING channels c
+WHERE e.channel_id = c.id AND e.seq <= c.last_seq - 500;
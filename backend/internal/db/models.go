@@ -0,0 +1,217 @@
+package db
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	// ErrMessageNotFound is returned when a message does not exist or has been deleted
+	ErrMessageNotFound = errors.New("message not found")
+	// ErrNotMessageAuthor is returned when someone other than the author changes a message
+	ErrNotMessageAuthor = errors.New("only the author can change this message")
+	// ErrChannelNotFound is returned when a channel does not exist
+	ErrChannelNotFound = errors.New("channel not found")
+	// ErrNotChannelMember is returned when a user needs to belong to a channel and does not
+	ErrNotChannelMember = errors.New("not a member of this channel")
+	// ErrAlreadyMember is returned when inviting or admitting someone who already belongs to a channel
+	ErrAlreadyMember = errors.New("already a member of this channel")
+	// ErrInvalidRole is returned for a role other than owner, admin or member
+	ErrInvalidRole = errors.New("role must be owner, admin or member")
+	// ErrInvitationNotFound is returned when accepting or declining an invitation that does not exist
+	ErrInvitationNotFound = errors.New("invitation not found")
+	// ErrJoinRequestNotFound is returned when approving or rejecting a join request that does not exist
+	ErrJoinRequestNotFound = errors.New("join request not found")
+	// ErrInvalidParticipants is returned when a direct message has too few or too many participants
+	ErrInvalidParticipants = errors.New("a direct message needs between 2 and 9 participants")
+	// ErrUserNotFound is returned when inviting a user that does not exist
+	ErrUserNotFound = errors.New("user not found")
+	// ErrUnknownParticipant is returned when a direct message names a user that does not exist
+	ErrUnknownParticipant = errors.New("participant does not exist")
+	// ErrChannelExists is returned when creating or renaming a channel to a name already in use
+	ErrChannelExists = errors.New("a channel with this name already exists")
+	// ErrInvalidChannelName is returned for a name that cannot be used for a channel
+	ErrInvalidChannelName = errors.New("channel names must be 1-100 characters, not all digits, without / or , and not start with dm-")
+	// ErrTopicTooLong is returned for a topic longer than MaxTopicLength
+	ErrTopicTooLong = errors.New("topic must be at most 250 characters")
+	// ErrChannelArchived is returned when posting to or changing messages in an archived channel
+	ErrChannelArchived = errors.New("channel is archived and read-only")
+	// ErrDirectMessage is returned when a channel operation is attempted on a direct message
+	ErrDirectMessage = errors.New("direct messages have a fixed set of participants")
+	// ErrAIOutputNotFound is returned when no generated reply is stored for a key
+	ErrAIOutputNotFound = errors.New("no stored AI output")
+	// ErrAIOutputStale is returned when saving a reply whose messages were edited or deleted while it was generated
+	ErrAIOutputStale = errors.New("messages changed while the AI output was generated")
+)
+
+// Message is a chat message stored in a channel
+type Message struct {
+	ID         int        `json:"id"`
+	Content    string     `json:"content"`
+	Username   string     `json:"username"`
+	ChannelID  int        `json:"channelId"`
+	ParentID   *int       `json:"parentId,omitempty"`
+	RoomID     string     `json:"roomId"`
+	Timestamp  time.Time  `json:"timestamp"`
+	EditedAt   *time.Time `json:"editedAt,omitempty"`
+	Deleted    bool       `json:"deleted,omitempty"`
+	ReplyCount int        `json:"replyCount"`
+	Reactions  []Reaction `json:"reactions,omitempty"`
+}
+
+// Reaction is the aggregate of everyone who reacted to a message with one emoji
+type Reaction struct {
+	Emoji string   `json:"emoji"`
+	Count int      `json:"count"`
+	Users []string `json:"users"`
+}
+
+// Presence statuses
+const (
+	PresenceOnline  = "online"
+	PresenceAway    = "away"
+	PresenceOffline = "offline"
+)
+
+// Presence is whether a user is connected and when they last did something
+type Presence struct {
+	Username     string    `json:"username"`
+	Status       string    `json:"status"`
+	LastActiveAt time.Time `json:"lastActiveAt"`
+}
+
+// Channel is a named room messages are posted to
+type Channel struct {
+	ID          int        `json:"id"`
+	Name        string     `json:"name"`
+	Description string     `json:"description"`
+	CreatedBy   string     `json:"createdBy,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	IsPrivate   bool       `json:"isPrivate"`
+	Kind        string     `json:"kind"`
+	Topic       string     `json:"topic"`
+	ArchivedAt  *time.Time `json:"archivedAt,omitempty"`
+}
+
+// Channel kinds
+const (
+	KindChannel = "channel"
+	KindDirect  = "dm"
+)
+
+// DirectMessage is a conversation between a fixed set of users. ID is the
+// name of the channel backing it and is the same for the same participants.
+type DirectMessage struct {
+	ID            string     `json:"id"`
+	Participants  []string   `json:"participants"`
+	CreatedAt     time.Time  `json:"createdAt"`
+	LastMessageAt *time.Time `json:"lastMessageAt,omitempty"`
+	UnreadCount   int        `json:"unreadCount"`
+}
+
+// Channel roles, from most to least privileged
+const (
+	RoleOwner  = "owner"
+	RoleAdmin  = "admin"
+	RoleMember = "member"
+)
+
+// Member is a user's membership in a channel
+type Member struct {
+	Username string    `json:"username"`
+	Role     string    `json:"role"`
+	JoinedAt time.Time `json:"joinedAt"`
+}
+
+// Invitation is a standing offer for a user to join a private channel
+type Invitation struct {
+	Channel   string    `json:"channel"`
+	Username  string    `json:"username"`
+	InvitedBy string    `json:"invitedBy"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// JoinRequest is a user asking to be let into a private channel
+type JoinRequest struct {
+	Channel   string    `json:"channel"`
+	Username  string    `json:"username"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+const (
+	// DefaultPageSize is used when a page request does not set a limit
+	DefaultPageSize = 50
+	// MaxPageSize caps how many messages a single page may return
+	MaxPageSize = 200
+)
+
+// PageRequest selects a window of channel history. Before and After are
+// message IDs; at most one of them may be set. With neither set the most
+// recent messages are returned.
+type PageRequest struct {
+	Before int
+	After  int
+	Limit  int
+}
+
+// MessagePage is one window of channel history in ascending ID order.
+// PrevCursor is passed as "before" to load older messages and NextCursor as
+// "after" to load newer ones; each is nil when there is nothing further.
+type MessagePage struct {
+	Messages   []Message `json:"messages"`
+	PrevCursor *int      `json:"prevCursor"`
+	NextCursor *int      `json:"nextCursor"`
+}
+
+// Repository is the storage used by the chat and AI handlers
+type Repository interface {
+	SaveMessage(content, username string, roomId string) (*Message, error)
+	EditMessage(messageId int, username, content string) (*Message, error)
+	DeleteMessage(messageId int, username string) (*Message, error)
+	GetMessage(messageId int) (*Message, error)
+	SaveReply(content, username string, parentId int) (*Message, error)
+	GetReplies(parentId int) ([]Message, error)
+	AddReaction(messageId int, username, emoji string) ([]Reaction, error)
+	RemoveReaction(messageId int, username, emoji string) ([]Reaction, error)
+	SetPresence(username, status string, lastActive time.Time) error
+	GetPresence(usernames []string) ([]Presence, error)
+	AddPresenceConnection(connectionId, username, instanceId string) (int, error)
+	RemovePresenceConnection(connectionId, username string) (int, error)
+	HeartbeatPresenceConnections(instanceId string) error
+	ExpirePresenceConnections() ([]string, error)
+	GetRoomMessages(roomId string, page PageRequest) (*MessagePage, error)
+	SearchMessages(username string, search SearchQuery) (*SearchPage, error)
+	GetMessageWithThread(messageId int) (*Message, []Message, error)
+	CreateChannel(name, description, createdBy string, isPrivate bool) (int, error)
+	GetAllChannels(username string) ([]Channel, error)
+	GetChannel(channelName string) (*Channel, error)
+	RenameChannel(oldName, newName string) (*Channel, error)
+	SetChannelTopic(channelName, topic string) (*Channel, error)
+	SetChannelArchived(channelName string, archived bool) (*Channel, error)
+	DeleteChannel(channelName string) error
+	CheckChannelAccess(channelName, username string) error
+	GetMemberRole(channelName, username string) (string, error)
+	ListMembers(channelName string) ([]Member, error)
+	AddMember(channelName, username, role string) error
+	RemoveMember(channelName, username string) error
+	SetMemberRole(channelName, username, role string) error
+	InviteMember(channelName, username, invitedBy string) error
+	ListInvitations(username string) ([]Invitation, error)
+	AcceptInvitation(channelName, username string) error
+	DeclineInvitation(channelName, username string) error
+	RequestToJoin(channelName, username string) error
+	ListJoinRequests(channelName string) ([]JoinRequest, error)
+	ApproveJoinRequest(channelName, username string) error
+	RejectJoinRequest(channelName, username string) error
+	OpenDirectMessage(participants []string) (*DirectMessage, error)
+	ListDirectMessages(username string) ([]DirectMessage, error)
+	UpdateUserLastSeen(username string, channelName string, messageId int) error
+	GetUnreadMessages(username string, channelName string) ([]Message, error)
+	GetAIOutput(key AIOutputKey) (*AIOutput, error)
+	SaveAIOutput(key AIOutputKey, content string, since time.Time) (*AIOutput, error)
+	AppendRoomEvent(roomId string, payload []byte) (int64, error)
+	GetRoomEvents(roomId string, afterSeq int64, limit int) ([]RoomEvent, error)
+	AckRoomEvents(username, roomId string, seq int64) error
+	GetLastSeq(roomId string) (int64, error)
+	GetAckedSeq(username, roomId string) (int64, error)
+}
@@ -0,0 +1,153 @@
+package db
+
+import (
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// awayAfter is how long an online user can be idle before being reported as away
+	awayAfter = 5 * time.Minute
+	// PresenceStaleAfter is how long a connection counts without a heartbeat.
+	// Instances heartbeat their connections well within it.
+	PresenceStaleAfter = 90 * time.Second
+)
+
+// SetPresence records a user's status and when they were last active
+func (d *Database) SetPresence(username, status string, lastActive time.Time) error {
+	query := `
+		INSERT INTO user_presence (username, status, last_active_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (username)
+		DO UPDATE SET status = EXCLUDED.status, last_active_at = EXCLUDED.last_active_at
+	`
+	if _, err := d.db.Exec(query, username, status, lastActive); err != nil {
+		log.Printf("Error setting presence for %s: %v", username, err)
+		return err
+	}
+	return nil
+}
+
+// AddPresenceConnection records an open socket and returns how many live
+// connections the user has now, this one included
+func (d *Database) AddPresenceConnection(connectionId, username, instanceId string) (int, error) {
+	if _, err := d.db.Exec(`
+		INSERT INTO presence_connections (connection_id, username, instance_id)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (connection_id) DO UPDATE SET heartbeat_at = NOW()
+	`, connectionId, username, instanceId); err != nil {
+		log.Printf("Error recording connection %s for %s: %v", connectionId, username, err)
+		return 0, err
+	}
+	return d.liveConnections(username)
+}
+
+// RemovePresenceConnection forgets a closed socket and returns how many
+// live connections the user still has on any instance
+func (d *Database) RemovePresenceConnection(connectionId, username string) (int, error) {
+	if _, err := d.db.Exec(`DELETE FROM presence_connections WHERE connection_id = $1`, connectionId); err != nil {
+		log.Printf("Error removing connection %s for %s: %v", connectionId, username, err)
+		return 0, err
+	}
+	return d.liveConnections(username)
+}
+
+func (d *Database) liveConnections(username string) (int, error) {
+	var n int
+	err := d.db.QueryRow(`
+		SELECT COUNT(*) FROM presence_connections
+		WHERE username = $1 AND heartbeat_at > NOW() - make_interval(secs => $2)
+	`, username, PresenceStaleAfter.Seconds()).Scan(&n)
+	return n, err
+}
+
+// HeartbeatPresenceConnections marks every connection of an instance as still open
+func (d *Database) HeartbeatPresenceConnections(instanceId string) error {
+	_, err := d.db.Exec(`UPDATE presence_connections SET heartbeat_at = NOW() WHERE instance_id = $1`, instanceId)
+	return err
+}
+
+// ExpirePresenceConnections removes connections whose instance stopped
+// heartbeating and returns the users left without any live connection
+func (d *Database) ExpirePresenceConnections() ([]string, error) {
+	query := `
+		WITH expired AS (
+			DELETE FROM presence_connections
+			WHERE heartbeat_at <= NOW() - make_interval(secs => $1)
+			RETURNING username
+		)
+		SELECT DISTINCT e.username FROM expired e
+		WHERE NOT EXISTS (
+			SELECT 1 FROM presence_connections c
+			WHERE c.username = e.username AND c.heartbeat_at > NOW() - make_interval(secs => $1)
+		)
+	`
+	rows, err := d.db.Query(query, PresenceStaleAfter.Seconds())
+	if err != nil {
+		log.Printf("Error expiring stale connections: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	usernames := []string{}
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			return nil, err
+		}
+		usernames = append(usernames, username)
+	}
+	return usernames, rows.Err()
+}
+
+// GetPresence returns the presence of the given users. A user is online or
+// away only while they have a live connection on some instance; users that
+// were never seen are reported offline.
+func (d *Database) GetPresence(usernames []string) ([]Presence, error) {
+	presence := []Presence{}
+	if len(usernames) == 0 {
+		return presence, nil
+	}
+
+	query := `
+		SELECT u.username, COALESCE(p.status, 'offline'), p.last_active_at,
+			EXISTS (
+				SELECT 1 FROM presence_connections c
+				WHERE c.username = u.username AND c.heartbeat_at > NOW() - make_interval(secs => $2)
+			)
+		FROM (SELECT DISTINCT unnest($1::text[]) AS username) u
+		LEFT JOIN user_presence p ON p.username = u.username
+		ORDER BY u.username
+	`
+	rows, err := d.db.Query(query, pq.Array(usernames), PresenceStaleAfter.Seconds())
+	if err != nil {
+		log.Printf("Error querying presence: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p Presence
+		var lastActive sql.NullTime
+		var connected bool
+		if err := rows.Scan(&p.Username, &p.Status, &lastActive, &connected); err != nil {
+			log.Printf("Error scanning presence row: %v", err)
+			return nil, err
+		}
+		p.LastActiveAt = lastActive.Time
+		switch {
+		case !connected:
+			p.Status = PresenceOffline
+		case p.Status == PresenceOffline:
+			// Connected, but the status write has not landed yet
+			p.Status = PresenceOnline
+		case p.Status == PresenceOnline && time.Since(p.LastActiveAt) > awayAfter:
+			p.Status = PresenceAway
+		}
+		presence = append(presence, p)
+	}
+	return presence, rows.Err()
+}
@@ -0,0 +1,128 @@
+package db
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+)
+
+// maxEmojiLength bounds reactions so they stay a single emoji or short :shortcode:
+const maxEmojiLength = 64
+
+// ErrInvalidReaction is returned for empty or oversized reactions
+var ErrInvalidReaction = errors.New("invalid reaction")
+
+// AddReaction records that username reacted to a message with emoji and
+// returns the message's updated reaction counts. Reacting twice is a no-op.
+func (d *Database) AddReaction(messageId int, username, emoji string) ([]Reaction, error) {
+	if err := validateEmoji(emoji); err != nil {
+		return nil, err
+	}
+
+	query := `
+		INSERT INTO message_reactions (message_id, username, emoji)
+		SELECT id, $2, $3 FROM messages WHERE id = $1 AND deleted_at IS NULL
+		ON CONFLICT DO NOTHING
+	`
+	if _, err := d.db.Exec(query, messageId, username, emoji); err != nil {
+		log.Printf("Error adding reaction %s to message %d: %v", emoji, messageId, err)
+		return nil, err
+	}
+
+	return d.GetReactions(messageId)
+}
+
+// RemoveReaction removes username's emoji reaction from a message and returns
+// the message's updated reaction counts
+func (d *Database) RemoveReaction(messageId int, username, emoji string) ([]Reaction, error) {
+	query := `DELETE FROM message_reactions WHERE message_id = $1 AND username = $2 AND emoji = $3`
+	if _, err := d.db.Exec(query, messageId, username, emoji); err != nil {
+		log.Printf("Error removing reaction %s from message %d: %v", emoji, messageId, err)
+		return nil, err
+	}
+
+	return d.GetReactions(messageId)
+}
+
+// GetReactions returns the aggregated reactions of a single message
+func (d *Database) GetReactions(messageId int) ([]Reaction, error) {
+	byMessage, err := d.reactionsFor([]int{messageId})
+	if err != nil {
+		return nil, err
+	}
+	if reactions, ok := byMessage[messageId]; ok {
+		return reactions, nil
+	}
+	return []Reaction{}, nil
+}
+
+// attachReactions fills in the reaction counts of every message with a single query
+func (d *Database) attachReactions(messages []Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	ids := make([]int, len(messages))
+	for i, m := range messages {
+		ids[i] = m.ID
+	}
+
+	byMessage, err := d.reactionsFor(ids)
+	if err != nil {
+		return err
+	}
+
+	for i := range messages {
+		messages[i].Reactions = byMessage[messages[i].ID]
+	}
+	return nil
+}
+
+// reactionsFor aggregates reactions per message, ordering emojis by when they were first used
+func (d *Database) reactionsFor(messageIds []int) (map[int][]Reaction, error) {
+	query := `
+		SELECT message_id, emoji, COUNT(*), array_agg(username ORDER BY created_at)
+		FROM message_reactions
+		WHERE message_id = ANY($1)
+		GROUP BY message_id, emoji
+		ORDER BY message_id, MIN(created_at)
+	`
+
+	ids := make(pq.Int64Array, len(messageIds))
+	for i, id := range messageIds {
+		ids[i] = int64(id)
+	}
+
+	rows, err := d.db.Query(query, ids)
+	if err != nil {
+		log.Printf("Error querying reactions: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	byMessage := make(map[int][]Reaction)
+	for rows.Next() {
+		var messageId int
+		var reaction Reaction
+		if err := rows.Scan(&messageId, &reaction.Emoji, &reaction.Count, pq.Array(&reaction.Users)); err != nil {
+			log.Printf("Error scanning reaction row: %v", err)
+			return nil, err
+		}
+		byMessage[messageId] = append(byMessage[messageId], reaction)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return byMessage, nil
+}
+
+func validateEmoji(emoji string) error {
+	if emoji == "" || len(emoji) > maxEmojiLength || !utf8.ValidString(emoji) || strings.ContainsAny(emoji, " \t\r\n") {
+		return ErrInvalidReaction
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package db
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultSearchLimit is used when a search does not set a limit
+	DefaultSearchLimit = 20
+	// MaxSearchLimit caps how many results a single search may return
+	MaxSearchLimit = 100
+)
+
+// SearchQuery selects messages by full-text search. Query uses web search
+// syntax: words are ANDed, "quoted text" matches a phrase, OR matches either
+// side and -word excludes a word. The other fields narrow the results and
+// are ignored when empty.
+type SearchQuery struct {
+	Query   string
+	Channel string
+	Author  string
+	From    *time.Time
+	To      *time.Time
+	Limit   int
+	Offset  int
+}
+
+// SearchResult is a message matching a search. Snippet is HTML: the
+// message text is escaped and matched words are wrapped in <mark>.
+type SearchResult struct {
+	Message Message `json:"message"`
+	Snippet string  `json:"snippet"`
+	Rank    float64 `json:"rank"`
+}
+
+// SearchPage is one page of search results, best matches first
+type SearchPage struct {
+	Results []SearchResult `json:"results"`
+	HasMore bool           `json:"hasMore"`
+}
+
+// Matches in a headline are delimited by private-use characters, which are
+// stripped from the content first so a message cannot forge them. Escaping
+// happens afterwards in Go, since escaping before ts_headline lets the
+// parser split entities like &amp; into words and match inside them.
+const (
+	markStart = "\uE000"
+	markStop  = "\uE001"
+)
+
+const searchHeadline = `ts_headline('english', translate(m.content, '` + markStart + markStop + `', ''), q,
+	'StartSel="` + markStart + `", StopSel="` + markStop + `", MaxWords=30, MinWords=10, MaxFragments=2')`
+
+var markReplacer = strings.NewReplacer(markStart, "<mark>", markStop, "</mark>")
+
+// highlightSnippet turns a raw headline into HTML: everything is escaped
+// and only the matches are wrapped in <mark>
+func highlightSnippet(headline string) string {
+	return markReplacer.Replace(html.EscapeString(headline))
+}
+
+// SearchMessages runs a full-text search over the channels the user can
+// read: public channels and the private channels and direct messages they
+// belong to. Deleted messages are never returned.
+func (d *Database) SearchMessages(username string, search SearchQuery) (*SearchPage, error) {
+	if search.Limit <= 0 {
+		search.Limit = DefaultSearchLimit
+	} else if search.Limit > MaxSearchLimit {
+		search.Limit = MaxSearchLimit
+	}
+	if search.Offset < 0 {
+		search.Offset = 0
+	}
+
+	args := []interface{}{username, search.Query}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	filters := []string{
+		"m.search_vector @@ q",
+		"m.deleted_at IS NULL",
+		"(NOT c.is_private OR EXISTS (SELECT 1 FROM channel_members cm WHERE cm.channel_id = c.id AND cm.username = $1))",
+	}
+	if search.Channel != "" {
+		filters = append(filters, "c.name = "+arg(search.Channel))
+	}
+	if search.Author != "" {
+		filters = append(filters, "m.username = "+arg(search.Author))
+	}
+	if search.From != nil {
+		filters = append(filters, "m.created_at >= "+arg(*search.From))
+	}
+	if search.To != nil {
+		filters = append(filters, "m.created_at < "+arg(*search.To))
+	}
+
+	query := `
+		SELECT ` + messageColumns + `, c.name, ` + searchHeadline + `, ts_rank(m.search_vector, q) AS rank
+		FROM messages m
+		JOIN channels c ON c.id = m.channel_id
+		CROSS JOIN websearch_to_tsquery('english', $2) q
+		WHERE ` + strings.Join(filters, " AND ") + `
+		ORDER BY rank DESC, m.id DESC
+		LIMIT ` + arg(search.Limit+1) + ` OFFSET ` + arg(search.Offset)
+
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		log.Printf("Error searching messages for %s: %v", username, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	page := &SearchPage{Results: []SearchResult{}}
+	for rows.Next() {
+		var r SearchResult
+		if err := scanMessage(rows, &r.Message, &r.Message.RoomID, &r.Snippet, &r.Rank); err != nil {
+			return nil, err
+		}
+		r.Snippet = highlightSnippet(r.Snippet)
+		page.Results = append(page.Results, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(page.Results) > search.Limit {
+		page.Results = page.Results[:search.Limit]
+		page.HasMore = true
+	}
+	return page, nil
+}
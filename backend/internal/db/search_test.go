@@ -0,0 +1,56 @@
+package db
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHighlightSnippet(t *testing.T) {
+	tests := []struct {
+		headline, want string
+	}{
+		{"plain text", "plain text"},
+		{"a " + markStart + "match" + markStop + " here", "a <mark>match</mark> here"},
+		{"<script>alert(1)</script> " + markStart + "x" + markStop, "&lt;script&gt;alert(1)&lt;/script&gt; <mark>x</mark>"},
+		{"already &amp; escaped", "already &amp;amp; escaped"},
+		{"<mark>fake</mark>", "&lt;mark&gt;fake&lt;/mark&gt;"},
+		{`"quoted" & 'single'`, "&#34;quoted&#34; &amp; &#39;single&#39;"},
+	}
+	for _, tt := range tests {
+		if got := highlightSnippet(tt.headline); got != tt.want {
+			t.Errorf("highlightSnippet(%q) = %q, want %q", tt.headline, got, tt.want)
+		}
+	}
+}
+
+func TestSearchSnippetsEscapeContent(t *testing.T) {
+	database := testDatabase(t)
+	name, channelId := testChannel(t, database)
+
+	content := `<b>amp</b> & <mark>forged</mark> ` + markStart + `sentinel` + markStop + ` amp`
+	if _, err := database.db.Exec(`INSERT INTO messages (content, username, channel_id) VALUES ($1, 'alice', $2)`,
+		content, channelId); err != nil {
+		t.Fatal(err)
+	}
+
+	page, err := database.SearchMessages("alice", SearchQuery{Query: "amp", Channel: name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Results) != 1 {
+		t.Fatalf("got %d results, want 1", len(page.Results))
+	}
+	snippet := page.Results[0].Snippet
+	if !strings.Contains(snippet, "<mark>amp</mark>") {
+		t.Errorf("snippet %q does not mark the match", snippet)
+	}
+	if strings.Contains(snippet, "<b>") || strings.Contains(snippet, "<mark>forged") {
+		t.Errorf("snippet %q lets markup from the message through", snippet)
+	}
+	if strings.ContainsAny(snippet, markStart+markStop) {
+		t.Errorf("snippet %q contains a sentinel", snippet)
+	}
+	if strings.Count(snippet, "<mark>") != strings.Count(snippet, "</mark>") {
+		t.Errorf("snippet %q has unbalanced marks", snippet)
+	}
+}
@@ -1,6 +1,10 @@
 package user
 
-import "context"
+import (
+	"context"
+
+	"github.com/goyalg325/whiz/backend/internal/auth"
+)
 
 type User struct {
 	ID       int64  `json:"id"`
@@ -27,9 +31,9 @@ type LoginUserReq struct {
 }
 
 type LoginUserRes struct {
-	accessToken string
-	ID          string `json:"id"`
-	Username    string `json:"username"`
+	tokens   *auth.TokenPair
+	ID       string `json:"id"`
+	Username string `json:"username"`
 }
 
 type Repository interface {
@@ -40,4 +44,7 @@ type Repository interface {
 type Service interface {
 	CreateUser(c context.Context, req *CreateUserReq) (*CreateUserRes, error)
 	Login(c context.Context, req *LoginUserReq) (*LoginUserRes, error)
+	Refresh(c context.Context, refreshToken string) (*auth.TokenPair, error)
+	Logout(c context.Context, refreshToken string) error
+	LogoutAll(c context.Context, userID string) error
 }
\ No newline at end of file
@@ -1,9 +1,12 @@
 package user
 
 import (
+	"log"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/goyalg325/whiz/backend/internal/auth"
 )
 
 type Handler struct {
@@ -46,7 +49,7 @@ func (h *Handler) Login(c *gin.Context) {
 		return
 	}
 
-	c.SetCookie("jwt", u.accessToken, 3600, "/", "localhost", false, true)
+	setTokenCookies(c, u.tokens)
 
 	res := &LoginUserRes{
 		Username: u.Username,
@@ -55,7 +58,56 @@ func (h *Handler) Login(c *gin.Context) {
 	c.JSON(http.StatusOK, res)
 }
 
+// Refresh rotates the refresh token cookie and issues a new access token
+func (h *Handler) Refresh(c *gin.Context) {
+	refreshToken, _ := c.Cookie(auth.RefreshCookieName)
+
+	tokens, err := h.Service.Refresh(c.Request.Context(), refreshToken)
+	if err != nil {
+		log.Printf("Token refresh failed: %v", err)
+		clearTokenCookies(c)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired refresh token"})
+		return
+	}
+
+	setTokenCookies(c, tokens)
+	c.JSON(http.StatusOK, gin.H{"expiresAt": tokens.AccessExpiresAt})
+}
+
 func (h *Handler) Logout(c *gin.Context) {
-	c.SetCookie("jwt", "", -1, "", "", false, true)
+	if refreshToken, err := c.Cookie(auth.RefreshCookieName); err == nil && refreshToken != "" {
+		if err := h.Service.Logout(c.Request.Context(), refreshToken); err != nil {
+			log.Printf("Error revoking session on logout: %v", err)
+		}
+	}
+
+	clearTokenCookies(c)
 	c.JSON(http.StatusOK, gin.H{"message": "logout successful"})
+}
+
+// LogoutAll revokes every session of the authenticated user
+func (h *Handler) LogoutAll(c *gin.Context) {
+	claims, ok := auth.GetClaims(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	if err := h.Service.LogoutAll(c.Request.Context(), claims.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	clearTokenCookies(c)
+	c.JSON(http.StatusOK, gin.H{"message": "logged out of all devices"})
+}
+
+func setTokenCookies(c *gin.Context, tokens *auth.TokenPair) {
+	c.SetCookie(auth.CookieName, tokens.AccessToken, int(time.Until(tokens.AccessExpiresAt).Seconds()), "/", "localhost", false, true)
+	c.SetCookie(auth.RefreshCookieName, tokens.RefreshToken, int(time.Until(tokens.RefreshExpiresAt).Seconds()), "/", "localhost", false, true)
+}
+
+func clearTokenCookies(c *gin.Context) {
+	c.SetCookie(auth.CookieName, "", -1, "/", "localhost", false, true)
+	c.SetCookie(auth.RefreshCookieName, "", -1, "/", "localhost", false, true)
 }
\ No newline at end of file
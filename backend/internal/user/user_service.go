@@ -6,21 +6,19 @@ import (
 	"strconv"
 	"time"
 
-	"github.com/golang-jwt/jwt/v4"
-)
-
-const (
-	secretKey = "secret"
+	"github.com/goyalg325/whiz/backend/internal/auth"
 )
 
 type service struct {
 	Repository
-	timeout time.Duration
+	sessions *auth.Sessions
+	timeout  time.Duration
 }
 
-func NewService(repository Repository) Service {
+func NewService(repository Repository, sessions *auth.Sessions) Service {
 	return &service{
 		repository,
+		sessions,
 		time.Duration(2) * time.Second,
 	}
 }
@@ -54,12 +52,6 @@ func (s *service) CreateUser(c context.Context, req *CreateUserReq) (*CreateUser
 	return res, nil
 }
 
-type MyJWTClaims struct {
-	ID       string `json:"id"`
-	Username string `json:"username"`
-	jwt.RegisteredClaims
-}
-
 func (s *service) Login(c context.Context, req *LoginUserReq) (*LoginUserRes, error) {
 	ctx, cancel := context.WithTimeout(c, s.timeout)
 	defer cancel()
@@ -74,19 +66,35 @@ func (s *service) Login(c context.Context, req *LoginUserReq) (*LoginUserRes, er
 		return &LoginUserRes{}, err
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, MyJWTClaims{
-		ID:       strconv.Itoa(int(u.ID)),
-		Username: u.Username,
-		RegisteredClaims: jwt.RegisteredClaims{
-			Issuer:    strconv.Itoa(int(u.ID)),
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
-		},
-	})
-
-	ss, err := token.SignedString([]byte(secretKey))
+	tokens, err := s.sessions.Start(ctx, u.ID, u.Username)
 	if err != nil {
 		return &LoginUserRes{}, err
 	}
 
-	return &LoginUserRes{accessToken: ss, Username: u.Username, ID: strconv.Itoa(int(u.ID))}, nil
-}
\ No newline at end of file
+	return &LoginUserRes{tokens: tokens, Username: u.Username, ID: strconv.Itoa(int(u.ID))}, nil
+}
+
+func (s *service) Refresh(c context.Context, refreshToken string) (*auth.TokenPair, error) {
+	ctx, cancel := context.WithTimeout(c, s.timeout)
+	defer cancel()
+
+	return s.sessions.Refresh(ctx, refreshToken)
+}
+
+func (s *service) Logout(c context.Context, refreshToken string) error {
+	ctx, cancel := context.WithTimeout(c, s.timeout)
+	defer cancel()
+
+	return s.sessions.RevokeRefreshToken(ctx, refreshToken)
+}
+
+func (s *service) LogoutAll(c context.Context, userID string) error {
+	ctx, cancel := context.WithTimeout(c, s.timeout)
+	defer cancel()
+
+	id, err := strconv.ParseInt(userID, 10, 64)
+	if err != nil {
+		return err
+	}
+	return s.sessions.RevokeAll(ctx, id)
+}
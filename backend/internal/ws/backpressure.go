@@ -0,0 +1,181 @@
+package ws
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/gorilla/websocket"
+	"github.com/goyalg325/whiz/backend/internal/db"
+)
+
+// SlowClientPolicy decides what happens when a client's send queue is full
+type SlowClientPolicy string
+
+const (
+	// PolicyDropOldest discards the oldest queued message to make room
+	PolicyDropOldest SlowClientPolicy = "drop_oldest"
+	// PolicyDisconnect evicts the client; it can reconnect and reload history
+	PolicyDisconnect SlowClientPolicy = "disconnect"
+	// PolicyCoalesce collapses queued events that a newer one supersedes
+	// (typing, presence, reactions) and evicts the client if that frees nothing
+	PolicyCoalesce SlowClientPolicy = "coalesce"
+)
+
+const defaultQueueSize = 64
+
+// Hub metrics, published at /debug/vars on the DEBUG_ADDR listener
+var (
+	metricDelivered = expvar.NewInt("ws_messages_delivered")
+	metricDropped   = expvar.NewInt("ws_messages_dropped")
+	metricCoalesced = expvar.NewInt("ws_messages_coalesced")
+	metricEvicted   = expvar.NewInt("ws_clients_evicted")
+)
+
+// HubConfig controls per-client queueing
+type HubConfig struct {
+	QueueSize int
+	Policy    SlowClientPolicy
+}
+
+// HubConfigFromEnv reads WS_QUEUE_SIZE and WS_SLOW_CLIENT_POLICY
+func HubConfigFromEnv() (HubConfig, error) {
+	cfg := HubConfig{QueueSize: defaultQueueSize, Policy: PolicyDisconnect}
+
+	if v := os.Getenv("WS_QUEUE_SIZE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return cfg, fmt.Errorf("invalid WS_QUEUE_SIZE %q", v)
+		}
+		cfg.QueueSize = n
+	}
+
+	if v := os.Getenv("WS_SLOW_CLIENT_POLICY"); v != "" {
+		switch p := SlowClientPolicy(v); p {
+		case PolicyDropOldest, PolicyDisconnect, PolicyCoalesce:
+			cfg.Policy = p
+		default:
+			return cfg, fmt.Errorf("invalid WS_SLOW_CLIENT_POLICY %q, expected drop_oldest, disconnect or coalesce", v)
+		}
+	}
+
+	return cfg, nil
+}
+
+// maxHeldMessages is how many messages may pile up for a connection that is
+// still replaying before it is evicted as too far behind
+const maxHeldMessages = db.MaxReplayEvents
+
+// enqueue hands a message to a client without ever blocking the hub.
+// It must only be called from the hub goroutine.
+func (h *Hub) enqueue(cl *Client, m *Message) {
+	if held, ok := h.held[cl]; ok {
+		if len(held) >= maxHeldMessages {
+			h.evict(cl)
+			return
+		}
+		h.held[cl] = append(held, m)
+		metricDelivered.Add(1)
+		return
+	}
+
+	select {
+	case cl.Message <- m:
+		metricDelivered.Add(1)
+		return
+	default:
+	}
+
+	switch h.config.Policy {
+	case PolicyDropOldest:
+		// The writer may drain the queue concurrently, so either receive may find it empty
+		select {
+		case <-cl.Message:
+			metricDropped.Add(1)
+		default:
+		}
+		select {
+		case cl.Message <- m:
+			metricDelivered.Add(1)
+		default:
+			metricDropped.Add(1)
+		}
+
+	case PolicyCoalesce:
+		if h.coalesce(cl, m) {
+			return
+		}
+		h.evict(cl)
+
+	default:
+		h.evict(cl)
+	}
+}
+
+// coalesce rebuilds the client's queue without events superseded by later
+// ones and reports whether m fit afterwards
+func (h *Hub) coalesce(cl *Client, m *Message) bool {
+	var queued []*Message
+	for len(queued) < cap(cl.Message) {
+		select {
+		case q := <-cl.Message:
+			queued = append(queued, q)
+			continue
+		default:
+		}
+		break
+	}
+	queued = append(queued, m)
+
+	// Walk backwards so the newest event for each key survives
+	seen := make(map[string]bool)
+	kept := make([]*Message, 0, len(queued))
+	for i := len(queued) - 1; i >= 0; i-- {
+		if key := coalesceKey(queued[i]); key != "" {
+			if seen[key] {
+				metricCoalesced.Add(1)
+				continue
+			}
+			seen[key] = true
+		}
+		kept = append(kept, queued[i])
+	}
+
+	if len(kept) > cap(cl.Message) {
+		return false
+	}
+	for i := len(kept) - 1; i >= 0; i-- {
+		cl.Message <- kept[i]
+	}
+	metricDelivered.Add(1)
+	return true
+}
+
+// coalesceKey identifies events where only the latest one matters; chat
+// messages, edits and deletes are never coalesced
+func coalesceKey(m *Message) string {
+	switch m.Type {
+	case MessageTypeTypingStart, MessageTypeTypingStop:
+		return "typing:" + m.RoomID + ":" + m.Username
+	case MessageTypePresence:
+		return "presence:" + m.Username
+	case MessageTypeReactions:
+		return "reactions:" + strconv.Itoa(m.ID)
+	}
+	return ""
+}
+
+// evict disconnects a client that cannot keep up. Closing its queue makes
+// the writer close the connection, which in turn ends the reader.
+func (h *Hub) evict(cl *Client) {
+	if _, ok := h.conns[cl]; !ok {
+		return
+	}
+
+	log.Printf("Evicting slow client %s (%s)", cl.ID, cl.Username)
+	cl.closeCode = websocket.CloseTryAgainLater
+	h.remove(cl)
+	metricEvicted.Add(1)
+}
@@ -0,0 +1,91 @@
+package ws
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+)
+
+// Event is what the Hub sends through the Broker. AllRooms events are
+// delivered to every connected client, others only to Message.RoomID.
+type Event struct {
+	Message  *Message `json:"message"`
+	AllRooms bool     `json:"allRooms,omitempty"`
+}
+
+// Broker carries hub events between server instances. Every event published
+// by any instance is delivered to every subscriber, including the publisher.
+type Broker interface {
+	Publish(ctx context.Context, e *Event) error
+	// Subscribe returns a channel of events that is closed when ctx is done
+	Subscribe(ctx context.Context) (<-chan *Event, error)
+	Close() error
+}
+
+// subscriberBuffer is how many events a subscriber may fall behind before publishing blocks
+const subscriberBuffer = 256
+
+// NewBrokerFromEnv picks the broker named by HUB_BROKER: "memory" (the
+// default, for a single instance) or "postgres" to fan out across instances
+// with LISTEN/NOTIFY
+func NewBrokerFromEnv(database *sql.DB, dsn string) (Broker, error) {
+	switch kind := os.Getenv("HUB_BROKER"); kind {
+	case "", "memory":
+		log.Printf("Using in-memory hub broker")
+		return NewMemoryBroker(), nil
+	case "postgres":
+		log.Printf("Using Postgres LISTEN/NOTIFY hub broker")
+		return NewPostgresBroker(database, dsn), nil
+	default:
+		return nil, fmt.Errorf("unknown HUB_BROKER %q, expected memory or postgres", kind)
+	}
+}
+
+// MemoryBroker delivers events within a single process
+type MemoryBroker struct {
+	mu   sync.RWMutex
+	subs map[chan *Event]struct{}
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{subs: make(map[chan *Event]struct{})}
+}
+
+func (b *MemoryBroker) Publish(ctx context.Context, e *Event) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for sub := range b.subs {
+		select {
+		case sub <- e:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (b *MemoryBroker) Subscribe(ctx context.Context) (<-chan *Event, error) {
+	sub := make(chan *Event, subscriberBuffer)
+
+	b.mu.Lock()
+	b.subs[sub] = struct{}{}
+	b.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		b.mu.Lock()
+		delete(b.subs, sub)
+		close(sub)
+		b.mu.Unlock()
+	}()
+
+	return sub, nil
+}
+
+func (b *MemoryBroker) Close() error {
+	return nil
+}
@@ -0,0 +1,154 @@
+package ws
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// notifyChannel is the Postgres channel every instance listens on
+	notifyChannel = "whiz_hub"
+	// maxNotifyPayload stays under Postgres' 8000 byte NOTIFY payload limit
+	maxNotifyPayload = 7900
+	// storedEventTTL is how long an event stored in hub_events is kept for
+	// subscribers to load
+	storedEventTTL = 5 * time.Minute
+)
+
+// notification is a NOTIFY payload: either the event itself or, for events
+// larger than maxNotifyPayload, the id of the hub_events row holding it
+type notification struct {
+	Event
+	Ref int64 `json:"ref,omitempty"`
+}
+
+// PostgresBroker fans hub events out to every instance connected to the same
+// database using LISTEN/NOTIFY
+type PostgresBroker struct {
+	db       *sql.DB
+	listener *pq.Listener
+}
+
+func NewPostgresBroker(database *sql.DB, dsn string) *PostgresBroker {
+	listener := pq.NewListener(dsn, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		switch ev {
+		case pq.ListenerEventConnectionAttemptFailed, pq.ListenerEventDisconnected:
+			log.Printf("Hub broker listener connection problem: %v", err)
+		case pq.ListenerEventReconnected:
+			log.Printf("Hub broker listener reconnected, events sent while disconnected were missed")
+		}
+	})
+
+	return &PostgresBroker{db: database, listener: listener}
+}
+
+func (b *PostgresBroker) Publish(ctx context.Context, e *Event) error {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if len(payload) > maxNotifyPayload {
+		if payload, err = b.store(ctx, payload); err != nil {
+			return err
+		}
+	}
+
+	_, err = b.db.ExecContext(ctx, "SELECT pg_notify($1, $2)", notifyChannel, string(payload))
+	return err
+}
+
+// store saves a large event in hub_events and returns the notification
+// referring to it. Events older than storedEventTTL are cleared out on the way.
+func (b *PostgresBroker) store(ctx context.Context, payload []byte) ([]byte, error) {
+	if _, err := b.db.ExecContext(ctx, `DELETE FROM hub_events WHERE created_at < NOW() - make_interval(secs => $1)`,
+		storedEventTTL.Seconds()); err != nil {
+		log.Printf("Error clearing old hub events: %v", err)
+	}
+
+	var id int64
+	if err := b.db.QueryRowContext(ctx, `INSERT INTO hub_events (payload) VALUES ($1) RETURNING id`,
+		payload).Scan(&id); err != nil {
+		return nil, fmt.Errorf("storing event of %d bytes: %w", len(payload), err)
+	}
+	return json.Marshal(notification{Ref: id})
+}
+
+// load reads a notification, fetching the event from hub_events if it only carries a reference
+func (b *PostgresBroker) load(ctx context.Context, payload string) (*Event, error) {
+	var n notification
+	if err := json.Unmarshal([]byte(payload), &n); err != nil {
+		return nil, err
+	}
+	if n.Ref != 0 {
+		var stored []byte
+		if err := b.db.QueryRowContext(ctx, `SELECT payload FROM hub_events WHERE id = $1`, n.Ref).Scan(&stored); err != nil {
+			return nil, fmt.Errorf("loading event %d: %w", n.Ref, err)
+		}
+		n.Event = Event{}
+		if err := json.Unmarshal(stored, &n.Event); err != nil {
+			return nil, err
+		}
+	}
+	if n.Message == nil {
+		return nil, errors.New("event has no message")
+	}
+	return &n.Event, nil
+}
+
+func (b *PostgresBroker) Subscribe(ctx context.Context) (<-chan *Event, error) {
+	if err := b.listener.Listen(notifyChannel); err != nil {
+		return nil, err
+	}
+
+	events := make(chan *Event, subscriberBuffer)
+	go func() {
+		defer close(events)
+
+		// Ping regularly so a silently dropped connection is noticed and re-established
+		ping := time.NewTicker(90 * time.Second)
+		defer ping.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case n := <-b.listener.Notify:
+				// A nil notification means the listener reconnected
+				if n == nil {
+					continue
+				}
+
+				e, err := b.load(ctx, n.Extra)
+				if err != nil {
+					log.Printf("Ignoring unreadable hub event: %v", err)
+					continue
+				}
+
+				select {
+				case events <- e:
+				case <-ctx.Done():
+					return
+				}
+
+			case <-ping.C:
+				if err := b.listener.Ping(); err != nil {
+					log.Printf("Hub broker listener ping failed: %v", err)
+				}
+			}
+		}
+	}()
+
+	return events, nil
+}
+
+func (b *PostgresBroker) Close() error {
+	return b.listener.Close()
+}
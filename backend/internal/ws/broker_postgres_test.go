@@ -0,0 +1,87 @@
+package ws
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goyalg325/whiz/backend/internal/db"
+)
+
+// postgresBrokers connects two brokers, as two instances would, to the
+// database named by WHIZ_TEST_DB_URL. The test is skipped without it.
+func postgresBrokers(t *testing.T) (*PostgresBroker, *PostgresBroker) {
+	dsn := os.Getenv("WHIZ_TEST_DB_URL")
+	if dsn == "" {
+		t.Skip("set WHIZ_TEST_DB_URL to run against a local Postgres")
+	}
+	t.Setenv("DB_URL", dsn)
+
+	database, err := db.NewDatabase()
+	if err != nil {
+		t.Fatalf("connecting: %v", err)
+	}
+	t.Cleanup(database.Close)
+	if err := database.MigrateUp(context.Background()); err != nil {
+		t.Fatalf("migrating: %v", err)
+	}
+
+	a := NewPostgresBroker(database.GetDB(), dsn)
+	b := NewPostgresBroker(database.GetDB(), dsn)
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	return a, b
+}
+
+func receive(t *testing.T, events <-chan *Event) *Event {
+	t.Helper()
+	select {
+	case e := <-events:
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for an event")
+		return nil
+	}
+}
+
+func TestPostgresBrokerFansOutAcrossInstances(t *testing.T) {
+	a, b := postgresBrokers(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fromA, err := a.Subscribe(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromB, err := b.Subscribe(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Well past the NOTIFY limit, as a message at WS_MAX_MESSAGE_SIZE would be
+	large := strings.Repeat("x", 3*maxNotifyPayload)
+	sent := []*Event{
+		{Message: &Message{Type: MessageTypeChat, RoomID: "general", Username: "alice", Content: "hello"}},
+		{Message: &Message{Type: MessageTypeChat, RoomID: "general", Username: "alice", Content: large}},
+		{Message: &Message{Type: MessageTypePresence, Username: "bob", Status: "away"}, AllRooms: true},
+	}
+	for _, e := range sent {
+		if err := a.Publish(ctx, e); err != nil {
+			t.Fatalf("publishing %d bytes: %v", len(e.Message.Content), err)
+		}
+	}
+
+	for name, events := range map[string]<-chan *Event{"publisher": fromA, "other instance": fromB} {
+		for i, want := range sent {
+			got := receive(t, events)
+			if got.Message.Content != want.Message.Content || got.Message.Type != want.Message.Type || got.AllRooms != want.AllRooms {
+				t.Errorf("%s: event %d is a %d byte %s, want a %d byte %s",
+					name, i, len(got.Message.Content), got.Message.Type, len(want.Message.Content), want.Message.Type)
+			}
+		}
+	}
+}
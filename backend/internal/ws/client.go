@@ -1,129 +1,435 @@
 package ws
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"log"
+	"net"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/goyalg325/whiz/backend/internal/auth"
 	"github.com/goyalg325/whiz/backend/internal/db"
 )
 
 type Client struct {
-	Conn     *websocket.Conn
-	Message  chan *Message
-	ID       string `json:"id"`
+	Conn    *websocket.Conn
+	Message chan *Message
+	ID      string `json:"id"`
+	// RoomID is the room a single-room connection was opened for and the
+	// default for frames without a channel_id; empty on multiplexed connections
 	RoomID   string `json:"roomId"`
 	Username string `json:"username"`
+
+	limits ConnConfig
+	// sessionID is the login session the connection was opened with; it is
+	// re-checked on every ping so logging out closes the socket
+	sessionID string
+	sessions  auth.RevocationChecker
+	// closeCode is set by the hub before it closes Message to tell the writer why
+	closeCode int
+	// replayedThrough is the last sequence number replayed per room; queued copies up to it are skipped
+	replayedThrough map[string]int64
+	// frameID is the ID of the client frame being handled and frameFailed
+	// whether an error frame was sent for it; both are owned by the read loop
+	frameID     string
+	frameFailed bool
 }
 
+// Message types understood by readMessage and sent to clients; see
+// protocol.go for the envelope they travel in.
+const (
+	MessageTypeChat    = "message"
+	MessageTypeReply   = "reply"
+	MessageTypeEdit    = "edit"
+	MessageTypeDelete  = "delete"
+	MessageTypeReact   = "react"
+	MessageTypeUnreact = "unreact"
+	// MessageTypeReactions is sent to the room whenever a message's reactions change
+	MessageTypeReactions = "reactions"
+	// Typing events are relayed to the room but never saved
+	MessageTypeTypingStart = "typing_start"
+	MessageTypeTypingStop  = "typing_stop"
+	// MessageTypePresence is sent by a client to go away/online and to every client when a status changes
+	MessageTypePresence = "presence"
+	MessageTypeError    = "error"
+	// Subscriptions change which rooms a connection receives; the server
+	// confirms each with subscribed/unsubscribed
+	MessageTypeSubscribe    = "subscribe"
+	MessageTypeUnsubscribe  = "unsubscribe"
+	MessageTypeSubscribed   = "subscribed"
+	MessageTypeUnsubscribed = "unsubscribed"
+	// Membership changes are announced to the room; a removed member's
+	// connections stop receiving it
+	MessageTypeMemberJoined  = "member_joined"
+	MessageTypeMemberRemoved = "member_removed"
+	// Channel lifecycle events carry the channel's new state. A rename is
+	// sent to the old room name; afterwards the room goes by the new name
+	// and connections opened for the old one are closed. A deleted
+	// channel's room is closed the same way. Neither is replayed on resume.
+	MessageTypeChannelRenamed    = "channel_renamed"
+	MessageTypeChannelTopic      = "channel_topic"
+	MessageTypeChannelArchived   = "channel_archived"
+	MessageTypeChannelUnarchived = "channel_unarchived"
+	MessageTypeChannelDeleted    = "channel_deleted"
+)
+
 type Message struct {
+	Type      string `json:"type,omitempty"`
+	Seq       int64  `json:"seq,omitempty"`
+	ID        int    `json:"id,omitempty"`
+	ParentID  int    `json:"parentId,omitempty"`
 	Content   string `json:"content"`
 	RoomID    string `json:"roomId"`
 	Username  string `json:"username"`
 	Timestamp string `json:"timestamp,omitempty"`
+	EditedAt  string `json:"editedAt,omitempty"`
+	Deleted   bool   `json:"deleted,omitempty"`
 	IsSystem  bool   `json:"isSystem,omitempty"`
+	Status    string `json:"status,omitempty"`
+	// Code is set on error frames, see the ErrCode constants
+	Code string `json:"code,omitempty"`
+	// FrameID is the client frame this answers; it is only set on frames sent
+	// to one client and travels in the envelope rather than the payload
+	FrameID string `json:"-"`
+
+	Reactions []db.Reaction `json:"reactions,omitempty"`
+	// Channel is set on channel lifecycle events
+	Channel *db.Channel `json:"channel,omitempty"`
 }
 
-// IncomingMessage represents the structure of messages sent from the frontend
-type IncomingMessage struct {
-	Type      string      `json:"type"`
-	ChannelID string      `json:"channel_id"`
-	UserID    string      `json:"user_id"`
-	Username  string      `json:"username"`
-	Content   interface{} `json:"content"`
+// newMessageFromDB converts a stored message to the format sent over the socket
+func newMessageFromDB(msgType string, m *db.Message) *Message {
+	msg := &Message{
+		Type:      msgType,
+		ID:        m.ID,
+		Content:   m.Content,
+		RoomID:    m.RoomID,
+		Username:  m.Username,
+		Timestamp: m.Timestamp.Format(time.RFC3339),
+		Deleted:   m.Deleted,
+	}
+	if m.ParentID != nil {
+		msg.ParentID = *m.ParentID
+	}
+	if m.EditedAt != nil {
+		msg.EditedAt = m.EditedAt.Format(time.RFC3339)
+	}
+	return msg
 }
 
 func (c *Client) writeMessage() {
+	ticker := time.NewTicker(c.limits.PingPeriod)
 	defer func() {
+		ticker.Stop()
 		c.Conn.Close()
 	}()
 
 	for {
-		message, ok := <-c.Message
-		if !ok {
-			return
+		select {
+		case message, ok := <-c.Message:
+			if !ok {
+				// The hub dropped this client; say why before hanging up
+				code := c.closeCode
+				if code == 0 {
+					code = websocket.CloseNormalClosure
+				}
+				c.Conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, ""),
+					time.Now().Add(c.limits.WriteTimeout))
+				return
+			}
+
+			if err := c.write(message); err != nil {
+				log.Printf("Error writing to client %s: %v", c.ID, err)
+				return
+			}
+
+		case <-ticker.C:
+			if c.revoked() {
+				log.Printf("Session of client %s was revoked, closing the connection", c.ID)
+				c.Conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "session revoked"),
+					time.Now().Add(c.limits.WriteTimeout))
+				return
+			}
+			if err := c.Conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(c.limits.WriteTimeout)); err != nil {
+				log.Printf("Ping to client %s failed: %v", c.ID, err)
+				return
+			}
 		}
+	}
+}
 
-		c.Conn.WriteJSON(message)
+// revoked reports whether the connection's session has been logged out. A
+// failed lookup keeps the connection; the next ping checks again.
+func (c *Client) revoked() bool {
+	if c.sessions == nil {
+		return false
 	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.limits.WriteTimeout)
+	defer cancel()
+
+	revoked, err := c.sessions.IsRevoked(ctx, c.sessionID)
+	if err != nil {
+		log.Printf("Error checking session of client %s: %v", c.ID, err)
+		return false
+	}
+	return revoked
 }
 
-func (c *Client) readMessage(hub *Hub, database *db.Database) {
+func (c *Client) readMessage(hub *Hub, database db.Repository, presence *Presence, recent *recentFrames) {
 	defer func() {
 		hub.Unregister <- c
+		presence.Disconnect(c.ID, c.Username)
 		c.Conn.Close()
 	}()
 
+	// Any frame, including a pong, proves the connection is still alive
+	c.Conn.SetReadLimit(c.limits.MaxMessageSize)
+	c.Conn.SetReadDeadline(time.Now().Add(c.limits.IdleTimeout))
+	c.Conn.SetPongHandler(func(string) error {
+		return c.Conn.SetReadDeadline(time.Now().Add(c.limits.IdleTimeout))
+	})
+
 	for {
 		_, m, err := c.Conn.ReadMessage()
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("error: %v", err)
-			}
+			c.logReadError(err)
 			break
 		}
+		c.Conn.SetReadDeadline(time.Now().Add(c.limits.IdleTimeout))
 
-		// Try to parse as JSON first
-		var incomingMsg IncomingMessage
-		if err := json.Unmarshal(m, &incomingMsg); err == nil {
-			// Successfully parsed as JSON - extract content
-			var content string
-
-			// Handle different content types
-			if contentMap, ok := incomingMsg.Content.(map[string]interface{}); ok {
-				// If content is an object, extract the actual content field
-				if actualContent, exists := contentMap["content"]; exists {
-					content = actualContent.(string)
-				} else {
-					content = string(m) // fallback to raw message
-				}
-			} else if contentStr, ok := incomingMsg.Content.(string); ok {
-				// If content is already a string
-				content = contentStr
-			} else {
-				// Fallback to raw message
-				content = string(m)
-			}
+		env, in, perr := decodeFrame(m)
+		c.frameID = ""
+		if env != nil {
+			c.frameID = env.ID
+		}
+		if perr != nil {
+			log.Printf("Rejected frame from client %s: %v", c.ID, perr)
+			c.sendError(hub, c.RoomID, perr)
+			continue
+		}
+		if env.ID != "" && !recent.claim(c.Username, env.ID) {
+			log.Printf("Rejecting duplicate frame %s from client %s", env.ID, c.ID)
+			c.sendError(hub, c.RoomID, protocolError(ErrCodeDuplicate, "frame %s was already received", env.ID))
+			continue
+		}
 
-			log.Printf("Parsed message - Type: %s, Content: %s, Username: %s, RoomID: %s",
-				incomingMsg.Type, content, c.Username, c.RoomID)
+		c.frameFailed = false
+		c.handleFrame(hub, database, presence, env.Type, in)
+		if env.ID != "" {
+			recent.finish(c.Username, env.ID, !c.frameFailed)
+		}
+	}
+}
 
-			// Debug logging to track roomId
-			log.Printf("DEBUG: About to save message with roomId='%s' (type %T) from client with RoomID='%s'",
-				c.RoomID, c.RoomID, c.RoomID)
+// handleFrame dispatches one decoded client frame
+func (c *Client) handleFrame(hub *Hub, database db.Repository, presence *Presence, msgType string, in *IncomingMessage) {
+	switch msgType {
+	case MessageTypeSubscribe:
+		c.subscribe(hub, database, in.ChannelID)
+		return
+	case MessageTypeUnsubscribe:
+		c.unsubscribe(hub, in.ChannelID)
+		return
+	case MessageTypePresence:
+		if err := presence.SetStatus(c.Username, in.Status); err != nil {
+			c.sendError(hub, c.RoomID, protocolError(ErrCodeInvalidPayload, "%v", err))
+		}
+		return
+	}
 
-			// Save the extracted content to the database
-			if err := database.SaveMessage(content, c.Username, c.RoomID); err != nil {
-				log.Printf("Error saving message to database: %v", err)
-			}
+	room, ok := c.frameRoom(hub, in.ChannelID)
+	if !ok {
+		return
+	}
 
-			msg := &Message{
-				Content:   content,
-				RoomID:    c.RoomID,
-				Username:  c.Username,
-				Timestamp: time.Now().Format(time.RFC3339),
-			}
+	if msgType == MessageTypeAck {
+		if err := database.AckRoomEvents(c.Username, room, in.Seq); err != nil {
+			c.sendError(hub, room, accessError(err))
+		}
+		return
+	}
 
-			hub.Broadcast <- msg
-		} else {
-			// Fallback to treating as plain text
-			content := string(m)
-			log.Printf("Treating as plain text: %s", content)
+	if msgType == MessageTypeTypingStart || msgType == MessageTypeTypingStop {
+		hub.Broadcast <- &Message{
+			Type:      msgType,
+			RoomID:    room,
+			Username:  c.Username,
+			Timestamp: time.Now().Format(time.RFC3339),
+		}
+		return
+	}
 
-			// Save the message to the database
-			if err := database.SaveMessage(content, c.Username, c.RoomID); err != nil {
-				log.Printf("Error saving message to database: %v", err)
-			}
+	// Everything else is user activity and changes the room's messages
+	presence.Touch(c.Username)
+	if !c.writable(hub, database, room) {
+		return
+	}
 
-			msg := &Message{
-				Content:   content,
-				RoomID:    c.RoomID,
-				Username:  c.Username,
-				Timestamp: time.Now().Format(time.RFC3339),
-			}
+	switch msgType {
+	case MessageTypeChat:
+		c.sendChatMessage(hub, database, room, in.Content)
+	case MessageTypeReply:
+		c.replyToMessage(hub, database, room, in)
+	case MessageTypeEdit:
+		c.editMessage(hub, database, room, in)
+	case MessageTypeDelete:
+		c.deleteMessage(hub, database, room, in)
+	case MessageTypeReact, MessageTypeUnreact:
+		c.reactToMessage(hub, database, room, msgType == MessageTypeReact, in)
+	}
+}
 
-			hub.Broadcast <- msg
-		}
+// writable sends an error frame and returns false if the room's messages
+// cannot be changed, e.g. because the channel was archived
+func (c *Client) writable(hub *Hub, database db.Repository, room string) bool {
+	channel, err := database.GetChannel(room)
+	if err != nil {
+		c.sendError(hub, room, accessError(err))
+		return false
+	}
+	if channel.ArchivedAt != nil {
+		c.sendError(hub, room, errorFrom(db.ErrChannelArchived))
+		return false
+	}
+	return true
+}
+
+// logReadError records why a connection's read loop ended, staying quiet for ordinary closes
+func (c *Client) logReadError(err error) {
+	var netErr net.Error
+	switch {
+	case websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived):
+		return
+	case errors.Is(err, websocket.ErrReadLimit):
+		log.Printf("Client %s sent a frame larger than %d bytes", c.ID, c.limits.MaxMessageSize)
+	case errors.As(err, &netErr) && netErr.Timeout():
+		log.Printf("Client %s timed out after %s without a frame", c.ID, c.limits.IdleTimeout)
+	case websocket.IsUnexpectedCloseError(err):
+		log.Printf("Client %s closed the connection: %v", c.ID, err)
+	default:
+		log.Printf("error: %v", err)
 	}
 }
+
+// sendChatMessage saves a new message and broadcasts it to the room. A
+// message that could not be saved is only reported back to the sender.
+func (c *Client) sendChatMessage(hub *Hub, database db.Repository, room, content string) {
+	saved, err := database.SaveMessage(content, c.Username, room)
+	if err != nil {
+		log.Printf("Error saving message to room %s: %v", room, err)
+		c.sendError(hub, room, errorFrom(err))
+		return
+	}
+
+	hub.Broadcast <- newMessageFromDB(MessageTypeChat, saved)
+}
+
+// replyToMessage saves a reply in a message's thread and broadcasts it to the room
+func (c *Client) replyToMessage(hub *Hub, database db.Repository, room string, in *IncomingMessage) {
+	parent, err := database.GetMessage(in.ParentID)
+	if err != nil || parent.Deleted || parent.RoomID != room {
+		c.sendError(hub, room, errorFrom(db.ErrMessageNotFound))
+		return
+	}
+
+	reply, err := database.SaveReply(in.Content, c.Username, parent.ID)
+	if err != nil {
+		log.Printf("Error saving reply to message %d: %v", parent.ID, err)
+		c.sendError(hub, room, errorFrom(err))
+		return
+	}
+
+	hub.Broadcast <- newMessageFromDB(MessageTypeReply, reply)
+}
+
+// editMessage updates one of the client's own messages and tells the room about it
+func (c *Client) editMessage(hub *Hub, database db.Repository, room string, in *IncomingMessage) {
+	if !c.ownsRoomMessage(hub, database, room, in.MessageID) {
+		return
+	}
+
+	edited, err := database.EditMessage(in.MessageID, c.Username, in.Content)
+	if err != nil {
+		log.Printf("Error editing message %d: %v", in.MessageID, err)
+		c.sendError(hub, room, errorFrom(err))
+		return
+	}
+
+	hub.Broadcast <- newMessageFromDB(MessageTypeEdit, edited)
+}
+
+// deleteMessage removes one of the client's own messages and tells the room about it
+func (c *Client) deleteMessage(hub *Hub, database db.Repository, room string, in *IncomingMessage) {
+	if !c.ownsRoomMessage(hub, database, room, in.MessageID) {
+		return
+	}
+
+	deleted, err := database.DeleteMessage(in.MessageID, c.Username)
+	if err != nil {
+		log.Printf("Error deleting message %d: %v", in.MessageID, err)
+		c.sendError(hub, room, errorFrom(err))
+		return
+	}
+
+	hub.Broadcast <- newMessageFromDB(MessageTypeDelete, deleted)
+}
+
+// reactToMessage adds or removes one of the client's reactions and broadcasts the new counts
+func (c *Client) reactToMessage(hub *Hub, database db.Repository, room string, add bool, in *IncomingMessage) {
+	target, err := database.GetMessage(in.MessageID)
+	if err != nil || target.Deleted || target.RoomID != room {
+		c.sendError(hub, room, errorFrom(db.ErrMessageNotFound))
+		return
+	}
+
+	var reactions []db.Reaction
+	if add {
+		reactions, err = database.AddReaction(target.ID, c.Username, in.Emoji)
+	} else {
+		reactions, err = database.RemoveReaction(target.ID, c.Username, in.Emoji)
+	}
+	if err != nil {
+		log.Printf("Error updating reactions on message %d: %v", target.ID, err)
+		c.sendError(hub, room, errorFrom(err))
+		return
+	}
+
+	hub.Broadcast <- &Message{
+		Type:      MessageTypeReactions,
+		ID:        target.ID,
+		RoomID:    target.RoomID,
+		Username:  c.Username,
+		Timestamp: time.Now().Format(time.RFC3339),
+		Reactions: reactions,
+	}
+}
+
+// ownsRoomMessage checks that a message exists in the room and was written by the client
+func (c *Client) ownsRoomMessage(hub *Hub, database db.Repository, room string, messageId int) bool {
+	original, err := database.GetMessage(messageId)
+	if err != nil || original.Deleted || original.RoomID != room {
+		c.sendError(hub, room, errorFrom(db.ErrMessageNotFound))
+		return false
+	}
+	if original.Username != c.Username {
+		c.sendError(hub, room, errorFrom(db.ErrNotMessageAuthor))
+		return false
+	}
+	return true
+}
+
+// sendError reports a problem with the current frame back to the client that sent it
+func (c *Client) sendError(hub *Hub, room string, perr *ProtocolError) {
+	c.frameFailed = true
+	hub.Send(c, &Message{
+		Type:      MessageTypeError,
+		Content:   perr.Reason,
+		Code:      perr.Code,
+		RoomID:    room,
+		Username:  c.Username,
+		Timestamp: time.Now().Format(time.RFC3339),
+		IsSystem:  true,
+		FrameID:   c.frameID,
+	})
+}
@@ -0,0 +1,498 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/goyalg325/whiz/backend/internal/auth"
+)
+
+// fakeSessions reports sessions as revoked once revoke is called
+type fakeSessions struct {
+	mu      sync.Mutex
+	revoked map[string]bool
+}
+
+func (s *fakeSessions) IsRevoked(ctx context.Context, sessionID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.revoked[sessionID], nil
+}
+
+func (s *fakeSessions) revoke(sessionID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.revoked[sessionID] = true
+}
+
+// testServer serves the socket endpoints behind the real auth middleware
+type testServer struct {
+	*httptest.Server
+	hub      *Hub
+	keys     *auth.KeySet
+	sessions *fakeSessions
+}
+
+func startServer(t *testing.T, config HubConfig, limits ConnConfig) *testServer {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	keys, err := auth.NewKeySet("test", auth.NewHMACKey("test", []byte("test-secret")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions := &fakeSessions{revoked: make(map[string]bool)}
+	hub := startHub(t, config)
+	h := NewHandler(hub, hub.db, limits, sessions)
+
+	r := gin.New()
+	authed := r.Group("/", auth.Middleware(keys, sessions))
+	authed.GET("/ws/joinRoom/:roomId", h.JoinRoom)
+	authed.GET("/ws/connect", h.Connect)
+	authed.GET("/ws/getMessages/:roomId", h.GetRoomMessages)
+
+	srv := &testServer{Server: httptest.NewServer(r), hub: hub, keys: keys, sessions: sessions}
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// limits returns short timeouts so liveness tests finish quickly
+func limits(idle time.Duration) ConnConfig {
+	return ConnConfig{
+		IdleTimeout:    idle,
+		PingPeriod:     idle * 9 / 10,
+		WriteTimeout:   5 * time.Second,
+		MaxMessageSize: defaultMaxMessageSize,
+	}
+}
+
+// token signs an access token for username, whose session ID is the username too
+func (s *testServer) token(t *testing.T, username string) string {
+	t.Helper()
+	token, err := s.keys.Sign(&auth.Claims{ID: username, Username: username, SessionID: username})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// get makes an authenticated HTTP request as username
+func (s *testServer) get(t *testing.T, username, path string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, s.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+s.token(t, username))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// dial opens a socket as username, whose session ID is the username too
+func (s *testServer) dial(t *testing.T, username, path string) *websocket.Conn {
+	t.Helper()
+	header := http.Header{"Authorization": []string{"Bearer " + s.token(t, username)}}
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http")+path, header)
+	if err != nil {
+		t.Fatalf("dial %s: %v", path, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	// The server hangs up right after its close frame, so echoing it back
+	// would fail and hide the close code
+	conn.SetCloseHandler(func(code int, text string) error {
+		return &websocket.CloseError{Code: code, Text: text}
+	})
+	return conn
+}
+
+// waitFor checks cond every few milliseconds until it holds, failing the
+// test if it does not within five seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	tick := time.NewTicker(5 * time.Millisecond)
+	defer tick.Stop()
+	timeout := time.After(5 * time.Second)
+	for !cond() {
+		select {
+		case <-tick.C:
+		case <-timeout:
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+// waitForClients waits until exactly n connections are in a room
+func (s *testServer) waitForClients(t *testing.T, room string, n int) {
+	t.Helper()
+	waitFor(t, fmt.Sprintf("%d clients in room %s", n, room), func() bool {
+		return len(s.hub.ListClients(room)) == n
+	})
+}
+
+// readFrame reads the next server frame and its Message payload
+func readFrame(conn *websocket.Conn) (*Envelope, *Message, error) {
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		return nil, nil, err
+	}
+	var env Envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, nil, err
+	}
+	var m Message
+	if err := json.Unmarshal(env.Payload, &m); err != nil {
+		return nil, nil, err
+	}
+	return &env, &m, nil
+}
+
+// readUntilClosed reads frames until the connection closes and returns the close error
+func readUntilClosed(t *testing.T, conn *websocket.Conn) error {
+	t.Helper()
+	for {
+		if _, _, err := readFrame(conn); err != nil {
+			var syntax *json.SyntaxError
+			if errors.As(err, &syntax) {
+				t.Fatalf("unreadable frame: %v", err)
+			}
+			return err
+		}
+	}
+}
+
+func closeCode(err error) int {
+	var ce *websocket.CloseError
+	if errors.As(err, &ce) {
+		return ce.Code
+	}
+	return 0
+}
+
+func TestConnClosesPeerThatStopsAnsweringPings(t *testing.T) {
+	config := limits(200 * time.Millisecond)
+	config.PingPeriod = 20 * time.Millisecond
+	srv := startServer(t, HubConfig{QueueSize: 8, Policy: PolicyDisconnect}, config)
+
+	// This peer reads, so it notices being dropped, but never answers a ping
+	dead := srv.dial(t, "dead", "/ws/joinRoom/general")
+	dead.SetPingHandler(func(string) error { return nil })
+	deadClosed := make(chan struct{})
+	go func() {
+		defer close(deadClosed)
+		for {
+			if _, _, err := dead.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	healthy := srv.dial(t, "healthy", "/ws/joinRoom/general")
+	pings := make(chan struct{}, 64)
+	healthy.SetPingHandler(func(data string) error {
+		select {
+		case pings <- struct{}{}:
+		default:
+		}
+		return healthy.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+	})
+	healthyClosed := make(chan struct{})
+	go func() {
+		defer close(healthyClosed)
+		for {
+			if _, _, err := healthy.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	// The dead peer's read deadline passes without a pong and it is dropped
+	select {
+	case <-deadClosed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("peer that never answers pings was not dropped")
+	}
+	srv.waitForClients(t, "general", 1)
+	if got := srv.hub.ListClients("general"); got[0].Username != "healthy" {
+		t.Errorf("remaining client = %s, want healthy", got[0].Username)
+	}
+
+	// A peer answering pings outlives several idle timeouts' worth of them
+	want := int(3 * config.IdleTimeout / config.PingPeriod)
+	for i := 0; i < want; i++ {
+		select {
+		case <-pings:
+		case <-healthyClosed:
+			t.Fatalf("healthy client was dropped after %d pings", i)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d of %d pings arrived", i, want)
+		}
+	}
+	if got := srv.hub.ListClients("general"); len(got) != 1 {
+		t.Errorf("healthy client was dropped, room has %+v", got)
+	}
+}
+
+func TestConnEnforcesMaxMessageSize(t *testing.T) {
+	config := limits(time.Minute)
+	config.MaxMessageSize = 512
+	srv := startServer(t, HubConfig{QueueSize: 8, Policy: PolicyDisconnect}, config)
+
+	conn := srv.dial(t, "alice", "/ws/joinRoom/general")
+	srv.waitForClients(t, "general", 1)
+
+	small := `{"type":"typing_start","version":1,"payload":{}}`
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(small)); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		_, m, err := readFrame(conn)
+		if err != nil {
+			t.Fatalf("connection closed after a frame within the limit: %v", err)
+		}
+		if m.Type == MessageTypeTypingStart {
+			break
+		}
+	}
+
+	large := `{"type":"message","version":1,"payload":{"content":"` + strings.Repeat("x", 1024) + `"}}`
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(large)); err != nil {
+		t.Fatal(err)
+	}
+	if code := closeCode(readUntilClosed(t, conn)); code != websocket.CloseMessageTooBig {
+		t.Errorf("close code = %d, want %d", code, websocket.CloseMessageTooBig)
+	}
+	srv.waitForClients(t, "general", 0)
+}
+
+// bigChat is a chat message large enough that a few of them fill the
+// socket buffers of a client that does not read
+func bigChat(room string, id int) *Message {
+	m := chat(room, strings.Repeat("x", 256*1024))
+	m.ID = id
+	return m
+}
+
+func TestConnEvictsSlowConsumerWithDisconnectPolicy(t *testing.T) {
+	// The evicted client's writer is stuck on a full socket until the client
+	// reads; a long write timeout keeps it from giving up first
+	config := limits(time.Minute)
+	config.WriteTimeout = time.Minute
+	srv := startServer(t, HubConfig{QueueSize: 4, Policy: PolicyDisconnect}, config)
+
+	slow := srv.dial(t, "slow", "/ws/joinRoom/general")
+	fast := srv.dial(t, "fast", "/ws/joinRoom/general")
+	srv.waitForClients(t, "general", 2)
+
+	received := make(chan int)
+	go func() {
+		defer close(received)
+		for {
+			_, m, err := readFrame(fast)
+			if err != nil {
+				return
+			}
+			if m.Type == MessageTypeChat {
+				received <- m.ID
+			}
+		}
+	}()
+
+	// Each message waits for the fast client, so only the slow one backs up
+	id := 0
+	send := func() {
+		id++
+		srv.hub.Broadcast <- bigChat("general", id)
+		if got := <-received; got != id {
+			t.Fatalf("client that kept up got message %d, want %d", got, id)
+		}
+	}
+	for len(srv.hub.ListClients("general")) == 2 {
+		if id == 200 {
+			t.Fatal("slow client was never evicted")
+		}
+		send()
+	}
+	send()
+	if clients := srv.hub.ListClients("general"); len(clients) != 1 || clients[0].Username != "fast" {
+		t.Errorf("room has %+v, want only the client that kept up", clients)
+	}
+
+	// Once the slow client reads again it learns why it was dropped
+	if code := closeCode(readUntilClosed(t, slow)); code != websocket.CloseTryAgainLater {
+		t.Errorf("close code = %d, want %d", code, websocket.CloseTryAgainLater)
+	}
+}
+
+func TestConnDropsOldestForSlowConsumerWithDropOldestPolicy(t *testing.T) {
+	srv := startServer(t, HubConfig{QueueSize: 4, Policy: PolicyDropOldest}, limits(time.Minute))
+
+	slow := srv.dial(t, "slow", "/ws/joinRoom/general")
+	srv.waitForClients(t, "general", 1)
+
+	const total = 100
+	for id := 1; id <= total; id++ {
+		srv.hub.Broadcast <- bigChat("general", id)
+	}
+	settle(srv.hub)
+
+	got, last := 0, 0
+	for last < total {
+		_, m, err := readFrame(slow)
+		if err != nil {
+			t.Fatalf("slow client was disconnected after %d messages: %v", got, err)
+		}
+		if m.Type != MessageTypeChat {
+			continue
+		}
+		if m.ID <= last {
+			t.Fatalf("message %d arrived after %d", m.ID, last)
+		}
+		got, last = got+1, m.ID
+	}
+	if got == total {
+		t.Error("nothing was dropped; the flood did not back up the queue")
+	}
+	if clients := srv.hub.ListClients("general"); len(clients) != 1 {
+		t.Errorf("room has %+v, want the slow client still connected", clients)
+	}
+}
+
+func TestConnClosesRevokedSession(t *testing.T) {
+	// Sessions are re-checked on every ping, long before the socket could idle out
+	config := limits(time.Minute)
+	config.PingPeriod = 20 * time.Millisecond
+	srv := startServer(t, HubConfig{QueueSize: 8, Policy: PolicyDisconnect}, config)
+
+	conn := srv.dial(t, "alice", "/ws/connect?rooms=general")
+	srv.waitForClients(t, "general", 1)
+
+	srv.sessions.revoke("alice")
+	if code := closeCode(readUntilClosed(t, conn)); code != websocket.ClosePolicyViolation {
+		t.Errorf("close code = %d, want %d", code, websocket.ClosePolicyViolation)
+	}
+	srv.waitForClients(t, "general", 0)
+}
+
+// chatFrames reads until it has n chat frames, skipping join notices and presence
+func chatFrames(t *testing.T, conn *websocket.Conn, n int) []*Message {
+	t.Helper()
+	var got []*Message
+	for len(got) < n {
+		_, m, err := readFrame(conn)
+		if err != nil {
+			t.Fatalf("connection failed after %d chat frames: %v", len(got), err)
+		}
+		if m.Type == MessageTypeChat || m.Type == MessageTypeResync {
+			got = append(got, m)
+		}
+	}
+	return got
+}
+
+func TestConnResumeReplaysMissedEventsBeforeLiveOnes(t *testing.T) {
+	srv := startServer(t, HubConfig{QueueSize: 4, Policy: PolicyDisconnect}, limits(time.Minute))
+	observer := register(srv.hub, "observer", "general")
+	for i := 1; i <= 10; i++ {
+		srv.hub.Broadcast <- chat("general", fmt.Sprint(i))
+		nextChat(t, observer)
+	}
+
+	// Live messages sent while the replay is running come after it, and
+	// more of them than the queue holds does not evict the client
+	repo := srv.hub.db.(*fakeRepo)
+	gate := make(chan struct{})
+	repo.mu.Lock()
+	repo.replayGate = gate
+	repo.mu.Unlock()
+
+	conn := srv.dial(t, "bob", "/ws/joinRoom/general?resume=4")
+	srv.waitForClients(t, "general", 2)
+	for i := 11; i <= 20; i++ {
+		srv.hub.Broadcast <- chat("general", fmt.Sprint(i))
+		nextChat(t, observer)
+	}
+	settle(srv.hub)
+	close(gate)
+	for i, m := range chatFrames(t, conn, 16) {
+		if want := int64(i + 5); m.Seq != want || m.Content != fmt.Sprint(want) {
+			t.Errorf("frame %d is %q with seq %d, want seq %d", i, m.Content, m.Seq, want)
+		}
+	}
+
+	ack := `{"type":"ack","id":"ack-1","version":1,"payload":{"seq":20}}`
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(ack)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the ack to be recorded", func() bool {
+		seq, _ := srv.hub.db.GetAckedSeq("bob", "general")
+		return seq == 20
+	})
+
+	// A client that lost its position resumes from its last ack
+	srv.hub.Broadcast <- chat("general", "21")
+	nextChat(t, observer)
+	resumed := srv.dial(t, "bob", "/ws/connect?resume=general:acked")
+	if m := chatFrames(t, resumed, 1)[0]; m.Seq != 21 {
+		t.Errorf("resuming from the ack started at seq %d, want 21", m.Seq)
+	}
+}
+
+func TestConnResumeBeyondTrimmedLogAsksForResync(t *testing.T) {
+	srv := startServer(t, HubConfig{QueueSize: 8, Policy: PolicyDisconnect}, limits(time.Minute))
+	observer := register(srv.hub, "observer", "general")
+	for i := 1; i <= 10; i++ {
+		srv.hub.Broadcast <- chat("general", fmt.Sprint(i))
+		nextChat(t, observer)
+	}
+
+	repo := srv.hub.db.(*fakeRepo)
+	repo.mu.Lock()
+	repo.events["general"] = repo.events["general"][5:]
+	repo.mu.Unlock()
+
+	conn := srv.dial(t, "bob", "/ws/joinRoom/general?resume=2")
+	if m := chatFrames(t, conn, 1)[0]; m.Type != MessageTypeResync {
+		t.Errorf("got %s with seq %d, want resync", m.Type, m.Seq)
+	}
+}
+
+func TestConnResumeAheadOfLogAsksForResync(t *testing.T) {
+	srv := startServer(t, HubConfig{QueueSize: 8, Policy: PolicyDisconnect}, limits(time.Minute))
+	observer := register(srv.hub, "observer", "general")
+	for i := 1; i <= 3; i++ {
+		srv.hub.Broadcast <- chat("general", fmt.Sprint(i))
+		nextChat(t, observer)
+	}
+
+	// Resuming exactly at the last event is up to date and gets live messages only
+	current := srv.dial(t, "carol", "/ws/joinRoom/general?resume=3")
+	srv.waitForClients(t, "general", 2)
+
+	// A cursor past the last event can never be caught up with
+	for _, path := range []string{"/ws/joinRoom/general?resume=50", "/ws/connect?resume=general:50"} {
+		conn := srv.dial(t, "bob", path)
+		if m := chatFrames(t, conn, 1)[0]; m.Type != MessageTypeResync || m.RoomID != "general" {
+			t.Errorf("%s: got %s with seq %d, want resync", path, m.Type, m.Seq)
+		}
+	}
+
+	srv.hub.Broadcast <- chat("general", "4")
+	if m := chatFrames(t, current, 1)[0]; m.Type != MessageTypeChat || m.Seq != 4 {
+		t.Errorf("up-to-date client got %s with seq %d, want chat 4", m.Type, m.Seq)
+	}
+}
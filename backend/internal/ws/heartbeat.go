@@ -0,0 +1,72 @@
+package ws
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultIdleTimeout    = 60 * time.Second
+	defaultWriteTimeout   = 10 * time.Second
+	defaultMaxMessageSize = 16 * 1024
+)
+
+// ConnConfig holds the liveness and size limits applied to every socket
+type ConnConfig struct {
+	// IdleTimeout is how long a connection may go without any frame, including pongs, before it is dropped
+	IdleTimeout time.Duration
+	// PingPeriod is how often the server pings; it must be shorter than IdleTimeout
+	PingPeriod time.Duration
+	// WriteTimeout bounds every single write to the socket
+	WriteTimeout time.Duration
+	// MaxMessageSize is the largest frame a client may send, in bytes
+	MaxMessageSize int64
+}
+
+// ConnConfigFromEnv reads WS_IDLE_TIMEOUT, WS_PING_PERIOD, WS_WRITE_TIMEOUT and
+// WS_MAX_MESSAGE_SIZE
+func ConnConfigFromEnv() (ConnConfig, error) {
+	cfg := ConnConfig{
+		IdleTimeout:    defaultIdleTimeout,
+		WriteTimeout:   defaultWriteTimeout,
+		MaxMessageSize: defaultMaxMessageSize,
+	}
+
+	if v := os.Getenv("WS_IDLE_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return cfg, fmt.Errorf("invalid WS_IDLE_TIMEOUT %q", v)
+		}
+		cfg.IdleTimeout = d
+	}
+
+	if v := os.Getenv("WS_WRITE_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return cfg, fmt.Errorf("invalid WS_WRITE_TIMEOUT %q", v)
+		}
+		cfg.WriteTimeout = d
+	}
+
+	if v := os.Getenv("WS_MAX_MESSAGE_SIZE"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 1 {
+			return cfg, fmt.Errorf("invalid WS_MAX_MESSAGE_SIZE %q", v)
+		}
+		cfg.MaxMessageSize = n
+	}
+
+	// Ping often enough that a healthy client always answers before the read deadline
+	cfg.PingPeriod = cfg.IdleTimeout * 9 / 10
+	if v := os.Getenv("WS_PING_PERIOD"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 || d >= cfg.IdleTimeout {
+			return cfg, fmt.Errorf("invalid WS_PING_PERIOD %q, it must be shorter than the idle timeout", v)
+		}
+		cfg.PingPeriod = d
+	}
+
+	return cfg, nil
+}
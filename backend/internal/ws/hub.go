@@ -1,6 +1,16 @@
 package ws
 
-import "log"
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/goyalg325/whiz/backend/internal/db"
+)
+
+// publishTimeout bounds how long a single broker publish may take
+const publishTimeout = 5 * time.Second
 
 type Room struct {
 	ID      string             `json:"id"`
@@ -8,75 +18,370 @@ type Room struct {
 	Clients map[string]*Client `json:"clients"`
 }
 
+// ClientInfo is a snapshot of a connected client, safe to use outside the hub goroutine
+type ClientInfo struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+}
+
+// Hub routes messages between clients. All room and client state is owned
+// by the goroutine running Run; other goroutines talk to it through the
+// channels below or the request/response methods, never by touching rooms.
+//
+// A connection may be subscribed to any number of rooms. Register adds a
+// connection (subscribed to its RoomID, if set) and Subscribe/Unsubscribe
+// change the rest. Messages for a new connection are held by the hub until
+// Release hands them over, so a resuming client gets its replay first.
 type Hub struct {
-	Rooms      map[string]*Room
 	Register   chan *Client
 	Unregister chan *Client
 	Broadcast  chan *Message
+	// BroadcastAll delivers a message to every client in every room
+	BroadcastAll chan *Message
+
+	rooms map[string]*Room
+	// conns holds every registered connection and the rooms it is subscribed to;
+	// Room.Clients is the reverse index used for fan-out
+	conns map[*Client]map[string]struct{}
+	// held collects messages for connections whose writer has not started yet
+	held map[*Client][]*Message
+	// requests are closures run on the hub goroutine on behalf of other goroutines
+	requests chan func()
+
+	config HubConfig
+	broker Broker
+	// db holds the per-room event log that sequence numbers come from
+	db db.Repository
+	// local receives events that could not be published, so this instance still delivers them
+	local chan *Event
 }
 
-func NewHub() *Hub {
+func NewHub(broker Broker, database db.Repository, config HubConfig) *Hub {
 	return &Hub{
-		Rooms:      make(map[string]*Room),
-		Register:   make(chan *Client),
-		Unregister: make(chan *Client),
-		Broadcast:  make(chan *Message, 5),
+		Register:     make(chan *Client),
+		Unregister:   make(chan *Client),
+		Broadcast:    make(chan *Message, 5),
+		BroadcastAll: make(chan *Message, 5),
+		rooms:        make(map[string]*Room),
+		conns:        make(map[*Client]map[string]struct{}),
+		held:         make(map[*Client][]*Message),
+		requests:     make(chan func()),
+		config:       config,
+		broker:       broker,
+		db:           database,
+		local:        make(chan *Event, 5),
+	}
+}
+
+// do runs fn on the hub goroutine and waits for it to finish
+func (h *Hub) do(fn func()) {
+	done := make(chan struct{})
+	h.requests <- func() {
+		fn()
+		close(done)
+	}
+	<-done
+}
+
+// NewClientQueue creates a send queue sized for this hub's configuration
+func (h *Hub) NewClientQueue() chan *Message {
+	return make(chan *Message, h.config.QueueSize)
+}
+
+// Send delivers a message to a single client if it is still connected
+func (h *Hub) Send(cl *Client, m *Message) {
+	h.do(func() {
+		if _, ok := h.conns[cl]; ok {
+			h.enqueue(cl, m)
+		}
+	})
+}
+
+// Release returns the messages held for a new connection since the last
+// call. Once it reports done nothing was left and later messages go to the
+// connection's queue; a connection that was dropped meanwhile is done too.
+func (h *Hub) Release(cl *Client) ([]*Message, bool) {
+	var held []*Message
+	h.do(func() {
+		held = h.held[cl]
+		if len(held) == 0 {
+			delete(h.held, cl)
+			return
+		}
+		h.held[cl] = nil
+	})
+	return held, len(held) == 0
+}
+
+// Subscribe starts delivering a room's messages to a connection. It reports
+// false if the connection has already gone away.
+func (h *Hub) Subscribe(cl *Client, roomID string) bool {
+	var ok bool
+	h.do(func() {
+		ok = h.subscribe(cl, roomID)
+	})
+	return ok
+}
+
+// Subscribed reports whether a connection currently receives a room's messages
+func (h *Hub) Subscribed(cl *Client, roomID string) bool {
+	var ok bool
+	h.do(func() {
+		_, ok = h.conns[cl][roomID]
+	})
+	return ok
+}
+
+// Unsubscribe stops delivering a room's messages to a connection
+func (h *Hub) Unsubscribe(cl *Client, roomID string) {
+	h.do(func() {
+		if subs, ok := h.conns[cl]; ok {
+			delete(subs, roomID)
+		}
+		if r, ok := h.rooms[roomID]; ok && r.Clients[cl.ID] == cl {
+			delete(r.Clients, cl.ID)
+		}
+	})
+}
+
+// EnsureRoom creates the in-memory room if it does not exist yet
+func (h *Hub) EnsureRoom(name string) {
+	h.do(func() {
+		h.ensureRoom(name)
+	})
+}
+
+// EnsureRooms creates every missing room in a single round trip to the hub
+func (h *Hub) EnsureRooms(names []string) {
+	h.do(func() {
+		for _, name := range names {
+			h.ensureRoom(name)
+		}
+	})
+}
+
+// ListClients returns the clients connected to a room on this instance
+func (h *Hub) ListClients(roomID string) []ClientInfo {
+	clients := make([]ClientInfo, 0)
+	h.do(func() {
+		if r, ok := h.rooms[roomID]; ok {
+			for _, cl := range r.Clients {
+				clients = append(clients, ClientInfo{ID: cl.ID, Username: cl.Username})
+			}
+		}
+	})
+	return clients
+}
+
+func (h *Hub) subscribe(cl *Client, roomID string) bool {
+	subs, ok := h.conns[cl]
+	if !ok {
+		return false
+	}
+	subs[roomID] = struct{}{}
+	h.ensureRoom(roomID).Clients[cl.ID] = cl
+	return true
+}
+
+// remove drops a connection from every room and closes its queue. It
+// reports false if the connection was already removed, e.g. by eviction.
+func (h *Hub) remove(cl *Client) bool {
+	subs, ok := h.conns[cl]
+	if !ok {
+		return false
+	}
+	for roomID := range subs {
+		if r, ok := h.rooms[roomID]; ok && r.Clients[cl.ID] == cl {
+			delete(r.Clients, cl.ID)
+		}
+	}
+	delete(h.conns, cl)
+	delete(h.held, cl)
+	close(cl.Message)
+	return true
+}
+
+// dropMember cuts a user who lost access to a room off from it. Connections
+// opened for that room are closed; multi-room connections just lose the
+// subscription. Leaving a public channel does not take away read access, so
+// its connections are kept.
+func (h *Hub) dropMember(r *Room, channel *db.Channel, username string) {
+	if channel != nil && !channel.IsPrivate {
+		return
+	}
+	for _, cl := range r.Clients {
+		if cl.Username == username {
+			h.detach(r, cl, websocket.ClosePolicyViolation)
+		}
+	}
+}
+
+// detach takes a connection out of a room. A connection opened for that
+// room is closed with the given code; a multi-room connection just loses
+// the subscription.
+func (h *Hub) detach(r *Room, cl *Client, code int) {
+	if cl.RoomID == r.ID {
+		cl.closeCode = code
+		h.remove(cl)
+		return
+	}
+	delete(h.conns[cl], r.ID)
+	delete(r.Clients, cl.ID)
+}
+
+// renameRoom moves a room to its channel's new name. Multi-room
+// connections keep receiving it under the new name; connections opened for
+// the old name are closed and reconnect with the name from the rename event.
+// Events sequenced under the new name by other instances may have arrived
+// before the rename and found no room, so moved connections are told to
+// resync rather than trust their position in the log.
+func (h *Hub) renameRoom(r *Room, newName string) {
+	if newName == "" || newName == r.ID {
+		return
+	}
+	target := h.ensureRoom(newName)
+	for _, cl := range r.Clients {
+		if cl.RoomID == r.ID {
+			h.detach(r, cl, websocket.CloseGoingAway)
+			continue
+		}
+		delete(h.conns[cl], r.ID)
+		h.conns[cl][newName] = struct{}{}
+		target.Clients[cl.ID] = cl
+		h.enqueue(cl, &Message{
+			Type:      MessageTypeResync,
+			RoomID:    newName,
+			Timestamp: time.Now().Format(time.RFC3339),
+			IsSystem:  true,
+		})
+	}
+	delete(h.rooms, r.ID)
+}
+
+// closeRoom disconnects everyone from a deleted channel's room
+func (h *Hub) closeRoom(r *Room) {
+	for _, cl := range r.Clients {
+		h.detach(r, cl, websocket.CloseGoingAway)
+	}
+	delete(h.rooms, r.ID)
+}
+
+func (h *Hub) ensureRoom(name string) *Room {
+	r, ok := h.rooms[name]
+	if !ok {
+		log.Printf("Room %s doesn't exist, creating it", name)
+		r = &Room{
+			ID:      name,
+			Name:    name,
+			Clients: make(map[string]*Client),
+		}
+		h.rooms[name] = r
+	}
+	return r
+}
+
+// forward publishes everything sent to Broadcast and BroadcastAll to the
+// broker, stamping room state changes with a sequence number first.
+// Delivery to local clients happens when the event comes back from the
+// broker, so every instance delivers in the same way.
+func (h *Hub) forward() {
+	for {
+		var e *Event
+		select {
+		case m := <-h.Broadcast:
+			if sequenced(m) {
+				h.sequence(m)
+			}
+			e = &Event{Message: m}
+		case m := <-h.BroadcastAll:
+			e = &Event{Message: m, AllRooms: true}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+		err := h.broker.Publish(ctx, e)
+		cancel()
+		if err != nil {
+			log.Printf("Error publishing hub event, delivering locally only: %v", err)
+			h.local <- e
+		}
 	}
 }
 
 func (h *Hub) Run() {
+	events, err := h.broker.Subscribe(context.Background())
+	if err != nil {
+		log.Fatalf("could not subscribe to hub broker: %s", err)
+	}
+
+	go h.forward()
+
 	for {
 		select {
 		case cl := <-h.Register:
-			log.Printf("Registering client %s to room %s", cl.ID, cl.RoomID)
-			if _, ok := h.Rooms[cl.RoomID]; ok {
-				r := h.Rooms[cl.RoomID]
-
-				if _, ok := r.Clients[cl.ID]; !ok {
-					r.Clients[cl.ID] = cl
+			log.Printf("Registering client %s", cl.ID)
+			if _, ok := h.conns[cl]; !ok {
+				h.conns[cl] = make(map[string]struct{})
+				h.held[cl] = nil
+				if cl.RoomID != "" {
+					h.subscribe(cl, cl.RoomID)
 					log.Printf("Client %s successfully registered to room %s", cl.ID, cl.RoomID)
 				}
-			} else {
-				// Create the room if it doesn't exist
-				log.Printf("Room %s doesn't exist, creating it", cl.RoomID)
-				h.Rooms[cl.RoomID] = &Room{
-					ID:      cl.RoomID,
-					Name:    cl.RoomID,
-					Clients: make(map[string]*Client),
-				}
-				h.Rooms[cl.RoomID].Clients[cl.ID] = cl
-				log.Printf("Created room %s and registered client %s", cl.RoomID, cl.ID)
 			}
+
 		case cl := <-h.Unregister:
-			if _, ok := h.Rooms[cl.RoomID]; ok {
-				if _, ok := h.Rooms[cl.RoomID].Clients[cl.ID]; ok {
-					if len(h.Rooms[cl.RoomID].Clients) != 0 {
-						h.Broadcast <- &Message{
-							Content:  "user left the chat",
-							RoomID:   cl.RoomID,
-							Username: cl.Username,
-							IsSystem: true,
-						}
-					}
-
-					delete(h.Rooms[cl.RoomID].Clients, cl.ID)
-					close(cl.Message)
+			// Evicted clients have already been removed and their queue closed
+			if h.remove(cl) && cl.RoomID != "" {
+				// Sent from a separate goroutine: the hub must never block on its own input
+				leave := &Message{
+					Content:  "user left the chat",
+					RoomID:   cl.RoomID,
+					Username: cl.Username,
+					IsSystem: true,
 				}
+				go func() { h.Broadcast <- leave }()
 			}
 
-		case m := <-h.Broadcast:
-			if _, ok := h.Rooms[m.RoomID]; ok {
-				log.Printf("Broadcasting message to room %s: content='%s', username='%s'", m.RoomID, m.Content, m.Username)
-				clientCount := len(h.Rooms[m.RoomID].Clients)
-				log.Printf("Room %s has %d clients", m.RoomID, clientCount)
-
-				for clientID, cl := range h.Rooms[m.RoomID].Clients {
-					log.Printf("Sending message to client %s", clientID)
-					cl.Message <- m
-				}
-			} else {
-				log.Printf("Room %s not found for broadcasting message", m.RoomID)
+		case fn := <-h.requests:
+			fn()
+
+		case e, ok := <-events:
+			if !ok {
+				log.Fatalf("hub broker subscription closed")
+			}
+			h.deliver(e)
+
+		case e := <-h.local:
+			h.deliver(e)
+		}
+	}
+}
+
+// deliver sends an event to the clients connected to this instance
+func (h *Hub) deliver(e *Event) {
+	m := e.Message
+	if e.AllRooms {
+		for cl := range h.conns {
+			h.enqueue(cl, m)
+		}
+		return
+	}
+
+	if r, ok := h.rooms[m.RoomID]; ok {
+		for _, cl := range r.Clients {
+			h.enqueue(cl, m)
+		}
+
+		switch m.Type {
+		case MessageTypeMemberRemoved:
+			h.dropMember(r, m.Channel, m.Username)
+		case MessageTypeChannelRenamed:
+			if m.Channel != nil {
+				h.renameRoom(r, m.Channel.Name)
 			}
+		case MessageTypeChannelDeleted:
+			h.closeRoom(r)
 		}
+	} else {
+		log.Printf("Room %s not found for broadcasting message", m.RoomID)
 	}
 }
@@ -0,0 +1,609 @@
+package ws
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/goyalg325/whiz/backend/internal/db"
+)
+
+// fakeRepo keeps the little state the hub and handler need in memory.
+// Every channel exists and is readable by everyone. Methods the tests do
+// not use panic through the nil embedded Repository.
+type fakeRepo struct {
+	db.Repository
+
+	mu          sync.Mutex
+	events      map[string][]db.RoomEvent
+	lastSeq     map[string]int64
+	acked       map[string]int64
+	connections map[string]int
+	// replayGate, when set, blocks GetRoomEvents until it is closed
+	replayGate chan struct{}
+	// saveErr, when set, is returned by SaveMessage
+	saveErr  error
+	messages []db.Message
+	// pages records the history pages asked for
+	pages []db.PageRequest
+}
+
+func newFakeRepo() *fakeRepo {
+	return &fakeRepo{
+		events:      make(map[string][]db.RoomEvent),
+		lastSeq:     make(map[string]int64),
+		acked:       make(map[string]int64),
+		connections: make(map[string]int),
+	}
+}
+
+func (r *fakeRepo) CheckChannelAccess(channelName, username string) error {
+	return nil
+}
+
+func (r *fakeRepo) GetChannel(channelName string) (*db.Channel, error) {
+	return &db.Channel{Name: channelName, Kind: db.KindChannel}, nil
+}
+
+func (r *fakeRepo) GetRoomMessages(roomId string, page db.PageRequest) (*db.MessagePage, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pages = append(r.pages, page)
+	return &db.MessagePage{Messages: []db.Message{}}, nil
+}
+
+func (r *fakeRepo) SaveMessage(content, username string, roomId string) (*db.Message, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.saveErr != nil {
+		return nil, r.saveErr
+	}
+	m := db.Message{
+		ID:        len(r.messages) + 1,
+		Content:   content,
+		Username:  username,
+		RoomID:    roomId,
+		Timestamp: time.Now(),
+	}
+	r.messages = append(r.messages, m)
+	return &m, nil
+}
+
+func (r *fakeRepo) SetPresence(username, status string, lastActive time.Time) error {
+	return nil
+}
+
+func (r *fakeRepo) HeartbeatPresenceConnections(instanceId string) error {
+	return nil
+}
+
+func (r *fakeRepo) ExpirePresenceConnections() ([]string, error) {
+	return nil, nil
+}
+
+func (r *fakeRepo) AddPresenceConnection(connectionId, username, instanceId string) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.connections[username]++
+	return r.connections[username], nil
+}
+
+func (r *fakeRepo) RemovePresenceConnection(connectionId, username string) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.connections[username]--
+	return r.connections[username], nil
+}
+
+func (r *fakeRepo) AppendRoomEvent(roomId string, payload []byte) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastSeq[roomId]++
+	seq := r.lastSeq[roomId]
+	r.events[roomId] = append(r.events[roomId], db.RoomEvent{Seq: seq, Payload: payload})
+	return seq, nil
+}
+
+func (r *fakeRepo) GetLastSeq(roomId string) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lastSeq[roomId], nil
+}
+
+func (r *fakeRepo) GetRoomEvents(roomId string, afterSeq int64, limit int) ([]db.RoomEvent, error) {
+	r.mu.Lock()
+	events := []db.RoomEvent{}
+	for _, e := range r.events[roomId] {
+		if e.Seq > afterSeq && len(events) < limit {
+			events = append(events, e)
+		}
+	}
+	gate := r.replayGate
+	r.mu.Unlock()
+
+	if gate != nil {
+		<-gate
+	}
+	return events, nil
+}
+
+func (r *fakeRepo) AckRoomEvents(username, roomId string, seq int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if seq > r.acked[username+"/"+roomId] {
+		r.acked[username+"/"+roomId] = seq
+	}
+	return nil
+}
+
+func (r *fakeRepo) GetAckedSeq(username, roomId string) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.acked[username+"/"+roomId], nil
+}
+
+// startHub runs a hub on an in-memory broker for the rest of the test binary
+func startHub(t *testing.T, config HubConfig) *Hub {
+	t.Helper()
+	hub := NewHub(NewMemoryBroker(), newFakeRepo(), config)
+	go hub.Run()
+	return hub
+}
+
+// register adds a socketless client to the hub that takes messages from
+// its queue right away; room may be empty for a multi-room connection
+func register(hub *Hub, id, room string) *Client {
+	cl := registerHeld(hub, id, room)
+	hub.Release(cl)
+	return cl
+}
+
+// registerHeld adds a socketless client whose messages the hub holds until Release
+func registerHeld(hub *Hub, id, room string) *Client {
+	cl := &Client{
+		Message:         hub.NewClientQueue(),
+		ID:              id,
+		RoomID:          room,
+		Username:        id,
+		replayedThrough: make(map[string]int64),
+	}
+	hub.Register <- cl
+	return cl
+}
+
+// next waits for the next message queued for a client
+func next(t *testing.T, cl *Client) *Message {
+	t.Helper()
+	select {
+	case m, ok := <-cl.Message:
+		if !ok {
+			t.Fatalf("queue of %s was closed", cl.ID)
+		}
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for a message to %s", cl.ID)
+	}
+	return nil
+}
+
+// nextChat waits for the next chat message queued for a client, skipping notices
+func nextChat(t *testing.T, cl *Client) *Message {
+	t.Helper()
+	for {
+		if m := next(t, cl); m.Type == MessageTypeChat {
+			return m
+		}
+	}
+}
+
+// closed waits for a client's queue to be closed, discarding anything still in it
+func closed(t *testing.T, cl *Client) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-cl.Message:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("queue of %s was never closed", cl.ID)
+		}
+	}
+}
+
+// settle waits until the hub has finished whatever it is doing, e.g. the
+// rest of a delivery one client has already seen
+func settle(hub *Hub) {
+	hub.do(func() {})
+}
+
+func chat(room, content string) *Message {
+	return &Message{Type: MessageTypeChat, RoomID: room, Username: "alice", Content: content}
+}
+
+func typing(room, username string) *Message {
+	return &Message{Type: MessageTypeTypingStart, RoomID: room, Username: username}
+}
+
+func TestHubRegisterBroadcastUnregister(t *testing.T) {
+	hub := startHub(t, HubConfig{QueueSize: 8, Policy: PolicyDisconnect})
+	alice := register(hub, "alice", "general")
+	bob := register(hub, "bob", "general")
+	other := register(hub, "carol", "random")
+
+	hub.Broadcast <- chat("general", "hello")
+	for _, cl := range []*Client{alice, bob} {
+		m := next(t, cl)
+		if m.Content != "hello" || m.Seq != 1 {
+			t.Errorf("%s got %q with seq %d, want hello with seq 1", cl.ID, m.Content, m.Seq)
+		}
+	}
+	settle(hub)
+	if n := len(other.Message); n != 0 {
+		t.Errorf("client in another room has %d queued messages", n)
+	}
+
+	hub.Unregister <- bob
+	closed(t, bob)
+	if m := next(t, alice); !m.IsSystem || m.Username != "bob" {
+		t.Errorf("alice got %+v, want the notice that bob left", m)
+	}
+	if got := hub.ListClients("general"); len(got) != 1 || got[0].ID != "alice" {
+		t.Errorf("clients after unregister = %+v, want only alice", got)
+	}
+
+	hub.Broadcast <- chat("general", "still here")
+	if m := next(t, alice); m.Content != "still here" || m.Seq != 2 {
+		t.Errorf("alice got %q with seq %d, want still here with seq 2", m.Content, m.Seq)
+	}
+
+	// Unregistering twice must not close the queue twice
+	hub.Unregister <- bob
+	settle(hub)
+}
+
+func TestHubHoldsMessagesUntilReleased(t *testing.T) {
+	hub := startHub(t, HubConfig{QueueSize: 2, Policy: PolicyDisconnect})
+	held := registerHeld(hub, "held", "general")
+	observer := register(hub, "observer", "general")
+
+	// More than the queue holds; none of it may reach the queue or evict the client
+	for i := 0; i < 5; i++ {
+		hub.Broadcast <- chat("general", fmt.Sprint(i))
+		next(t, observer)
+	}
+	settle(hub)
+	if n := len(held.Message); n != 0 {
+		t.Fatalf("%d messages reached the queue of a held client", n)
+	}
+
+	messages, done := hub.Release(held)
+	if done || len(messages) != 5 {
+		t.Fatalf("Release returned %d messages, done %v; want 5, not done", len(messages), done)
+	}
+	for i, m := range messages {
+		if m.Content != fmt.Sprint(i) {
+			t.Errorf("held message %d = %q", i, m.Content)
+		}
+	}
+	if messages, done := hub.Release(held); !done || len(messages) != 0 {
+		t.Fatalf("second Release returned %d messages, done %v; want none, done", len(messages), done)
+	}
+
+	hub.Broadcast <- chat("general", "live")
+	if m := next(t, held); m.Content != "live" {
+		t.Errorf("released client got %q, want live", m.Content)
+	}
+}
+
+func TestHubEvictsHeldClientTooFarBehind(t *testing.T) {
+	hub := startHub(t, HubConfig{QueueSize: 2, Policy: PolicyDisconnect})
+	held := registerHeld(hub, "held", "general")
+
+	for i := 0; i <= maxHeldMessages; i++ {
+		hub.Broadcast <- typing("general", "bob")
+	}
+	closed(t, held)
+	if held.closeCode != websocket.CloseTryAgainLater {
+		t.Errorf("close code = %d, want %d", held.closeCode, websocket.CloseTryAgainLater)
+	}
+	if messages, done := hub.Release(held); !done || len(messages) != 0 {
+		t.Errorf("Release after eviction returned %d messages, done %v", len(messages), done)
+	}
+}
+
+func TestHubBroadcastAllReachesEveryRoom(t *testing.T) {
+	hub := startHub(t, HubConfig{QueueSize: 8, Policy: PolicyDisconnect})
+	general := register(hub, "alice", "general")
+	random := register(hub, "bob", "random")
+	multi := register(hub, "carol", "")
+
+	hub.BroadcastAll <- &Message{Type: MessageTypePresence, Username: "dave", Status: db.PresenceOnline}
+	for _, cl := range []*Client{general, random, multi} {
+		if m := next(t, cl); m.Type != MessageTypePresence || m.Username != "dave" {
+			t.Errorf("%s got %+v, want dave's presence", cl.ID, m)
+		}
+	}
+}
+
+func TestHubEvictsSlowClient(t *testing.T) {
+	hub := startHub(t, HubConfig{QueueSize: 2, Policy: PolicyDisconnect})
+	slow := register(hub, "slow", "general")
+	fast := register(hub, "fast", "general")
+
+	for i := 0; i < 3; i++ {
+		hub.Broadcast <- chat("general", fmt.Sprint(i))
+		next(t, fast)
+	}
+
+	closed(t, slow)
+	if slow.closeCode != websocket.CloseTryAgainLater {
+		t.Errorf("close code = %d, want %d", slow.closeCode, websocket.CloseTryAgainLater)
+	}
+	if hub.Subscribed(slow, "general") {
+		t.Error("evicted client is still subscribed")
+	}
+	if !hub.Subscribed(fast, "general") {
+		t.Error("client that kept up was evicted too")
+	}
+
+	// The evicted client's reader still unregisters it afterwards
+	hub.Unregister <- slow
+	settle(hub)
+}
+
+func TestHubDropOldestKeepsNewest(t *testing.T) {
+	hub := startHub(t, HubConfig{QueueSize: 2, Policy: PolicyDropOldest})
+	slow := register(hub, "slow", "general")
+	fast := register(hub, "fast", "general")
+
+	for i := 0; i < 5; i++ {
+		hub.Broadcast <- chat("general", fmt.Sprint(i))
+		next(t, fast)
+	}
+	settle(hub)
+
+	for _, want := range []string{"3", "4"} {
+		if m := next(t, slow); m.Content != want {
+			t.Errorf("slow client got %q, want %q", m.Content, want)
+		}
+	}
+	if !hub.Subscribed(slow, "general") {
+		t.Error("drop_oldest evicted the client")
+	}
+}
+
+func TestHubCoalesceCollapsesSupersededEvents(t *testing.T) {
+	hub := startHub(t, HubConfig{QueueSize: 2, Policy: PolicyCoalesce})
+	slow := register(hub, "slow", "general")
+	fast := register(hub, "fast", "general")
+
+	send := func(m *Message) {
+		hub.Broadcast <- m
+		next(t, fast)
+	}
+	send(chat("general", "hello"))
+	send(typing("general", "bob"))
+	send(typing("general", "bob"))
+	settle(hub)
+
+	if m := next(t, slow); m.Content != "hello" {
+		t.Errorf("first queued message = %+v, want the chat message", m)
+	}
+	if m := next(t, slow); m.Type != MessageTypeTypingStart {
+		t.Errorf("second queued message = %+v, want bob typing", m)
+	}
+
+	// Chat messages never coalesce, so a full queue of them evicts the client
+	send(chat("general", "1"))
+	send(chat("general", "2"))
+	send(chat("general", "3"))
+	closed(t, slow)
+	if slow.closeCode != websocket.CloseTryAgainLater {
+		t.Errorf("close code = %d, want %d", slow.closeCode, websocket.CloseTryAgainLater)
+	}
+}
+
+func TestHubSubscribeUnsubscribe(t *testing.T) {
+	hub := startHub(t, HubConfig{QueueSize: 8, Policy: PolicyDisconnect})
+	multi := register(hub, "multi", "")
+
+	if !hub.Subscribe(multi, "a") || !hub.Subscribe(multi, "b") {
+		t.Fatal("Subscribe failed for a registered client")
+	}
+	if !hub.Subscribed(multi, "a") || !hub.Subscribed(multi, "b") {
+		t.Fatal("client is not subscribed after Subscribe")
+	}
+
+	hub.Broadcast <- chat("a", "to a")
+	hub.Broadcast <- chat("b", "to b")
+	for _, want := range []string{"to a", "to b"} {
+		if m := next(t, multi); m.Content != want {
+			t.Errorf("got %q, want %q", m.Content, want)
+		}
+	}
+
+	hub.Unsubscribe(multi, "a")
+	if hub.Subscribed(multi, "a") {
+		t.Error("client is still subscribed to a")
+	}
+	hub.Broadcast <- chat("a", "missed")
+	hub.Broadcast <- chat("b", "seen")
+	if m := next(t, multi); m.Content != "seen" {
+		t.Errorf("got %q after unsubscribing from a, want the message to b", m.Content)
+	}
+
+	hub.Unregister <- multi
+	closed(t, multi)
+	if hub.Subscribe(multi, "a") {
+		t.Error("Subscribe succeeded for an unregistered client")
+	}
+	if got := hub.ListClients("b"); len(got) != 0 {
+		t.Errorf("room b still lists %+v", got)
+	}
+}
+
+func TestHubMemberRemovedDropsOnlyPrivateChannels(t *testing.T) {
+	hub := startHub(t, HubConfig{QueueSize: 8, Policy: PolicyDisconnect})
+	public := register(hub, "bob", "general")
+	secret := register(hub, "bob", "secret")
+	multi := &Client{
+		Message:         hub.NewClientQueue(),
+		ID:              "multi",
+		Username:        "bob",
+		replayedThrough: make(map[string]int64),
+	}
+	hub.Register <- multi
+	hub.Release(multi)
+	hub.Subscribe(multi, "general")
+	hub.Subscribe(multi, "secret")
+
+	removed := func(room string, private bool) *Message {
+		return &Message{
+			Type:     MessageTypeMemberRemoved,
+			RoomID:   room,
+			Username: "bob",
+			IsSystem: true,
+			Channel:  &db.Channel{Name: room, IsPrivate: private},
+		}
+	}
+
+	hub.Broadcast <- removed("general", false)
+	if m := next(t, public); m.Type != MessageTypeMemberRemoved {
+		t.Fatalf("got %+v, want the member_removed notice", m)
+	}
+	settle(hub)
+	if !hub.Subscribed(multi, "general") {
+		t.Error("leaving a public channel dropped the subscription")
+	}
+	hub.Broadcast <- chat("general", "still readable")
+	if m := nextChat(t, public); m.Content != "still readable" {
+		t.Errorf("got %q on the public room's connection", m.Content)
+	}
+
+	hub.Broadcast <- removed("secret", true)
+	closed(t, secret)
+	if hub.Subscribed(multi, "secret") {
+		t.Error("leaving a private channel kept the subscription")
+	}
+}
+
+func TestHubSequencesMembershipButResyncsAfterRename(t *testing.T) {
+	hub := startHub(t, HubConfig{QueueSize: 8, Policy: PolicyDisconnect})
+	repo := hub.db.(*fakeRepo)
+	single := register(hub, "alice", "general")
+	multi := register(hub, "bob", "")
+	hub.Subscribe(multi, "general")
+
+	channel := &db.Channel{Name: "general", Topic: "hello"}
+	hub.Broadcast <- &Message{Type: MessageTypeMemberJoined, RoomID: "general", Username: "carol", IsSystem: true}
+	hub.Broadcast <- &Message{Type: MessageTypeChannelTopic, RoomID: "general", IsSystem: true, Channel: channel}
+	for seq := int64(1); seq <= 2; seq++ {
+		if m := next(t, multi); m.Seq != seq {
+			t.Errorf("%s event got seq %d, want %d", m.Type, m.Seq, seq)
+		}
+	}
+
+	hub.Broadcast <- &Message{Type: MessageTypeChannelRenamed, RoomID: "general", IsSystem: true,
+		Channel: &db.Channel{Name: "lobby"}}
+	renamed := next(t, multi)
+	if renamed.Type != MessageTypeChannelRenamed || renamed.Seq != 0 {
+		t.Errorf("got %+v, want an unsequenced channel_renamed", renamed)
+	}
+	resync := next(t, multi)
+	if resync.Type != MessageTypeResync || resync.RoomID != "lobby" {
+		t.Errorf("got %+v, want a resync for lobby", resync)
+	}
+	if !hub.Subscribed(multi, "lobby") {
+		t.Error("multi-room connection did not follow the rename")
+	}
+	closed(t, single)
+
+	repo.mu.Lock()
+	logged := len(repo.events["general"])
+	repo.mu.Unlock()
+	if logged != 2 {
+		t.Errorf("general's log holds %d events, want the join and the topic change", logged)
+	}
+}
+
+func TestHubConcurrentBroadcasts(t *testing.T) {
+	const (
+		clients = 50
+		senders = 8
+		perSend = 25
+	)
+	hub := startHub(t, HubConfig{QueueSize: senders * perSend, Policy: PolicyDisconnect})
+
+	var readers sync.WaitGroup
+	errs := make(chan error, clients)
+	for i := 0; i < clients; i++ {
+		cl := register(hub, fmt.Sprintf("client-%d", i), "general")
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			last := make(map[string]int)
+			var lastSeq int64
+			for n := 0; n < senders*perSend; n++ {
+				var m *Message
+				select {
+				case m = <-cl.Message:
+				case <-time.After(5 * time.Second):
+					errs <- fmt.Errorf("%s timed out after %d messages", cl.ID, n)
+					return
+				}
+				if m.Seq <= lastSeq {
+					errs <- fmt.Errorf("%s got seq %d after %d", cl.ID, m.Seq, lastSeq)
+					return
+				}
+				lastSeq = m.Seq
+
+				var k int
+				fmt.Sscan(m.Content, &k)
+				if k != last[m.Username] {
+					errs <- fmt.Errorf("%s got message %d from %s, want %d", cl.ID, k, m.Username, last[m.Username])
+					return
+				}
+				last[m.Username]++
+			}
+		}()
+	}
+
+	// Subscriptions keep changing while the messages flow
+	churn := register(hub, "churn", "")
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			hub.Subscribe(churn, "general")
+			hub.ListClients("general")
+			hub.Unsubscribe(churn, "general")
+		}
+	}()
+
+	var senderWG sync.WaitGroup
+	for s := 0; s < senders; s++ {
+		senderWG.Add(1)
+		go func(name string) {
+			defer senderWG.Done()
+			for k := 0; k < perSend; k++ {
+				hub.Broadcast <- &Message{Type: MessageTypeChat, RoomID: "general", Username: name, Content: fmt.Sprint(k)}
+			}
+		}(fmt.Sprintf("sender-%d", s))
+	}
+
+	senderWG.Wait()
+	readers.Wait()
+	close(stop)
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
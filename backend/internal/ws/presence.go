@@ -0,0 +1,189 @@
+package ws
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/goyalg325/whiz/backend/internal/db"
+)
+
+const (
+	// touchInterval throttles how often activity is written to the database
+	touchInterval = 30 * time.Second
+	// heartbeatInterval is how often this instance marks its connections as
+	// open and clears out those of instances that stopped; it must stay well
+	// under db.PresenceStaleAfter
+	heartbeatInterval = 30 * time.Second
+)
+
+type userPresence struct {
+	connections int
+	status      string
+	lastActive  time.Time
+	lastWrite   time.Time
+}
+
+// Presence tracks which users are connected across all rooms, persists their
+// status and tells every connected client when someone's status changes.
+//
+// Every open socket has a row in the database heartbeated by the instance
+// holding it, so a user stays online while connected to any instance and
+// goes offline when the last of their connections closes or its instance
+// stops heartbeating. users only covers this instance's connections.
+type Presence struct {
+	mu         sync.Mutex
+	users      map[string]*userPresence
+	hub        *Hub
+	db         db.Repository
+	instanceID string
+}
+
+func NewPresence(hub *Hub, database db.Repository) *Presence {
+	return &Presence{
+		users:      make(map[string]*userPresence),
+		hub:        hub,
+		db:         database,
+		instanceID: randomSuffix() + randomSuffix(),
+	}
+}
+
+// Run heartbeats this instance's connections and takes users whose
+// instance went away offline
+func (p *Presence) Run() {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := p.db.HeartbeatPresenceConnections(p.instanceID); err != nil {
+			log.Printf("Error heartbeating connections of instance %s: %v", p.instanceID, err)
+		}
+
+		usernames, err := p.db.ExpirePresenceConnections()
+		if err != nil {
+			continue
+		}
+		for _, username := range usernames {
+			log.Printf("Connections of %s went stale, marking them offline", username)
+			p.publish(username, db.PresenceOffline, time.Now())
+		}
+	}
+}
+
+// Connect records a new connection; the user comes online with their first
+// one on any instance
+func (p *Presence) Connect(connectionID, username string) {
+	now := time.Now()
+
+	p.mu.Lock()
+	u, ok := p.users[username]
+	if !ok {
+		u = &userPresence{status: db.PresenceOnline}
+		p.users[username] = u
+	}
+	u.connections++
+	u.lastActive = now
+	u.lastWrite = now
+	p.mu.Unlock()
+
+	live, err := p.db.AddPresenceConnection(connectionID, username, p.instanceID)
+	if err != nil {
+		return
+	}
+	if live == 1 {
+		p.publish(username, db.PresenceOnline, now)
+	}
+}
+
+// Disconnect records a closed connection; the user goes offline with their
+// last one on any instance
+func (p *Presence) Disconnect(connectionID, username string) {
+	p.mu.Lock()
+	u, ok := p.users[username]
+	if !ok {
+		p.mu.Unlock()
+		return
+	}
+	u.connections--
+	lastActive := u.lastActive
+	if u.connections <= 0 {
+		delete(p.users, username)
+	}
+	p.mu.Unlock()
+
+	live, err := p.db.RemovePresenceConnection(connectionID, username)
+	if err != nil {
+		return
+	}
+	if live == 0 {
+		p.publish(username, db.PresenceOffline, lastActive)
+	}
+}
+
+// Touch marks the user as active. An away user comes back online.
+func (p *Presence) Touch(username string) {
+	now := time.Now()
+
+	p.mu.Lock()
+	u, ok := p.users[username]
+	if !ok {
+		p.mu.Unlock()
+		return
+	}
+	u.lastActive = now
+	cameBack := u.status == db.PresenceAway
+	shouldWrite := cameBack || now.Sub(u.lastWrite) >= touchInterval
+	if cameBack {
+		u.status = db.PresenceOnline
+	}
+	if shouldWrite {
+		u.lastWrite = now
+	}
+	p.mu.Unlock()
+
+	if cameBack {
+		p.publish(username, db.PresenceOnline, now)
+	} else if shouldWrite {
+		if err := p.db.SetPresence(username, db.PresenceOnline, now); err != nil {
+			log.Printf("Error recording activity for %s: %v", username, err)
+		}
+	}
+}
+
+// SetStatus lets a connected user switch between online and away
+func (p *Presence) SetStatus(username, status string) error {
+	if status != db.PresenceOnline && status != db.PresenceAway {
+		return errors.New("status must be online or away")
+	}
+
+	p.mu.Lock()
+	u, ok := p.users[username]
+	if !ok {
+		p.mu.Unlock()
+		return errors.New("user is not connected")
+	}
+	changed := u.status != status
+	u.status = status
+	lastActive := u.lastActive
+	p.mu.Unlock()
+
+	if changed {
+		p.publish(username, status, lastActive)
+	}
+	return nil
+}
+
+func (p *Presence) publish(username, status string, lastActive time.Time) {
+	if err := p.db.SetPresence(username, status, lastActive); err != nil {
+		log.Printf("Error saving presence for %s: %v", username, err)
+	}
+
+	p.hub.BroadcastAll <- &Message{
+		Type:      MessageTypePresence,
+		Username:  username,
+		Status:    status,
+		Timestamp: lastActive.Format(time.RFC3339),
+		IsSystem:  true,
+	}
+}
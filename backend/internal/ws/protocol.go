@@ -0,0 +1,281 @@
+package ws
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/goyalg325/whiz/backend/internal/db"
+)
+
+// Every WebSocket frame, in both directions, is a JSON envelope:
+//
+//	{"type": "message", "id": "c0ffee-1", "version": 1, "payload": {...}}
+//
+// type names what the frame is (the MessageType constants). id is chosen by
+// the client and echoed on error frames so the client knows which frame
+// failed. A frame that went through is remembered by id for dedupeWindow:
+// sending it again gets a duplicate error instead of a second copy, while a
+// failed frame may be retried with the same id. ids are remembered in
+// memory by the instance that handled the frame, so a frame resent to
+// another instance or after a restart is processed again. version must be
+// ProtocolVersion. payload holds the frame's fields:
+//
+//	message                    channel_id?, content
+//	reply                      channel_id?, parent_id, content
+//	edit                       channel_id?, message_id, content
+//	delete                     channel_id?, message_id
+//	react, unreact             channel_id?, message_id, emoji
+//	typing_start, typing_stop  channel_id?
+//	presence                   status
+//	subscribe, unsubscribe     channel_id
+//	ack                        channel_id?, seq
+//
+// channel_id defaults to the room a single-room connection was opened for.
+// Room events carry a per-room seq; clients ack the last one they handled
+// so a reconnect can resume from it with resume=acked even when the client
+// itself lost track.
+// Unknown fields, missing required fields and other versions are rejected
+// with an error frame whose payload carries a code and a reason.
+// Server frames carry a Message as their payload.
+
+// ProtocolVersion is the envelope version this server speaks
+const ProtocolVersion = 1
+
+// Error codes sent in the payload of error frames
+const (
+	ErrCodeInvalidFrame       = "invalid_frame"
+	ErrCodeUnsupportedVersion = "unsupported_version"
+	ErrCodeUnknownType        = "unknown_type"
+	ErrCodeInvalidPayload     = "invalid_payload"
+	ErrCodeNotSubscribed      = "not_subscribed"
+	ErrCodeNotFound           = "not_found"
+	ErrCodeForbidden          = "forbidden"
+	ErrCodeInternal           = "internal"
+	ErrCodeDuplicate          = "duplicate"
+)
+
+// dedupeWindow is how long a client frame ID is remembered
+const dedupeWindow = 5 * time.Minute
+
+// Envelope wraps every frame sent over the socket
+type Envelope struct {
+	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	Version int             `json:"version"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// IncomingMessage is the payload of a client frame. Which fields are
+// required depends on the frame type.
+type IncomingMessage struct {
+	ChannelID string `json:"channel_id,omitempty"`
+	MessageID int    `json:"message_id,omitempty"`
+	ParentID  int    `json:"parent_id,omitempty"`
+	Content   string `json:"content,omitempty"`
+	Emoji     string `json:"emoji,omitempty"`
+	Status    string `json:"status,omitempty"`
+	Seq       int64  `json:"seq,omitempty"`
+}
+
+// ProtocolError is reported to the client as an error frame
+type ProtocolError struct {
+	Code   string
+	Reason string
+}
+
+func (e *ProtocolError) Error() string {
+	return e.Code + ": " + e.Reason
+}
+
+func protocolError(code, format string, args ...interface{}) *ProtocolError {
+	return &ProtocolError{Code: code, Reason: fmt.Sprintf(format, args...)}
+}
+
+// decodeFrame strictly decodes a client frame. The envelope is returned
+// even on error when it could be read, so the error can echo its ID.
+func decodeFrame(raw []byte) (*Envelope, *IncomingMessage, *ProtocolError) {
+	var env Envelope
+	if err := strictUnmarshal(raw, &env); err != nil {
+		return nil, nil, protocolError(ErrCodeInvalidFrame, "frame is not a valid envelope: %v", err)
+	}
+	if env.Version != ProtocolVersion {
+		return &env, nil, protocolError(ErrCodeUnsupportedVersion, "version %d is not supported, use %d", env.Version, ProtocolVersion)
+	}
+
+	var in IncomingMessage
+	if len(env.Payload) > 0 {
+		if err := strictUnmarshal(env.Payload, &in); err != nil {
+			return &env, nil, protocolError(ErrCodeInvalidPayload, "invalid %s payload: %v", env.Type, err)
+		}
+	}
+
+	if err := validateFrame(env.Type, &in); err != nil {
+		return &env, nil, err
+	}
+	return &env, &in, nil
+}
+
+func strictUnmarshal(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if dec.More() {
+		return errors.New("unexpected data after JSON value")
+	}
+	return nil
+}
+
+// validateFrame checks that a frame type is known and its required fields are set
+func validateFrame(msgType string, in *IncomingMessage) *ProtocolError {
+	missing := func(field string) *ProtocolError {
+		return protocolError(ErrCodeInvalidPayload, "%s requires %s", msgType, field)
+	}
+
+	switch msgType {
+	case MessageTypeChat:
+		if in.Content == "" {
+			return missing("content")
+		}
+	case MessageTypeReply:
+		if in.ParentID == 0 {
+			return missing("parent_id")
+		}
+		if in.Content == "" {
+			return missing("content")
+		}
+	case MessageTypeEdit:
+		if in.MessageID == 0 {
+			return missing("message_id")
+		}
+		if in.Content == "" {
+			return missing("content")
+		}
+	case MessageTypeDelete:
+		if in.MessageID == 0 {
+			return missing("message_id")
+		}
+	case MessageTypeReact, MessageTypeUnreact:
+		if in.MessageID == 0 {
+			return missing("message_id")
+		}
+		if in.Emoji == "" {
+			return missing("emoji")
+		}
+	case MessageTypePresence:
+		if in.Status == "" {
+			return missing("status")
+		}
+	case MessageTypeSubscribe, MessageTypeUnsubscribe:
+		if in.ChannelID == "" {
+			return missing("channel_id")
+		}
+	case MessageTypeAck:
+		if in.Seq <= 0 {
+			return missing("seq")
+		}
+	case MessageTypeTypingStart, MessageTypeTypingStop:
+	default:
+		return protocolError(ErrCodeUnknownType, "unknown frame type %q", msgType)
+	}
+	return nil
+}
+
+// errorFrom maps a storage error to an error frame without leaking internals
+func errorFrom(err error) *ProtocolError {
+	switch {
+	case errors.Is(err, db.ErrMessageNotFound), errors.Is(err, db.ErrChannelNotFound):
+		return &ProtocolError{Code: ErrCodeNotFound, Reason: err.Error()}
+	case errors.Is(err, db.ErrNotMessageAuthor), errors.Is(err, db.ErrChannelArchived):
+		return &ProtocolError{Code: ErrCodeForbidden, Reason: err.Error()}
+	case errors.Is(err, db.ErrInvalidReaction):
+		return &ProtocolError{Code: ErrCodeInvalidPayload, Reason: err.Error()}
+	}
+	return &ProtocolError{Code: ErrCodeInternal, Reason: "the server could not process this frame"}
+}
+
+// accessError maps a failed channel access check to an error frame.
+// Non-members cannot tell a private channel from one that does not exist.
+func accessError(err error) *ProtocolError {
+	switch {
+	case errors.Is(err, db.ErrChannelNotFound), errors.Is(err, db.ErrNotChannelMember):
+		return &ProtocolError{Code: ErrCodeNotFound, Reason: db.ErrChannelNotFound.Error()}
+	}
+	return errorFrom(err)
+}
+
+// encodeFrame wraps a server message in an envelope
+func encodeFrame(m *Message) ([]byte, error) {
+	payload, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+
+	msgType := m.Type
+	if msgType == "" {
+		msgType = MessageTypeChat
+	}
+	return json.Marshal(Envelope{
+		Type:    msgType,
+		ID:      m.FrameID,
+		Version: ProtocolVersion,
+		Payload: payload,
+	})
+}
+
+// recentFrames remembers the IDs of client frames per user so a frame
+// resent after a timeout or reconnect to this instance is only processed
+// once. It lives in this process's memory only.
+type recentFrames struct {
+	mu sync.Mutex
+	// seen holds when each frame was claimed, or handled once it went through
+	seen      map[string]time.Time
+	lastPrune time.Time
+}
+
+func newRecentFrames() *recentFrames {
+	return &recentFrames{seen: make(map[string]time.Time)}
+}
+
+// claim reserves a frame ID for handling. It reports false if the frame was
+// handled within dedupeWindow or is being handled right now.
+func (r *recentFrames) claim(username, frameID string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(r.lastPrune) > dedupeWindow {
+		for key, at := range r.seen {
+			if now.Sub(at) > dedupeWindow {
+				delete(r.seen, key)
+			}
+		}
+		r.lastPrune = now
+	}
+
+	key := username + "\x00" + frameID
+	if at, ok := r.seen[key]; ok && now.Sub(at) <= dedupeWindow {
+		return false
+	}
+	r.seen[key] = now
+	return true
+}
+
+// finish releases a claimed frame ID. A frame that went through is
+// remembered; a failed one is forgotten so it can be retried.
+func (r *recentFrames) finish(username, frameID string, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := username + "\x00" + frameID
+	if ok {
+		r.seen[key] = time.Now()
+	} else {
+		delete(r.seen, key)
+	}
+}
@@ -0,0 +1,216 @@
+package ws
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/goyalg325/whiz/backend/internal/db"
+)
+
+func TestDecodeFrame(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame string
+		code  string
+	}{
+		{"message", `{"type":"message","id":"1","version":1,"payload":{"content":"hi"}}`, ""},
+		{"typing without payload", `{"type":"typing_start","version":1}`, ""},
+		{"multi-room message", `{"type":"message","version":1,"payload":{"channel_id":"general","content":"hi"}}`, ""},
+		{"ack", `{"type":"ack","version":1,"payload":{"seq":4}}`, ""},
+		{"not JSON", `hello`, ErrCodeInvalidFrame},
+		{"unknown envelope field", `{"type":"message","version":1,"extra":true}`, ErrCodeInvalidFrame},
+		{"trailing data", `{"type":"typing_start","version":1} {}`, ErrCodeInvalidFrame},
+		{"missing version", `{"type":"message","payload":{"content":"hi"}}`, ErrCodeUnsupportedVersion},
+		{"future version", `{"type":"message","version":2,"payload":{"content":"hi"}}`, ErrCodeUnsupportedVersion},
+		{"unknown type", `{"type":"shout","version":1}`, ErrCodeUnknownType},
+		{"server-only type", `{"type":"reactions","version":1}`, ErrCodeUnknownType},
+		{"unknown payload field", `{"type":"message","version":1,"payload":{"content":"hi","roomId":"x"}}`, ErrCodeInvalidPayload},
+		{"wrong payload type", `{"type":"delete","version":1,"payload":{"message_id":"7"}}`, ErrCodeInvalidPayload},
+		{"message without content", `{"type":"message","version":1,"payload":{}}`, ErrCodeInvalidPayload},
+		{"reply without parent", `{"type":"reply","version":1,"payload":{"content":"hi"}}`, ErrCodeInvalidPayload},
+		{"react without emoji", `{"type":"react","version":1,"payload":{"message_id":3}}`, ErrCodeInvalidPayload},
+		{"subscribe without channel", `{"type":"subscribe","version":1,"payload":{}}`, ErrCodeInvalidPayload},
+		{"ack without seq", `{"type":"ack","version":1,"payload":{}}`, ErrCodeInvalidPayload},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env, in, perr := decodeFrame([]byte(tt.frame))
+			switch {
+			case tt.code == "" && perr != nil:
+				t.Fatalf("unexpected error %v", perr)
+			case tt.code == "" && (env == nil || in == nil):
+				t.Fatal("valid frame decoded without an envelope or payload")
+			case tt.code != "" && perr == nil:
+				t.Fatalf("accepted, want %s", tt.code)
+			case tt.code != "" && perr.Code != tt.code:
+				t.Fatalf("error %v, want %s", perr, tt.code)
+			}
+		})
+	}
+}
+
+func TestDecodeFrameKeepsEnvelopeForErrors(t *testing.T) {
+	env, _, perr := decodeFrame([]byte(`{"type":"shout","id":"abc","version":1}`))
+	if perr == nil || env == nil || env.ID != "abc" {
+		t.Fatalf("got envelope %+v and error %v, want the envelope with id abc and an error", env, perr)
+	}
+}
+
+func TestRecentFramesRememberOnlyFramesThatWentThrough(t *testing.T) {
+	recent := newRecentFrames()
+
+	if !recent.claim("alice", "1") {
+		t.Fatal("first claim of a frame failed")
+	}
+	if recent.claim("alice", "1") {
+		t.Error("frame was claimed again while being handled")
+	}
+	if !recent.claim("bob", "1") {
+		t.Error("another user's frame with the same id was rejected")
+	}
+
+	recent.finish("alice", "1", false)
+	if !recent.claim("alice", "1") {
+		t.Fatal("failed frame could not be retried")
+	}
+	recent.finish("alice", "1", true)
+	if recent.claim("alice", "1") {
+		t.Error("frame that went through was handled again")
+	}
+}
+
+func TestErrorFromHidesStorageErrors(t *testing.T) {
+	tests := []struct {
+		err  error
+		code string
+	}{
+		{db.ErrMessageNotFound, ErrCodeNotFound},
+		{db.ErrChannelNotFound, ErrCodeNotFound},
+		{db.ErrNotMessageAuthor, ErrCodeForbidden},
+		{db.ErrChannelArchived, ErrCodeForbidden},
+		{errors.New("pq: connection refused"), ErrCodeInternal},
+	}
+	for _, tt := range tests {
+		perr := errorFrom(tt.err)
+		if perr.Code != tt.code {
+			t.Errorf("%v: got code %s, want %s", tt.err, perr.Code, tt.code)
+		}
+		if tt.code == ErrCodeInternal && perr.Reason == tt.err.Error() {
+			t.Errorf("%v: reason leaks the storage error", tt.err)
+		}
+	}
+}
+
+func TestAccessErrorHidesPrivateChannels(t *testing.T) {
+	missing := accessError(db.ErrChannelNotFound)
+	private := accessError(db.ErrNotChannelMember)
+	if *private != *missing {
+		t.Errorf("private channel gave %+v, missing channel %+v", private, missing)
+	}
+	if missing.Code != ErrCodeNotFound {
+		t.Errorf("got code %s, want %s", missing.Code, ErrCodeNotFound)
+	}
+}
+
+// sendFrame writes a raw client frame
+func sendFrame(t *testing.T, conn *websocket.Conn, frame string) {
+	t.Helper()
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(frame)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// nextOf reads frames until one of the given type arrives
+func nextOf(t *testing.T, conn *websocket.Conn, msgType string) (*Envelope, *Message) {
+	t.Helper()
+	for {
+		env, m, err := readFrame(conn)
+		if err != nil {
+			t.Fatalf("waiting for %s: %v", msgType, err)
+		}
+		if env.Type == msgType {
+			return env, m
+		}
+	}
+}
+
+func TestProtocolErrorFrames(t *testing.T) {
+	srv := startServer(t, HubConfig{QueueSize: 16, Policy: PolicyDisconnect}, limits(time.Minute))
+	conn := srv.dial(t, "alice", "/ws/joinRoom/general")
+	srv.waitForClients(t, "general", 1)
+
+	tests := []struct {
+		frame string
+		id    string
+		code  string
+	}{
+		{`not json`, "", ErrCodeInvalidFrame},
+		{`{"type":"message","id":"v2","version":2,"payload":{"content":"hi"}}`, "v2", ErrCodeUnsupportedVersion},
+		{`{"type":"shout","id":"u1","version":1}`, "u1", ErrCodeUnknownType},
+		{`{"type":"edit","id":"e1","version":1,"payload":{"message_id":1}}`, "e1", ErrCodeInvalidPayload},
+		{`{"type":"message","id":"s1","version":1,"payload":{"channel_id":"random","content":"hi"}}`, "s1", ErrCodeNotSubscribed},
+	}
+	for _, tt := range tests {
+		sendFrame(t, conn, tt.frame)
+		env, m := nextOf(t, conn, MessageTypeError)
+		if env.ID != tt.id || m.Code != tt.code || m.Content == "" {
+			t.Errorf("%s: got error frame id %q code %q reason %q, want id %q code %q and a reason",
+				tt.frame, env.ID, m.Code, m.Content, tt.id, tt.code)
+		}
+	}
+}
+
+func TestFailedSaveIsReportedAndNotBroadcast(t *testing.T) {
+	srv := startServer(t, HubConfig{QueueSize: 16, Policy: PolicyDisconnect}, limits(time.Minute))
+	repo := srv.hub.db.(*fakeRepo)
+	observer := register(srv.hub, "observer", "general")
+	conn := srv.dial(t, "alice", "/ws/joinRoom/general")
+	srv.waitForClients(t, "general", 2)
+
+	repo.mu.Lock()
+	repo.saveErr = errors.New("database is down")
+	repo.mu.Unlock()
+
+	frame := `{"type":"message","id":"m1","version":1,"payload":{"content":"hello"}}`
+	sendFrame(t, conn, frame)
+	env, m := nextOf(t, conn, MessageTypeError)
+	if env.ID != "m1" || m.Code != ErrCodeInternal {
+		t.Errorf("got error frame id %q code %q, want m1 and %s", env.ID, m.Code, ErrCodeInternal)
+	}
+	if m.Content == "database is down" {
+		t.Error("error frame leaked the storage error")
+	}
+
+	// A failed frame can be retried with the same id once saving works again
+	repo.mu.Lock()
+	repo.saveErr = nil
+	repo.mu.Unlock()
+	sendFrame(t, conn, frame)
+	if got := nextChat(t, observer); got.Content != "hello" || got.ID != 1 {
+		t.Errorf("room got %+v, want the saved message", got)
+	}
+	if _, m := nextOf(t, conn, MessageTypeChat); m.ID != 1 {
+		t.Errorf("sender got message %d, want 1", m.ID)
+	}
+
+	// Resending it now is a duplicate and is not saved or broadcast again
+	sendFrame(t, conn, frame)
+	env, m = nextOf(t, conn, MessageTypeError)
+	if env.ID != "m1" || m.Code != ErrCodeDuplicate {
+		t.Errorf("got error frame id %q code %q, want m1 and %s", env.ID, m.Code, ErrCodeDuplicate)
+	}
+	settle(srv.hub)
+	for len(observer.Message) > 0 {
+		if m := next(t, observer); m.Type == MessageTypeChat {
+			t.Errorf("room got %+v after a failed or duplicate frame", m)
+		}
+	}
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	if len(repo.messages) != 1 {
+		t.Errorf("%d messages saved, want 1", len(repo.messages))
+	}
+}
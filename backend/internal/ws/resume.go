@@ -0,0 +1,122 @@
+package ws
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/goyalg325/whiz/backend/internal/db"
+)
+
+const (
+	// MessageTypeResync tells a resuming client it is too far behind to replay and must reload history
+	MessageTypeResync = "resync"
+	// MessageTypeAck is sent by a client to confirm it has received a room's events up to a sequence number
+	MessageTypeAck = "ack"
+)
+
+// resumeAcked is passed instead of a sequence number to resume a room from
+// the last event the user acknowledged, e.g. after a page reload lost the
+// client's own position
+const resumeAcked = "acked"
+
+// sequenced reports whether a message changes room state and so belongs in
+// the room's event log. Typing, presence and join/leave notices are not
+// worth replaying. Renames and deletions are not replayable either: both
+// happen after the room's name stops resolving to its log, so a client that
+// missed one finds the old name gone when it resumes, and clients moved to
+// a renamed room are told to resync instead.
+func sequenced(m *Message) bool {
+	switch m.Type {
+	case MessageTypeChat, MessageTypeReply, MessageTypeEdit, MessageTypeDelete, MessageTypeReactions,
+		MessageTypeMemberJoined, MessageTypeMemberRemoved,
+		MessageTypeChannelTopic, MessageTypeChannelArchived, MessageTypeChannelUnarchived:
+		return m.RoomID != ""
+	}
+	return false
+}
+
+// sequence appends a message to its room's event log and stamps it with
+// the room's next sequence number. On failure the message is still
+// broadcast, just without a sequence number.
+func (h *Hub) sequence(m *Message) {
+	payload, err := json.Marshal(m)
+	if err != nil {
+		log.Printf("Error encoding event for room %s: %v", m.RoomID, err)
+		return
+	}
+
+	seq, err := h.db.AppendRoomEvent(m.RoomID, payload)
+	if err != nil {
+		log.Printf("Broadcasting unsequenced event to room %s: %v", m.RoomID, err)
+		return
+	}
+	m.Seq = seq
+}
+
+// replay writes every event the client missed in a room after afterSeq
+// straight to the socket. It runs after the client is subscribed, so the
+// hub is already holding anything newer, and before the writer starts, so
+// nothing else is writing.
+func (c *Client) replay(database db.Repository, room string, afterSeq int64) error {
+	events, err := database.GetRoomEvents(room, afterSeq, db.MaxReplayEvents+1)
+	// The log is trimmed to the replay window, so a client further behind
+	// finds its next event already gone
+	trimmed := len(events) > 0 && events[0].Seq != afterSeq+1
+	// A cursor past the room's last event is stale or made up; waiting for
+	// that sequence number would leave the client stuck
+	ahead := false
+	if err == nil && len(events) == 0 {
+		var lastSeq int64
+		lastSeq, err = database.GetLastSeq(room)
+		ahead = afterSeq > lastSeq
+	}
+	if err != nil || trimmed || ahead || len(events) > db.MaxReplayEvents {
+		// Either way the gap cannot be filled from the log, so the client reloads history
+		log.Printf("Cannot replay room %s to client %s from %d, asking it to resync: %v",
+			room, c.ID, afterSeq, err)
+		return c.writeNow(&Message{
+			Type:      MessageTypeResync,
+			RoomID:    room,
+			Timestamp: time.Now().Format(time.RFC3339),
+			IsSystem:  true,
+		})
+	}
+
+	for _, e := range events {
+		var m Message
+		if err := json.Unmarshal(e.Payload, &m); err != nil {
+			log.Printf("Skipping unreadable event %d in room %s: %v", e.Seq, room, err)
+			continue
+		}
+		m.Seq = e.Seq
+		if err := c.writeNow(&m); err != nil {
+			return err
+		}
+		c.replayedThrough[room] = e.Seq
+	}
+
+	log.Printf("Replayed %d events to client %s in room %s", len(events), c.ID, room)
+	return nil
+}
+
+// write sends a live message unless replay already sent it
+func (c *Client) write(m *Message) error {
+	if m.Seq != 0 && m.Seq <= c.replayedThrough[m.RoomID] {
+		return nil
+	}
+	return c.writeNow(m)
+}
+
+// writeNow writes a message directly, bypassing the send queue
+func (c *Client) writeNow(m *Message) error {
+	frame, err := encodeFrame(m)
+	if err != nil {
+		log.Printf("Error encoding %s frame for client %s: %v", m.Type, c.ID, err)
+		return nil
+	}
+
+	c.Conn.SetWriteDeadline(time.Now().Add(c.limits.WriteTimeout))
+	return c.Conn.WriteMessage(websocket.TextMessage, frame)
+}
@@ -0,0 +1,58 @@
+package ws
+
+import (
+	"log"
+	"time"
+
+	"github.com/goyalg325/whiz/backend/internal/db"
+)
+
+// subscribe adds a room the user may read to the connection and confirms it to the client
+func (c *Client) subscribe(hub *Hub, database db.Repository, room string) {
+	if err := database.CheckChannelAccess(room, c.Username); err != nil {
+		c.sendError(hub, room, accessError(err))
+		return
+	}
+	if !hub.Subscribe(c, room) {
+		return
+	}
+	log.Printf("Client %s subscribed to room %s", c.ID, room)
+	c.confirm(hub, MessageTypeSubscribed, room)
+}
+
+// unsubscribe removes a room from the connection and confirms it to the client
+func (c *Client) unsubscribe(hub *Hub, room string) {
+	hub.Unsubscribe(c, room)
+	log.Printf("Client %s unsubscribed from room %s", c.ID, room)
+	c.confirm(hub, MessageTypeUnsubscribed, room)
+}
+
+func (c *Client) confirm(hub *Hub, msgType, room string) {
+	hub.Send(c, &Message{
+		Type:      msgType,
+		RoomID:    room,
+		Username:  c.Username,
+		Timestamp: time.Now().Format(time.RFC3339),
+		IsSystem:  true,
+		FrameID:   c.frameID,
+	})
+}
+
+// frameRoom picks the room a frame is for: its channel_id, or the room the
+// connection was opened for. The connection must still be subscribed to it;
+// the hub drops subscriptions when a member is removed from a channel.
+func (c *Client) frameRoom(hub *Hub, channelID string) (string, bool) {
+	room := channelID
+	if room == "" {
+		room = c.RoomID
+	}
+	if room == "" {
+		c.sendError(hub, "", protocolError(ErrCodeInvalidPayload, "channel_id is required on a multi-room connection"))
+		return "", false
+	}
+	if !hub.Subscribed(c, room) {
+		c.sendError(hub, room, protocolError(ErrCodeNotSubscribed, "not subscribed to %s", room))
+		return "", false
+	}
+	return room, true
+}
@@ -1,31 +1,58 @@
 package ws
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
+	"github.com/goyalg325/whiz/backend/internal/auth"
 	"github.com/goyalg325/whiz/backend/internal/db"
 )
 
 type Handler struct {
-	hub *Hub
-	db  *db.Database
+	hub      *Hub
+	db       db.Repository
+	presence *Presence
+	limits   ConnConfig
+	recent   *recentFrames
+	// sessions is asked on every ping whether a connection's login is still valid
+	sessions auth.RevocationChecker
 }
 
-func NewHandler(h *Hub, database *db.Database) *Handler {
+func NewHandler(h *Hub, database db.Repository, limits ConnConfig, sessions auth.RevocationChecker) *Handler {
+	presence := NewPresence(h, database)
+	go presence.Run()
+
 	return &Handler{
-		hub: h,
-		db:  database,
+		hub:      h,
+		db:       database,
+		presence: presence,
+		limits:   limits,
+		recent:   newRecentFrames(),
+		sessions: sessions,
 	}
 }
 
 type CreateRoomReq struct {
 	Name        string `json:"name"`
 	Description string `json:"description"`
+	// IsPrivate channels can only be read by their members
+	IsPrivate bool `json:"isPrivate"`
 }
 
 func (h *Handler) CreateRoom(c *gin.Context) {
+	claims, ok := auth.GetClaims(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
 	var req CreateRoomReq
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -33,24 +60,30 @@ func (h *Handler) CreateRoom(c *gin.Context) {
 	}
 
 	// Create the channel in the database
-	channelId, err := h.db.CreateChannel(req.Name, req.Description)
-	if err != nil {
+	channelId, err := h.db.CreateChannel(req.Name, req.Description, claims.Username, req.IsPrivate)
+	switch err {
+	case nil:
+	case db.ErrInvalidChannelName:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case db.ErrChannelExists:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	default:
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create channel"})
 		return
 	}
 
 	// Also create the room in memory for WebSocket handling
-	h.hub.Rooms[req.Name] = &Room{
-		ID:      req.Name,
-		Name:    req.Name,
-		Clients: make(map[string]*Client),
-	}
+	h.hub.EnsureRoom(req.Name)
 
 	// Return the created channel info
 	response := map[string]interface{}{
 		"id":          channelId,
 		"name":        req.Name,
 		"description": req.Description,
+		"createdBy":   claims.Username,
+		"isPrivate":   req.IsPrivate,
 	}
 
 	c.JSON(http.StatusOK, response)
@@ -65,105 +98,300 @@ var upgrader = websocket.Upgrader{
 }
 
 func (h *Handler) JoinRoom(c *gin.Context) {
-	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	// The identity comes from the verified token, never from query parameters
+	claims, ok := auth.GetClaims(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
 		return
 	}
 
 	roomID := c.Param("roomId")
-	clientID := c.Query("userId")
-	username := c.Query("username")
+	if !h.authorizeRoom(c, roomID) {
+		return
+	}
 
-	cl := &Client{
-		Conn:     conn,
-		Message:  make(chan *Message, 10),
-		ID:       clientID,
-		RoomID:   roomID,
-		Username: username,
+	// A reconnecting client passes the last sequence number it saw, or
+	// "acked", to catch up on what it missed
+	resume := map[string]int64{}
+	if v := c.Query("resume"); v != "" {
+		seq, ok := h.resumePoint(c, claims.Username, roomID, v)
+		if !ok {
+			return
+		}
+		resume[roomID] = seq
+	}
+
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 
-	m := &Message{
+	cl := h.newClient(conn, claims, roomID)
+
+	h.hub.Register <- cl
+	h.hub.Broadcast <- &Message{
 		Content:  "A new user has joined the room",
 		RoomID:   roomID,
-		Username: username,
+		Username: cl.Username,
 		IsSystem: true,
 	}
 
+	h.serve(cl, resume)
+}
+
+// Connect opens a multiplexed connection that can follow many rooms at
+// once. Initial rooms come from ?rooms=a,b; ?resume=a:12,b:acked subscribes
+// to those rooms too and replays what was missed after each sequence number
+// or the last one the user acknowledged.
+// Further rooms are added and removed with subscribe/unsubscribe frames and
+// every frame names its room, both ways.
+func (h *Handler) Connect(c *gin.Context) {
+	claims, ok := auth.GetClaims(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	resumeFrom := map[string]string{}
+	if v := c.Query("resume"); v != "" {
+		for _, entry := range strings.Split(v, ",") {
+			i := strings.LastIndex(entry, ":")
+			if i <= 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid resume entry " + entry})
+				return
+			}
+			resumeFrom[entry[:i]] = entry[i+1:]
+		}
+	}
+
+	rooms := make(map[string]bool)
+	for _, room := range strings.Split(c.Query("rooms"), ",") {
+		if room = strings.TrimSpace(room); room != "" {
+			rooms[room] = true
+		}
+	}
+	for room := range resumeFrom {
+		rooms[room] = true
+	}
+	for room := range rooms {
+		if !h.authorizeRoom(c, room) {
+			return
+		}
+	}
+
+	resume := map[string]int64{}
+	for room, v := range resumeFrom {
+		seq, ok := h.resumePoint(c, claims.Username, room, v)
+		if !ok {
+			return
+		}
+		resume[room] = seq
+	}
+
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	cl := h.newClient(conn, claims, "")
 	h.hub.Register <- cl
-	h.hub.Broadcast <- m
+	for room := range rooms {
+		h.hub.Subscribe(cl, room)
+	}
+
+	h.serve(cl, resume)
+}
+
+// resumePoint reads where a client wants to resume a room: a sequence
+// number, or "acked" for the last event the user acknowledged there. It
+// responds with an error and returns false if that cannot be worked out.
+func (h *Handler) resumePoint(c *gin.Context, username, room, v string) (int64, bool) {
+	if v == resumeAcked {
+		seq, err := h.db.GetAckedSeq(username, room)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up acknowledged events"})
+			return 0, false
+		}
+		return seq, true
+	}
+
+	seq, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || seq < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid resume sequence for " + room})
+		return 0, false
+	}
+	return seq, true
+}
+
+// newClient wraps an upgraded socket. A user may have the same room open
+// more than once, so every connection gets its own ID.
+func (h *Handler) newClient(conn *websocket.Conn, claims *auth.Claims, roomID string) *Client {
+	cl := &Client{
+		Conn:            conn,
+		Message:         h.hub.NewClientQueue(),
+		ID:              claims.ID + "-" + randomSuffix(),
+		RoomID:          roomID,
+		Username:        claims.Username,
+		replayedThrough: make(map[string]int64),
+		limits:          h.limits,
+		sessionID:       claims.SessionID,
+		sessions:        h.sessions,
+	}
+	return cl
+}
+
+// serve replays anything the client asked to resume, then runs the
+// connection until it closes. The client must already be registered, so
+// the hub holds its live messages until replay is done and they are
+// written after it, however long replay takes.
+func (h *Handler) serve(cl *Client, resume map[string]int64) {
+	h.presence.Connect(cl.ID, cl.Username)
+
+	for room, seq := range resume {
+		if seq == 0 {
+			continue
+		}
+		if err := cl.replay(h.db, room, seq); err != nil {
+			log.Printf("Error replaying room %s to client %s: %v", room, cl.ID, err)
+		}
+	}
+
+	// Catch up on what arrived during replay until nothing is left, then
+	// hand over to the writer and the send queue
+	for done := false; !done; {
+		var held []*Message
+		held, done = h.hub.Release(cl)
+		for _, m := range held {
+			if err := cl.write(m); err != nil {
+				log.Printf("Error writing to client %s: %v", cl.ID, err)
+				break
+			}
+		}
+	}
 
 	go cl.writeMessage()
-	cl.readMessage(h.hub, h.db)
+	cl.readMessage(h.hub, h.db, h.presence, h.recent)
 }
 
 type RoomRes struct {
 	ID          int    `json:"id"`
 	Name        string `json:"name"`
 	Description string `json:"description"`
+	IsPrivate   bool   `json:"isPrivate"`
+	Topic       string `json:"topic"`
+	IsArchived  bool   `json:"isArchived"`
 }
 
 func (h *Handler) GetRooms(c *gin.Context) {
+	claims, ok := auth.GetClaims(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
 	// Get channels from database instead of in-memory map
-	channelsData, err := h.db.GetAllChannels()
+	channels, err := h.db.GetAllChannels(claims.Username)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch channels"})
 		return
 	}
 
 	rooms := make([]RoomRes, 0)
+	names := make([]string, 0, len(channels))
 
-	for _, channelData := range channelsData {
-		// Ensure in-memory room exists for WebSocket handling
-		name := channelData["name"].(string)
-		if _, exists := h.hub.Rooms[name]; !exists {
-			h.hub.Rooms[name] = &Room{
-				ID:      name,
-				Name:    name,
-				Clients: make(map[string]*Client),
-			}
-		}
+	for _, channel := range channels {
+		names = append(names, channel.Name)
 
 		room := RoomRes{
-			ID:          channelData["id"].(int),
-			Name:        name,
-			Description: channelData["description"].(string),
+			ID:          channel.ID,
+			Name:        channel.Name,
+			Description: channel.Description,
+			IsPrivate:   channel.IsPrivate,
+			Topic:       channel.Topic,
+			IsArchived:  channel.ArchivedAt != nil,
 		}
 		rooms = append(rooms, room)
 	}
 
-	c.JSON(http.StatusOK, rooms)
-}
+	// Ensure in-memory rooms exist for WebSocket handling
+	h.hub.EnsureRooms(names)
 
-type ClientRes struct {
-	ID       string `json:"id"`
-	Username string `json:"username"`
+	c.JSON(http.StatusOK, rooms)
 }
 
-func (h *Handler) GetClients(c *gin.Context) {
-	var clients []ClientRes
-	roomId := c.Param("roomId")
+// maxPresenceUsers caps how many users one presence request may ask about
+const maxPresenceUsers = 100
 
-	if _, ok := h.hub.Rooms[roomId]; !ok {
-		clients = make([]ClientRes, 0)
-		c.JSON(http.StatusOK, clients)
+// GetPresence returns the online/away/offline status of users. With ?room=
+// it reports the users connected to that room and with ?users=a,b the named
+// users; one of them is required.
+func (h *Handler) GetPresence(c *gin.Context) {
+	var usernames []string
+	if roomId := c.Query("room"); roomId != "" {
+		if !h.authorizeRoom(c, roomId) {
+			return
+		}
+		usernames = make([]string, 0)
+		seen := make(map[string]bool)
+		for _, cl := range h.hub.ListClients(roomId) {
+			if !seen[cl.Username] {
+				seen[cl.Username] = true
+				usernames = append(usernames, cl.Username)
+			}
+		}
+		if len(usernames) == 0 {
+			c.JSON(http.StatusOK, []db.Presence{})
+			return
+		}
+	} else if users := c.Query("users"); users != "" {
+		usernames = strings.Split(users, ",")
+		if len(usernames) > maxPresenceUsers {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "At most " + strconv.Itoa(maxPresenceUsers) + " users can be looked up at once"})
+			return
+		}
+	} else {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "room or users is required"})
+		return
 	}
 
-	for _, c := range h.hub.Rooms[roomId].Clients {
-		clients = append(clients, ClientRes{
-			ID:       c.ID,
-			Username: c.Username,
-		})
+	presence, err := h.db.GetPresence(usernames)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve presence"})
+		return
 	}
 
-	c.JSON(http.StatusOK, clients)
+	c.JSON(http.StatusOK, presence)
 }
 
-// GetRoomMessages returns the message history for a specific room
+// GetRoomMessages returns one page of message history for a specific room.
+// The optional before, after and limit query parameters select the page.
 func (h *Handler) GetRoomMessages(c *gin.Context) {
 	roomId := c.Param("roomId")
+	if !h.authorizeRoom(c, roomId) {
+		return
+	}
+
+	var page db.PageRequest
+	for name, dest := range map[string]*int{"before": &page.Before, "after": &page.After, "limit": &page.Limit} {
+		v := c.Query(name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + name + " parameter"})
+			return
+		}
+		*dest = n
+	}
+	if page.Before != 0 && page.After != 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "before and after cannot be combined"})
+		return
+	}
 
-	messages, err := h.db.GetRoomMessages(roomId)
+	messages, err := h.db.GetRoomMessages(roomId, page)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve messages"})
 		return
@@ -171,3 +399,64 @@ func (h *Handler) GetRoomMessages(c *gin.Context) {
 
 	c.JSON(http.StatusOK, messages)
 }
+
+// GetReplies returns a message and the replies in its thread
+func (h *Handler) GetReplies(c *gin.Context) {
+	messageId, err := strconv.Atoi(c.Param("messageId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+		return
+	}
+
+	parent, err := h.db.GetMessage(messageId)
+	if err == db.ErrMessageNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve message"})
+		return
+	}
+	if !h.authorizeRoom(c, parent.RoomID) {
+		return
+	}
+
+	replies, err := h.db.GetReplies(messageId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve replies"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"parent":  parent,
+		"replies": replies,
+	})
+}
+
+// authorizeRoom responds with an error and returns false unless the
+// authenticated user may read the room
+func (h *Handler) authorizeRoom(c *gin.Context, room string) bool {
+	claims, ok := auth.GetClaims(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return false
+	}
+
+	switch err := h.db.CheckChannelAccess(room, claims.Username); err {
+	case nil:
+		return true
+	case db.ErrChannelNotFound, db.ErrNotChannelMember:
+		// Non-members cannot tell a private channel from one that does not exist
+		c.JSON(http.StatusNotFound, gin.H{"error": "Channel not found"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check channel access"})
+	}
+	return false
+}
+
+func randomSuffix() string {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
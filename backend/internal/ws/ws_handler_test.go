@@ -0,0 +1,52 @@
+package ws
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/goyalg325/whiz/backend/internal/db"
+)
+
+func TestGetRoomMessagesValidatesCursors(t *testing.T) {
+	srv := startServer(t, HubConfig{QueueSize: 8, Policy: PolicyDisconnect}, limits(time.Minute))
+	repo := srv.hub.db.(*fakeRepo)
+
+	tests := []struct {
+		query  string
+		status int
+		page   db.PageRequest
+	}{
+		{"", http.StatusOK, db.PageRequest{}},
+		{"?before=42&limit=10", http.StatusOK, db.PageRequest{Before: 42, Limit: 10}},
+		{"?after=42", http.StatusOK, db.PageRequest{After: 42}},
+		{"?before=abc", http.StatusBadRequest, db.PageRequest{}},
+		{"?after=-1", http.StatusBadRequest, db.PageRequest{}},
+		{"?before=1.5", http.StatusBadRequest, db.PageRequest{}},
+		{"?after=99999999999999999999", http.StatusBadRequest, db.PageRequest{}},
+		{"?limit=ten", http.StatusBadRequest, db.PageRequest{}},
+		{"?before=5&after=2", http.StatusBadRequest, db.PageRequest{}},
+	}
+
+	for _, tt := range tests {
+		repo.mu.Lock()
+		repo.pages = nil
+		repo.mu.Unlock()
+
+		resp := srv.get(t, "alice", "/ws/getMessages/general"+tt.query)
+		if resp.StatusCode != tt.status {
+			t.Errorf("%q: status %d, want %d", tt.query, resp.StatusCode, tt.status)
+			continue
+		}
+
+		repo.mu.Lock()
+		pages := repo.pages
+		repo.mu.Unlock()
+		switch {
+		case tt.status != http.StatusOK && len(pages) != 0:
+			t.Errorf("%q: rejected cursor still reached the database", tt.query)
+		case tt.status == http.StatusOK && (len(pages) != 1 || pages[0] != tt.page):
+			t.Errorf("%q: asked for %+v, want %+v", tt.query, pages, tt.page)
+		}
+	}
+}
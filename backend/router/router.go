@@ -1,9 +1,12 @@
 package router
 
 import (
+	"expvar"
+	"net/http"
 	"time"
 
 	"github.com/goyalg325/whiz/backend/internal/api"
+	"github.com/goyalg325/whiz/backend/internal/auth"
 	"github.com/goyalg325/whiz/backend/internal/user"
 	"github.com/goyalg325/whiz/backend/internal/ws"
 
@@ -13,13 +16,13 @@ import (
 
 var r *gin.Engine
 
-func InitRouter(userHandler *user.Handler, wsHandler *ws.Handler, aiHandler *api.AIHandler) {
+func InitRouter(keys *auth.KeySet, sessions *auth.Sessions, userHandler *user.Handler, wsHandler *ws.Handler, channelHandler *api.ChannelHandler, dmHandler *api.DMHandler, searchHandler *api.SearchHandler, aiHandler *api.AIHandler) {
 	r = gin.Default()
 
 	r.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{"http://localhost:3000"},
-		AllowMethods:     []string{"GET", "POST"},
-		AllowHeaders:     []string{"Content-Type"},
+		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE"},
+		AllowHeaders:     []string{"Content-Type", "Authorization"},
 		ExposeHeaders:    []string{"Content-Length"},
 		AllowCredentials: true,
 		AllowOriginFunc: func(origin string) bool {
@@ -31,19 +34,68 @@ func InitRouter(userHandler *user.Handler, wsHandler *ws.Handler, aiHandler *api
 	r.POST("/signup", userHandler.CreateUser)
 	r.POST("/login", userHandler.Login)
 	r.GET("/logout", userHandler.Logout)
+	r.POST("/token/refresh", userHandler.Refresh)
+	r.GET("/.well-known/jwks.json", auth.JWKSHandler(keys))
 
-	r.POST("/ws/createRoom", wsHandler.CreateRoom)
-	r.GET("/ws/joinRoom/:roomId", wsHandler.JoinRoom)
-	r.GET("/ws/getRooms", wsHandler.GetRooms)
-	r.GET("/ws/getClients/:roomId", wsHandler.GetClients)
-	r.GET("/ws/getMessages/:roomId", wsHandler.GetRoomMessages)
+	// Everything below requires a valid access token
+	authed := r.Group("/", auth.Middleware(keys, sessions))
+
+	authed.POST("/logout/all", userHandler.LogoutAll)
+
+	authed.POST("/ws/createRoom", wsHandler.CreateRoom)
+	authed.GET("/ws/joinRoom/:roomId", wsHandler.JoinRoom)
+	authed.GET("/ws/connect", wsHandler.Connect)
+	authed.GET("/ws/getRooms", wsHandler.GetRooms)
+	authed.GET("/presence", wsHandler.GetPresence)
+	authed.GET("/ws/getMessages/:roomId", wsHandler.GetRoomMessages)
+	authed.GET("/messages/:messageId/replies", wsHandler.GetReplies)
+
+	// Channel membership
+	authed.POST("/channels/:channelName/join", channelHandler.JoinChannel)
+	authed.POST("/channels/:channelName/leave", channelHandler.LeaveChannel)
+	authed.GET("/channels/:channelName/members", channelHandler.ListMembers)
+	authed.PUT("/channels/:channelName/members/:username", channelHandler.SetMemberRole)
+	authed.DELETE("/channels/:channelName/members/:username", channelHandler.RemoveMember)
+	authed.POST("/channels/:channelName/invitations", channelHandler.InviteMember)
+	authed.POST("/channels/:channelName/invitations/accept", channelHandler.AcceptInvitation)
+	authed.POST("/channels/:channelName/invitations/decline", channelHandler.DeclineInvitation)
+	authed.GET("/channels/:channelName/requests", channelHandler.ListJoinRequests)
+	authed.POST("/channels/:channelName/requests/:username/approve", channelHandler.ApproveJoinRequest)
+	authed.POST("/channels/:channelName/requests/:username/reject", channelHandler.RejectJoinRequest)
+	authed.GET("/invitations", channelHandler.ListInvitations)
+
+	// Channel lifecycle
+	authed.PUT("/channels/:channelName/name", channelHandler.RenameChannel)
+	authed.PUT("/channels/:channelName/topic", channelHandler.SetTopic)
+	authed.POST("/channels/:channelName/archive", channelHandler.ArchiveChannel)
+	authed.POST("/channels/:channelName/unarchive", channelHandler.UnarchiveChannel)
+	authed.DELETE("/channels/:channelName", channelHandler.DeleteChannel)
+
+	// Direct messages
+	authed.POST("/dms", dmHandler.OpenDirectMessage)
+	authed.GET("/dms", dmHandler.ListDirectMessages)
+
+	authed.GET("/search", searchHandler.SearchMessages)
 
 	// AI endpoints
-	r.GET("/messages/:messageId/context", aiHandler.GetMessageContext)
-	r.GET("/summaries/missed/:username/:channelName", aiHandler.GetMissedMessagesSummary)
-	r.POST("/activity/:username/:channelName/:messageId", aiHandler.UpdateUserActivity)
+	authed.GET("/messages/:messageId/context", aiHandler.GetMessageContext)
+	authed.GET("/summaries/missed/:username/:channelName", aiHandler.GetMissedMessagesSummary)
+	// The same, streamed as server-sent events
+	authed.GET("/messages/:messageId/context/stream", aiHandler.StreamMessageContext)
+	authed.GET("/summaries/missed/:username/:channelName/stream", aiHandler.StreamMissedMessagesSummary)
+	authed.POST("/activity/:username/:channelName/:messageId", aiHandler.UpdateUserActivity)
 }
 
 func Start(addr string) error {
 	return r.Run(addr)
 }
+
+// StartDebug serves runtime and hub metrics (ws_messages_dropped,
+// ws_clients_evicted, ...) at /debug/vars. They are not on the public
+// router, so addr should only be reachable from inside the deployment,
+// e.g. 127.0.0.1:6060.
+func StartDebug(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	return http.ListenAndServe(addr, mux)
+}
@@ -1,7 +1,16 @@
-const API_BASE_URL = 'http://localhost:8080';
+import { API_BASE_URL } from '../config';
+
+// Exchange the refresh token cookie for a new access token
+export async function refreshSession() {
+  const response = await fetch(`${API_BASE_URL}/token/refresh`, {
+    method: 'POST',
+    credentials: 'include'
+  });
+  return response.ok;
+}
 
 // Generic fetch function with error handling
-async function fetchAPI(endpoint, options = {}) {
+async function fetchAPI(endpoint, options = {}, retried = false) {
   const url = `${API_BASE_URL}${endpoint}`;
   
   // Debug request body if it exists
@@ -18,6 +27,11 @@ async function fetchAPI(endpoint, options = {}) {
     credentials: 'include' // Important for cookies/sessions
   });
 
+  // Access tokens are short-lived, refresh once and retry
+  if (response.status === 401 && !retried && await refreshSession()) {
+    return fetchAPI(endpoint, options, true);
+  }
+
   if (!response.ok) {
     const errorText = await response.text();
     throw new Error(`API Error (${response.status}): ${errorText}`);
@@ -47,6 +61,12 @@ export async function logout() {
   });
 }
 
+export async function logoutAllDevices() {
+  return fetchAPI('/logout/all', {
+    method: 'POST',
+  });
+}
+
 // Room API endpoints (renamed from channels)
 export async function fetchRooms() {
   const rooms = await fetchAPI('/ws/getRooms');
@@ -69,17 +89,101 @@ export async function createRoom(roomData) {
   });
 }
 
+// Direct message API endpoints
+
+// Open (or reopen) the conversation with the given users. The returned id is
+// used as the roomId for sockets, history and activity like any channel.
+export async function openDirectMessage(participants) {
+  return fetchAPI('/dms', {
+    method: 'POST',
+    body: JSON.stringify({ participants }),
+  });
+}
+
+export async function fetchDirectMessages() {
+  return fetchAPI('/dms');
+}
+
 // Message API endpoints
+
+// Fetch one page of history. Pass page.prevCursor as `before` to load older
+// messages and page.nextCursor as `after` to load newer ones.
+export async function fetchRoomMessagesPage(roomId, { before, after, limit } = {}) {
+  const params = new URLSearchParams();
+  if (before) params.set('before', before);
+  if (after) params.set('after', after);
+  if (limit) params.set('limit', limit);
+  const query = params.toString() ? `?${params}` : '';
+  return fetchAPI(`/ws/getMessages/${roomId}${query}`);
+}
+
+// Fetch the most recent page of messages
 export async function fetchRoomMessages(roomId) {
-  const messages = await fetchAPI(`/ws/getMessages/${roomId}`);
-  console.log(`Fetched ${messages ? messages.length : 0} messages for room ${roomId}`);
-  return messages || [];
+  const page = await fetchRoomMessagesPage(roomId);
+  const messages = page?.messages || [];
+  console.log(`Fetched ${messages.length} messages for room ${roomId}`);
+  return messages;
+}
+
+// Full-text search over every channel the user can read. filters may set
+// channel, author, from, to, limit and offset; snippets come back as HTML
+// with matches wrapped in <mark>.
+export async function searchMessages(q, filters = {}) {
+  const params = new URLSearchParams({ q });
+  Object.entries(filters).forEach(([key, value]) => {
+    if (value) params.set(key, value);
+  });
+  return fetchAPI(`/search?${params}`);
+}
+
+export async function fetchReplies(messageId) {
+  return fetchAPI(`/messages/${messageId}/replies`);
+}
+
+// Presence of the users connected to a room
+export async function fetchRoomPresence(roomId) {
+  return fetchAPI(`/presence?room=${encodeURIComponent(roomId)}`);
 }
 
 export async function fetchMessageContext(messageId) {
   return fetchAPI(`/messages/${messageId}/context`);
 }
 
+// Stream an AI reply as it is generated. Handlers receive the meta event,
+// each chunk of text, and finally done or error. meta.cached is true when a
+// stored reply is replayed; meta.generatedAt says when it was written. The returned function
+// closes the stream, which also stops generation on the server.
+function streamAI(endpoint, { onMeta, onChunk, onDone, onError } = {}) {
+  const source = new EventSource(`${API_BASE_URL}${endpoint}`, { withCredentials: true });
+  let finished = false;
+  const finish = () => {
+    finished = true;
+    source.close();
+  };
+
+  source.addEventListener('meta', (event) => onMeta?.(JSON.parse(event.data)));
+  source.addEventListener('chunk', (event) => onChunk?.(JSON.parse(event.data).text));
+  source.addEventListener('done', () => {
+    finish();
+    onDone?.();
+  });
+  source.addEventListener('error', (event) => {
+    if (finished) return;
+    finish();
+    onError?.(event.data ? JSON.parse(event.data).error : 'Connection lost');
+  });
+
+  return finish;
+}
+
+export function streamMessageContext(messageId, handlers) {
+  return streamAI(`/messages/${messageId}/context/stream`, handlers);
+}
+
+export function streamMissedMessagesSummary(username, channelName, handlers) {
+  return streamAI(`/summaries/missed/${username}/${channelName}/stream`, handlers);
+}
+
 export async function fetchMissedMessagesSummary(username, channelName) {
   return fetchAPI(`/summaries/missed/${username}/${channelName}`);
 }
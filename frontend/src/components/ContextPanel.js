@@ -1,35 +1,41 @@
 import React, { useState, useEffect } from 'react';
-import { fetchMessageContext } from '../api/client';
+import { streamMessageContext } from '../api/client';
 
 function ContextPanel({ message, onClose }) {
   const [context, setContext] = useState("");
   const [loading, setLoading] = useState(false);
   const [error, setError] = useState(null);
+  const [meta, setMeta] = useState(null);
 
   useEffect(() => {
-    const loadContext = async () => {
-      if (!message?.id) {
-        setError('Message information not available');
-        return;
-      }
+    if (!message?.id) {
+      setError('Message information not available');
+      return;
+    }
 
-      setLoading(true);
-      setError(null);
+    setLoading(true);
+    setError(null);
+    setContext("");
+    setMeta(null);
 
-      try {
-        const contextData = await fetchMessageContext(message.id);
-        setContext(contextData.context || contextData);
-      } catch (err) {
-        console.error('Failed to fetch context:', err);
+    // The context appears as the model writes it; closing the panel stops generation
+    const close = streamMessageContext(message.id, {
+      onMeta: setMeta,
+      onChunk: (text) => {
+        setLoading(false);
+        setContext(prev => prev + text);
+      },
+      onDone: () => setLoading(false),
+      onError: (err) => {
+        console.error('Failed to stream context:', err);
+        setLoading(false);
         setError('Failed to load context. Please try again.');
         // Fallback to placeholder
-        setContext("Unable to load AI context at this time. This feature analyzes the message and provides relevant background from the conversation.");
-      } finally {
-        setLoading(false);
-      }
-    };
+        setContext(prev => prev || "Unable to load AI context at this time. This feature analyzes the message and provides relevant background from the conversation.");
+      },
+    });
 
-    loadContext();
+    return close;
   }, [message?.id]);
 
   return (
@@ -81,7 +87,9 @@ function ContextPanel({ message, onClose }) {
                 </svg>
                 AI Context Analysis
               </h3>
-              <span className="text-xs text-gray-400">Powered by Gemini</span>
+              <span className="text-xs text-gray-400">
+                {meta?.cached ? `Saved ${new Date(meta.generatedAt).toLocaleString()}` : 'Powered by Gemini'}
+              </span>
             </div>
             
             <div className="bg-white border border-gray-200 rounded-lg shadow-sm overflow-hidden">
@@ -71,6 +71,11 @@ function SummaryPanel({ type, roomId, username, onClose }) {
           <div className="prose prose-sm max-w-none">
             <p className="text-gray-700 whitespace-pre-wrap leading-relaxed">{summary}</p>
           </div>
+          {summaryData.truncated && (
+            <p className="text-xs text-gray-500 italic mt-3">
+              The {summaryData.omittedCount} oldest messages were too many to include in this summary.
+            </p>
+          )}
         </div>
 
         {summaryData.messages && summaryData.messages.length > 0 && (
@@ -0,0 +1,5 @@
+// Backend addresses, overridable at build time through the environment
+export const API_BASE_URL = process.env.REACT_APP_API_URL || 'http://localhost:8080';
+
+// The WebSocket endpoints live on the same server unless configured otherwise
+export const WS_BASE_URL = process.env.REACT_APP_WS_URL || API_BASE_URL.replace(/^http/, 'ws');
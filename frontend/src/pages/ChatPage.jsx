@@ -23,10 +23,42 @@ function ChatPage({
   const [isConnected, setIsConnected] = useState(false);
   const [replyToMessage, setReplyToMessage] = useState(null);
 
-  // Initialize socket connection when room changes
+  // One multiplexed socket serves every room for as long as the user is logged in
   useEffect(() => {
-    if (!activeRoom || !user) {
-      console.log("Missing activeRoom or user, not connecting socket");
+    if (!user) {
+      return;
+    }
+
+    const client = new SocketClient(user.username);
+    client.onConnect(() => setIsConnected(true));
+    client.onDisconnect(() => setIsConnected(false));
+    client.connect();
+    setSocketClient(client);
+
+    return () => {
+      client.disconnect();
+      setSocketClient(null);
+      setIsConnected(false);
+    };
+  }, [user]);
+
+  // Follow every room in the sidebar on that socket, and stop following
+  // rooms that left it unless they are still open
+  useEffect(() => {
+    if (!socketClient) {
+      return;
+    }
+    const names = new Set((rooms || []).map(room => room.name));
+    names.forEach(name => socketClient.subscribe(name));
+    [...socketClient.rooms].forEach(name => {
+      if (!names.has(name) && name !== activeRoom?.name) socketClient.unsubscribe(name);
+    });
+  }, [socketClient, rooms, activeRoom]);
+
+  // Load the active room and show its live events
+  useEffect(() => {
+    if (!activeRoom || !user || !socketClient) {
+      console.log("Missing activeRoom, user or socket, not showing room");
       return;
     }
     
@@ -35,17 +67,12 @@ function ChatPage({
       console.error("Room ID or name is missing:", activeRoom);
       return;
     }
-    
-    // Clean up previous connection
-    if (socketClient) {
-      socketClient.disconnect();
-    }
 
     console.log("=== DEBUG ROOM INFO ===");
     console.log("Active Room:", JSON.stringify(activeRoom));
     console.log("activeRoom.id:", activeRoom.id, "Type:", typeof activeRoom.id);
     console.log("activeRoom.name:", activeRoom.name, "Type:", typeof activeRoom.name);
-    console.log("Using room name for WebSocket:", activeRoom.name);
+    console.log("Using room name for WebSocket frames:", activeRoom.name);
     console.log("========================");
     
     // Use room name for WebSocket connection and localStorage keys (not database ID)
@@ -126,24 +153,61 @@ function ChatPage({
     };
     
     loadMessages();
+    // A room opened before the sidebar listed it still needs following
+    socketClient.subscribe(roomName);
     
-    // Create new connection with room name (not database ID)
-    const client = new SocketClient(roomName, user.username);
-    
-    client.onConnect(() => {
-      setIsConnected(true);
-      console.log(`Connected to room: ${roomName}`);
-    });
-    
-    client.onDisconnect(() => {
-      setIsConnected(false);
-      console.log(`Disconnected from room: ${roomName}`);
-    });
-    
-    // This handler receives messages from all users via WebSocket
-    client.on((message) => {
+    // This handler receives every frame on the shared socket; only the
+    // active room's events (and connection-wide errors) concern it
+    const handleMessage = (message) => {
+      if (message.roomId && message.roomId !== roomName) {
+        return;
+      }
       console.log("Received message via WebSocket:", message);
-      
+
+      // Edits and deletes update the existing message in place
+      if (message.type === 'edit' || message.type === 'delete') {
+        setMessages(prevMessages => prevMessages.map(m => m.id === message.id ? { ...m, ...message } : m));
+        return;
+      }
+
+      // Replies live in their thread; the room timeline only shows the count
+      if (message.type === 'reply') {
+        setMessages(prevMessages => prevMessages.map(m => m.id === message.parentId ? { ...m, replyCount: (m.replyCount || 0) + 1 } : m));
+        return;
+      }
+
+      if (message.type === 'reactions') {
+        setMessages(prevMessages => prevMessages.map(m => m.id === message.id ? { ...m, reactions: message.reactions || [] } : m));
+        return;
+      }
+
+      // Ephemeral events and subscription confirmations are not chat messages
+      if (['typing_start', 'typing_stop', 'presence', 'subscribed', 'unsubscribed'].includes(message.type)) {
+        return;
+      }
+
+      if (message.type === 'error') {
+        console.error(`Server rejected frame ${message.frameId} (${message.code}):`, message.content);
+        return;
+      }
+
+      // Too much was missed while disconnected to replay, so reload history
+      if (message.type === 'resync') {
+        loadMessages();
+        return;
+      }
+
+      // The shared socket follows a renamed channel to its new name and
+      // drops a deleted one, so the page does the same
+      if (message.type === 'channel_renamed' && message.channel) {
+        onRoomSelect({ ...activeRoom, name: message.channel.name });
+        return;
+      }
+      if (message.type === 'channel_deleted') {
+        onRoomSelect(rooms.find(room => room.name !== roomName) || null);
+        return;
+      }
+
       // Check if this is a message from another user or our own
       const isFromCurrentUser = message.username === user.username;
       if (!isFromCurrentUser) {
@@ -217,15 +281,14 @@ function ChatPage({
         
         return updatedMessages;
       });
-    });
-    
-    client.connect();
-    setSocketClient(client);
+    };
+
+    socketClient.on(handleMessage);
     
     return () => {
-      client.disconnect();
+      socketClient.off(handleMessage);
     };
-  }, [activeRoom, user]);
+  }, [activeRoom, user, socketClient]);
 
   const handleSendMessage = (content) => {
     if (socketClient && isConnected) {
@@ -243,8 +306,10 @@ function ChatPage({
       
       console.log("Sending message:", messageData);
       
-      // Optimistic update - add message to UI immediately
-      setMessages(prevMessages => {
+      // Optimistic update - add message to UI immediately. Replies are not
+      // part of the timeline, the parent's reply count updates when it lands.
+      const isReply = typeof messageData.parentId === 'number';
+      if (!isReply) setMessages(prevMessages => {
         const updatedMessages = [...prevMessages, messageData];
         
         // Save to localStorage for persistence (with temp ID) - use room name
@@ -258,16 +323,11 @@ function ChatPage({
       });
       
       // Send message via WebSocket (without the temporary ID)
-      const serverMessage = {
+      // Replies to saved messages go into that message's thread
+      socketClient.send(isReply ? 'reply' : 'message', {
         content: messageData.content,
-        roomId: messageData.roomId, // This is now the room name
-        username: messageData.username,
-        parentId: messageData.parentId,
-        timestamp: messageData.timestamp
-        // Don't send the temporary ID to server
-      };
-      
-      socketClient.send(serverMessage);
+        parent_id: isReply ? messageData.parentId : undefined
+      }, activeRoom.name);
       
       // Clear reply state after sending
       if (replyToMessage) {
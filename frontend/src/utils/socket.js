@@ -1,29 +1,34 @@
+import { refreshSession } from '../api/client';
+import { WS_BASE_URL } from '../config';
+
+// Version of the WebSocket envelope this client speaks
+const PROTOCOL_VERSION = 1;
+
+// How long to wait before acknowledging the last event seen in a room, so
+// a burst of messages is acknowledged once
+const ACK_DELAY_MS = 1000;
+
+// SocketClient is the single multiplexed connection a logged-in user keeps
+// open. It follows any number of rooms: every frame names its room in
+// channel_id going out and roomId coming back.
 class SocketClient {
-  constructor(roomId, username) {
-    console.log("SocketClient constructor called with:", {
-      roomId: roomId,
-      roomIdType: typeof roomId,
-      username: username
-    });
-    
-    this.roomId = roomId;
+  constructor(username) {
+    // The server identifies the user from the auth cookie sent with the
+    // upgrade; the username only tells which membership changes are ours
     this.username = username;
-    
-    // Make sure roomId is defined and not empty
-    if (roomId && roomId !== 'undefined' && roomId !== 'null') {
-      // Include required query parameters for the WebSocket connection
-      const userId = username || 'anonymous'; // Fallback if username is not provided
-      
-      // The backend expects the URL format: /ws/joinRoom/:roomId with userId and username as query parameters
-      this.url = `ws://localhost:8080/ws/joinRoom/${roomId}?userId=${encodeURIComponent(userId)}&username=${encodeURIComponent(username)}`;
-      
-      console.log("WebSocket URL configured:", this.url);
-    } else {
-      console.error("Invalid roomId provided to SocketClient:", roomId);
-      this.url = null;
-    }
-    
+    this.url = `${WS_BASE_URL}/ws/connect`;
+
     this.socket = null;
+    // Rooms to follow, kept across reconnects
+    this.rooms = new Set();
+    // Highest sequence number seen per room, sent on reconnect so the server replays what was missed
+    this.lastSeq = {};
+    // Rooms with an acknowledgement waiting to be sent
+    this.pendingAcks = {};
+    // Rooms by the ID of the subscribe frame that asked for them, until the server answers
+    this.pendingSubscribes = {};
+    // Set by disconnect so a deliberate close does not reconnect
+    this.closed = false;
     this.messageHandlers = [];
     this.connectionHandlers = {
       onConnect: [],
@@ -31,30 +36,64 @@ class SocketClient {
     };
   }
 
-  connect() {
-    try {
-      // Check if we have a valid URL
-      if (!this.url) {
-        console.error("Cannot connect: WebSocket URL is not valid");
-        return;
+  // connectUrl subscribes to every followed room up front; rooms with a
+  // known position resume from it instead
+  connectUrl() {
+    const rooms = [];
+    const resume = [];
+    this.rooms.forEach(room => {
+      if (this.lastSeq[room] > 0) {
+        resume.push(`${encodeURIComponent(room)}:${this.lastSeq[room]}`);
+      } else {
+        rooms.push(encodeURIComponent(room));
       }
-      
-      console.log("Connecting to WebSocket at:", this.url);
-      console.log("Room ID:", this.roomId, "Type:", typeof this.roomId);
-      
-      // Create a WebSocket connection to our server
-      this.socket = new WebSocket(this.url);
+    });
+
+    const params = [];
+    if (rooms.length > 0) params.push(`rooms=${rooms.join(',')}`);
+    if (resume.length > 0) params.push(`resume=${resume.join(',')}`);
+    return params.length > 0 ? `${this.url}?${params.join('&')}` : this.url;
+  }
+
+  // connect opens the socket with every followed room in its URL. The
+  // server refuses the whole upgrade if one of them can no longer be read,
+  // so after a failed attempt the rooms are subscribed one by one instead;
+  // that loses their replay, and handlers are told to reload them.
+  connect(roomByRoom = false) {
+    this.closed = false;
+    try {
+      const url = roomByRoom ? this.url : this.connectUrl();
+      const joined = roomByRoom ? new Set() : new Set(this.rooms);
+      let opened = false;
+      console.log("Connecting to WebSocket at:", url);
+      this.socket = new WebSocket(url);
 
       this.socket.onopen = () => {
+        opened = true;
         console.log("WebSocket connection established to " + this.url);
+        // Rooms followed while the socket was opening were not in its URL
+        this.rooms.forEach(room => {
+          if (!joined.has(room)) this.subscribeFrame(room);
+        });
         this.connectionHandlers.onConnect.forEach(handler => handler());
+        if (roomByRoom) {
+          this.rooms.forEach(room => {
+            if (this.lastSeq[room] > 0) this.emit({ type: 'resync', roomId: room, isSystem: true });
+          });
+        }
       };
 
       this.socket.onclose = (event) => {
         console.log("WebSocket connection closed with code:", event.code, "reason:", event.reason);
         this.connectionHandlers.onDisconnect.forEach(handler => handler());
-        // Attempt to reconnect after 3 seconds
-        setTimeout(() => this.connect(), 3000);
+        if (this.closed) {
+          return;
+        }
+        // Attempt to reconnect after 3 seconds, refreshing the access token first
+        // in case it expired while the socket was open
+        setTimeout(() => refreshSession().finally(() => {
+          if (!this.closed) this.connect(!opened);
+        }), 3000);
       };
 
       this.socket.onerror = (error) => {
@@ -63,20 +102,16 @@ class SocketClient {
 
       this.socket.onmessage = (event) => {
         try {
-          // Parse the received message
-          const message = JSON.parse(event.data);
-          console.log("WebSocket message received:", message);
-          
-          // Ensure the message has a timestamp
-          if (!message.timestamp) {
-            message.timestamp = new Date().toISOString();
+          // Every frame is an envelope: { type, id, version, payload }
+          const frame = JSON.parse(event.data);
+          const message = { ...frame.payload, type: frame.type, frameId: frame.id };
+
+          if (message.seq && message.seq > (this.lastSeq[message.roomId] || 0)) {
+            this.lastSeq[message.roomId] = message.seq;
+            this.scheduleAck(message.roomId);
           }
-          
-          // Important: process the message regardless of who sent it
-          // This ensures we display messages from all users in the room
-          
-          // Notify all handlers about the new message
-          this.messageHandlers.forEach(handler => handler(message));
+          this.followRoomChange(message);
+          this.emit(message);
         } catch (error) {
           console.error("Error parsing message:", error);
         }
@@ -88,7 +123,101 @@ class SocketClient {
     }
   }
 
+  // emit passes a message to every handler; each picks the rooms it cares about
+  emit(message) {
+    // Ensure the message has a timestamp
+    if (!message.timestamp) {
+      message.timestamp = new Date().toISOString();
+    }
+    this.messageHandlers.forEach(handler => handler(message));
+  }
+
+  // followRoomChange keeps the followed rooms in step with renames, deletes,
+  // removals and refused subscriptions; the server changes the subscription
+  // on its side
+  followRoomChange(message) {
+    const subscribedRoom = this.pendingSubscribes[message.frameId];
+    if (subscribedRoom !== undefined) {
+      delete this.pendingSubscribes[message.frameId];
+      if (message.type === 'error') {
+        console.error(`Cannot follow room ${subscribedRoom}:`, message.content);
+        this.forget(subscribedRoom);
+      }
+      return;
+    }
+
+    // Leaving a public channel keeps read access, so only a private one is dropped
+    if (message.type === 'member_removed' && message.username === this.username) {
+      if (!message.channel || message.channel.isPrivate) this.forget(message.roomId);
+      return;
+    }
+
+    // The position could not be resumed from; the next live event sets a new one
+    if (message.type === 'resync') {
+      delete this.lastSeq[message.roomId];
+      return;
+    }
+
+    if (message.type === 'channel_renamed' && message.channel && this.rooms.has(message.roomId)) {
+      const newName = message.channel.name;
+      this.rooms.delete(message.roomId);
+      this.rooms.add(newName);
+      this.lastSeq[newName] = this.lastSeq[message.roomId];
+      delete this.lastSeq[message.roomId];
+    } else if (message.type === 'channel_deleted') {
+      this.forget(message.roomId);
+    }
+  }
+
+  forget(room) {
+    this.rooms.delete(room);
+    delete this.lastSeq[room];
+  }
+
+  // scheduleAck tells the server how far this client got in a room, so a
+  // reload can resume with resume=acked
+  scheduleAck(room) {
+    if (this.pendingAcks[room]) {
+      return;
+    }
+    this.pendingAcks[room] = setTimeout(() => {
+      delete this.pendingAcks[room];
+      if (this.lastSeq[room] > 0) {
+        this.send('ack', { seq: this.lastSeq[room] }, room);
+      }
+    }, ACK_DELAY_MS);
+  }
+
+  // subscribe starts following a room, now if connected and on every reconnect
+  subscribe(room) {
+    if (!room || this.rooms.has(room)) {
+      return;
+    }
+    this.rooms.add(room);
+    if (this.socket && this.socket.readyState === WebSocket.OPEN) {
+      this.subscribeFrame(room);
+    }
+  }
+
+  subscribeFrame(room) {
+    const id = this.send('subscribe', {}, room);
+    if (id) this.pendingSubscribes[id] = room;
+  }
+
+  unsubscribe(room) {
+    if (!this.rooms.has(room)) {
+      return;
+    }
+    this.forget(room);
+    if (this.socket && this.socket.readyState === WebSocket.OPEN) {
+      this.send('unsubscribe', {}, room);
+    }
+  }
+
   disconnect() {
+    this.closed = true;
+    Object.values(this.pendingAcks).forEach(clearTimeout);
+    this.pendingAcks = {};
     if (this.socket) {
       this.socket.close();
       this.socket = null;
@@ -117,25 +246,26 @@ class SocketClient {
     return this;
   }
 
-  send(message) {
+  // send wraps a payload for a room in a protocol envelope. The id lets the
+  // server drop the frame if it is ever resent and is echoed back on error frames.
+  send(type, payload = {}, room) {
     if (!this.socket || this.socket.readyState !== WebSocket.OPEN) {
       console.error("Cannot send message, socket is not open");
-      return;
+      return null;
     }
 
-    // Prepare the full message with all required fields
-    const fullMessage = {
-      ...message,
-      username: this.username,
-      roomId: this.roomId,
-      timestamp: message.timestamp || new Date().toISOString()
+    const frame = {
+      type,
+      id: `${Date.now()}-${Math.random().toString(36).substr(2, 9)}`,
+      version: PROTOCOL_VERSION,
+      payload: room ? { ...payload, channel_id: room } : payload
     };
 
-    console.log("Sending message through WebSocket:", fullMessage);
+    console.log("Sending frame through WebSocket:", frame);
 
-    // Send the message through WebSocket - this will broadcast to all users
-    // The backend will then broadcast this to all connected clients
-    this.socket.send(JSON.stringify(fullMessage));
+    // The backend saves the message and broadcasts it to everyone in the room
+    this.socket.send(JSON.stringify(frame));
+    return frame.id;
   }
 }
 